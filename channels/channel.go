@@ -26,6 +26,12 @@
  */
 package channels
 
+import (
+	"context"
+	"github.com/evilsocket/sg1/sg1"
+	"io"
+)
+
 type Direction int
 
 const (
@@ -39,12 +45,17 @@ type Stats struct {
 }
 
 type Channel interface {
+	// Return a new instance of the channel, flags are bound to the fields of
+	// the registered one so their values must be copied.
 	Copy() interface{}
 	Name() string
 	Description() string
 	Register() error
 	Setup(direction Direction, args string) error
 	Start() error
+	// Release listeners, sockets and goroutines of the channel, any pending or
+	// future Read will return io.EOF. It is safe to call it more than once.
+	Close() error
 
 	HasReader() bool
 	Read(b []byte) (n int, err error)
@@ -54,3 +65,32 @@ type Channel interface {
 
 	Stats() Stats
 }
+
+// Implemented by channels which can let the other end know that nothing else
+// will be written, so that its Read returns io.EOF. It must only be called when
+// the data being written is over, not when the channel is interrupted.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// Signal the end of the data written to w, if it supports it.
+func CloseWrite(w io.Writer) error {
+	if closer, ok := w.(CloseWriter); ok {
+		return closer.CloseWrite()
+	}
+	return nil
+}
+
+// Close the given channels as soon as the context is done, so that an
+// application embedding sg1 can stop them by cancelling it.
+func CloseOnCancel(ctx context.Context, channels ...Channel) {
+	go func() {
+		<-ctx.Done()
+		for _, channel := range channels {
+			sg1.Debug("Closing channel %s: %s\n", channel.Name(), ctx.Err())
+			if err := channel.Close(); err != nil {
+				sg1.Warning("Error while closing channel %s: %s\n", channel.Name(), err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package channels
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/evilsocket/sg1/sg1"
+	"github.com/stretchr/testify/assert"
+)
+
+// Enable -reliable with a short timeout until the end of the test.
+func enableReliable(t *testing.T) {
+	reliable, timeout := sg1.Reliable, sg1.ReliableTimeout
+	sg1.Reliable, sg1.ReliableTimeout = true, 50
+	t.Cleanup(func() {
+		sg1.Reliable, sg1.ReliableTimeout = reliable, timeout
+	})
+}
+
+// Read data written at once, which must arrive with a single read unless it
+// doesn't fit in one chunk of the channel.
+func readWritten(t *testing.T, c Channel, data string, chunk_size int) string {
+	if len(data) <= chunk_size {
+		return readString(t, c)
+	}
+	return readStringOfSize(t, c, len(data))
+}
+
+// Write the requests from the client, which the listener must read in the
+// same order, and the reply from the listener. Then end the stream of the
+// client, which must end the one of the listener, and close both.
+func testRoundTrip(t *testing.T, server, client Channel, chunk_size int, requests []string, reply string) {
+	for _, request := range requests {
+		_, err := client.Write([]byte(request))
+		assert.Nil(t, err)
+	}
+
+	if len(requests) == 1 {
+		assert.Equal(t, requests[0], readWritten(t, server, requests[0], chunk_size))
+	} else {
+		expected := strings.Join(requests, "")
+		assert.Equal(t, expected, readStringOfSize(t, server, len(expected)))
+	}
+
+	_, err := server.Write([]byte(reply))
+	assert.Nil(t, err)
+	assert.Equal(t, reply, readWritten(t, client, reply, chunk_size))
+
+	assert.Nil(t, CloseWrite(client))
+	_, err = server.Read(make([]byte, 16))
+	assert.NotNil(t, err)
+
+	client.Close()
+	server.Close()
+}
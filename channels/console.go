@@ -28,15 +28,42 @@ package channels
 
 import (
 	"github.com/evilsocket/sg1/sg1"
+	"io"
 	"os"
+	"sync"
 )
 
+const (
+	ConsoleBufferSize = 64 * 1024
+)
+
+// data read from the standard input, or the error that stopped it
+type consoleChunk struct {
+	data []byte
+	err  error
+}
+
+// Console reads from the standard input in its own goroutine, so that Close
+// can unblock a pending Read even if the standard input is not ours to close.
 type Console struct {
-	stats Stats
+	stdin   io.Reader
+	chunks  chan consoleChunk
+	pending []byte
+	err     error
+	reading sync.Once
+	done    chan struct{}
+	closing sync.Once
+	stats   Stats
 }
 
 func NewConsoleChannel() *Console {
-	return &Console{}
+	return &Console{
+		stdin:   os.Stdin,
+		chunks:  make(chan consoleChunk),
+		pending: nil,
+		err:     nil,
+		done:    make(chan struct{}),
+	}
 }
 
 func (c *Console) Copy() interface{} {
@@ -63,6 +90,17 @@ func (c *Console) Start() error {
 	return nil
 }
 
+// Standard input and output are not ours to close, so any pending or future
+// Read just returns io.EOF, what is read from the standard input afterwards
+// is dropped.
+func (c *Console) Close() error {
+	c.closing.Do(func() {
+		sg1.Debug("Closing console channel.\n")
+		close(c.done)
+	})
+	return nil
+}
+
 func (c *Console) HasReader() bool {
 	return true
 }
@@ -71,15 +109,65 @@ func (c *Console) HasWriter() bool {
 	return true
 }
 
+func (c *Console) reader() {
+	for {
+		buff := make([]byte, ConsoleBufferSize)
+		n, err := c.stdin.Read(buff)
+		if n > 0 {
+			select {
+			case c.chunks <- consoleChunk{data: buff[:n]}:
+			case <-c.done:
+				return
+			}
+		}
+
+		if err != nil {
+			select {
+			case c.chunks <- consoleChunk{err: err}:
+			case <-c.done:
+			}
+			return
+		}
+	}
+}
+
 func (c *Console) Read(b []byte) (n int, err error) {
-	n, err = os.Stdin.Read(b)
-	if n > 0 {
-		c.stats.TotalRead += n
+	c.reading.Do(func() {
+		go c.reader()
+	})
+
+	select {
+	case <-c.done:
+		return 0, io.EOF
+	default:
 	}
 
+	// chunks can be bigger than the buffer, what is left is kept for the
+	// next reads
+	if len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		select {
+		case chunk := <-c.chunks:
+			if chunk.err != nil {
+				c.err = chunk.err
+				return 0, c.err
+			}
+			c.pending = chunk.data
+		case <-c.done:
+			return 0, io.EOF
+		}
+	}
+
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	c.stats.TotalRead += n
+
 	sg1.Debug("Read %d bytes from stdin.\n", n)
 
-	return n, err
+	return n, nil
 }
 
 func (c *Console) Write(b []byte) (n int, err error) {
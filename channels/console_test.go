@@ -0,0 +1,59 @@
+package channels
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsoleRead(t *testing.T) {
+	c := NewConsoleChannel()
+	c.stdin = strings.NewReader("hello console")
+
+	buff := make([]byte, 5)
+	received := ""
+	for {
+		n, err := c.Read(buff)
+		received += string(buff[:n])
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+	}
+	assert.Equal(t, "hello console", received)
+}
+
+func TestConsoleClose(t *testing.T) {
+	// nothing is ever written to the pipe, so reading from it blocks
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	c := NewConsoleChannel()
+	c.stdin = r
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Read(make([]byte, 16))
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, c.Close())
+
+	select {
+	case err := <-done:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not unblock Read.")
+	}
+
+	_, err = c.Read(make([]byte, 16))
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, c.Close())
+}
@@ -0,0 +1,399 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DeadDropDefaultStream = "SG1STREAM"
+	DeadDropChunkSize     = 128 * 1024
+	DeadDropPollTime      = 1000
+	// The listener writes data back to the client on a separate stream, so that
+	// the two ends of a tunnel never read their own blobs.
+	ReplyStreamSuffix = "-REPLY"
+)
+
+type DeadDropBlob struct {
+	// identifier of the blob for the service
+	Key string
+	// name the blob was created with
+	Name string
+}
+
+// A DeadDrop is a store-and-forward service where one end of a channel
+// leaves blobs for the other end to pick up later, such as a paste site, a
+// directory or a key-value store.
+type DeadDrop interface {
+	// Store a new blob with the given name.
+	Put(name string, data []byte) error
+	// List the blobs currently stored, in any order.
+	List() ([]DeadDropBlob, error)
+	// Return the data of a blob.
+	Get(key string) ([]byte, error)
+	// Delete a blob, this must fail if the blob was already deleted since it
+	// is how readers claim the blobs they process.
+	Delete(key string) error
+}
+
+// DeadDropChannel implements a channel on top of a DeadDrop: data is split
+// in packets stored as blobs named after the stream and the time they were
+// written, which the other end polls for, processes in order and deletes.
+type DeadDropChannel struct {
+	name       string
+	drop       DeadDrop
+	is_client  bool
+	preserve   bool
+	stream     string
+	chunk_size int
+	poll_time  int
+	demux      *sg1.PacketDemuxer
+	seq        *sg1.PacketSequencer
+	pending    []byte
+	seen       map[string]bool
+	last_time  int64
+	mutex      *sync.Mutex
+	polling    sync.Once
+	pollers    sync.WaitGroup
+	done       chan struct{}
+	closing    sync.Once
+	stats      Stats
+}
+
+func NewDeadDropChannel(name string, stream string, chunk_size int) *DeadDropChannel {
+	return &DeadDropChannel{
+		name:       name,
+		drop:       nil,
+		is_client:  true,
+		preserve:   false,
+		stream:     stream,
+		chunk_size: chunk_size,
+		poll_time:  DeadDropPollTime,
+		demux:      sg1.NewPacketDemuxer(),
+		seq:        sg1.NewPacketSequencer(),
+		pending:    nil,
+		seen:       make(map[string]bool),
+		last_time:  0,
+		mutex:      &sync.Mutex{},
+		done:       make(chan struct{}),
+	}
+}
+
+// Split an optional "#stream" suffix from the arguments of a channel.
+func (c *DeadDropChannel) parseStream(args string) string {
+	if idx := strings.LastIndex(args, "#"); idx != -1 && idx < len(args)-1 {
+		c.stream = args[idx+1:]
+		return args[:idx]
+	}
+	return args
+}
+
+func (c *DeadDropChannel) setup(direction Direction, drop DeadDrop) {
+	c.is_client = direction != INPUT_CHANNEL
+	c.drop = drop
+
+	sg1.Debug("Setup %s channel: direction=%d stream='%s'\n", c.name, direction, c.stream)
+}
+
+func (c *DeadDropChannel) Start() error {
+	if c.is_client == true {
+		sg1.Log("Sending data to %s ...\n", c.name)
+	} else {
+		sg1.Log("Running %s listener ...\n\n", c.name)
+
+		c.startPolling()
+	}
+
+	return nil
+}
+
+// Start polling the blobs of the stream we're reading from, this only happens
+// once and for the client only when it's actually used for reading.
+func (c *DeadDropChannel) startPolling() {
+	c.polling.Do(func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		c.pollers.Add(1)
+		go func() {
+			defer c.pollers.Done()
+			c.poller()
+		}()
+	})
+}
+
+// Return the blobs of the stream we're reading from that have not been
+// processed yet, oldest first.
+func (c *DeadDropChannel) listPending(stream string) ([]DeadDropBlob, error) {
+	blobs, err := c.drop.List()
+	if err != nil {
+		return nil, err
+	}
+
+	sg1.Debug("Filtering %d blobs by stream '%s'.\n", len(blobs), stream)
+
+	filtered := make([]DeadDropBlob, 0)
+	times := make(map[string]int64)
+	for _, blob := range blobs {
+		if c.seen[blob.Key] {
+			continue
+		} else if ts, ok := parseBlobName(blob.Name, stream); ok {
+			filtered = append(filtered, blob)
+			times[blob.Key] = ts
+		}
+	}
+
+	// the name has the timestamp of the writer, which is more accurate than
+	// the creation date of the service and strictly increasing for the same
+	// stream
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return times[filtered[i].Key] < times[filtered[j].Key]
+	})
+
+	return filtered, nil
+}
+
+func blobName(stream string, ts int64) string {
+	return fmt.Sprintf("SG1 %s 0x%016x", stream, ts)
+}
+
+// Parse a blob name as "SG1 <stream> 0x<timestamp>", returns the timestamp
+// and whether the blob belongs to the stream.
+func parseBlobName(name string, stream string) (int64, bool) {
+	parts := strings.Split(name, " ")
+	if len(parts) != 3 || parts[0] != "SG1" || parts[1] != stream {
+		return 0, false
+	}
+
+	ts, err := strconv.ParseInt(parts[2], 0, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return ts, true
+}
+
+// Fetch a blob and, unless we're preserving them, claim it by deleting it:
+// if another reader of the same drop deleted it first, it's theirs.
+func (c *DeadDropChannel) process(blob DeadDropBlob) {
+	sg1.Debug("Requesting blob %s (%s) ...\n", blob.Key, blob.Name)
+
+	data, err := c.drop.Get(blob.Key)
+	if err != nil {
+		sg1.Warning("Error while requesting blob %s: %s\n", blob.Key, err)
+		return
+	}
+
+	if c.preserve {
+		c.seen[blob.Key] = true
+	} else if err = c.drop.Delete(blob.Key); err != nil {
+		sg1.Debug("Could not claim blob %s, skipping it: %s\n", blob.Key, err)
+		return
+	}
+
+	packet, err := sg1.DecodePacket(data)
+	if err != nil {
+		sg1.Error("Error while decoding blob %s: %s\n", blob.Key, err)
+		return
+	}
+
+	sg1.Debug("Decoded packet of %d bytes.\n", packet.DataSize)
+
+	c.mutex.Lock()
+	c.stats.TotalRead += int(packet.DataSize)
+	c.mutex.Unlock()
+
+	c.demux.Add(packet)
+}
+
+func (c *DeadDropChannel) poller() {
+	stream := c.readStream()
+
+	for {
+		blobs, err := c.listPending(stream)
+		if err != nil {
+			sg1.Error("Error while requesting %s blobs: %s.\n", c.name, err)
+		} else {
+			sg1.Debug("Got %d blobs to process.\n", len(blobs))
+		}
+
+		for _, blob := range blobs {
+			select {
+			case <-c.done:
+				sg1.Debug("%s poller stopped.\n", c.name)
+				return
+			default:
+			}
+
+			c.process(blob)
+		}
+
+		// if we got blobs there might be more, otherwise wait for them
+		wait := time.Duration(c.poll_time) * time.Millisecond
+		if len(blobs) > 0 {
+			wait = 0
+		}
+
+		sg1.Debug("Waiting for %s ...\n", wait)
+		select {
+		case <-time.After(wait):
+		case <-c.done:
+			sg1.Debug("%s poller stopped.\n", c.name)
+			return
+		}
+	}
+}
+
+func (c *DeadDropChannel) CloseWrite() error {
+	if c.drop == nil || c.demux.IsClosed() || (c.is_client == false && c.Stats().TotalWrote == 0) {
+		return nil
+	}
+
+	sg1.Debug("Sending %s FIN packet.\n", c.name)
+	return c.send(c.seq.Fin())
+}
+
+func (c *DeadDropChannel) Close() error {
+	c.closing.Do(func() {
+		sg1.Debug("Closing %s channel.\n", c.name)
+
+		c.mutex.Lock()
+		close(c.done)
+		c.mutex.Unlock()
+
+		c.demux.Close()
+		// the drop might be released right after we return
+		c.pollers.Wait()
+	})
+	return nil
+}
+
+func (c *DeadDropChannel) HasReader() bool {
+	return true
+}
+
+func (c *DeadDropChannel) HasWriter() bool {
+	return true
+}
+
+func (c *DeadDropChannel) readStream() string {
+	if c.is_client {
+		return c.stream + ReplyStreamSuffix
+	}
+	return c.stream
+}
+
+func (c *DeadDropChannel) writeStream() string {
+	if c.is_client {
+		return c.stream
+	}
+	return c.stream + ReplyStreamSuffix
+}
+
+func (c *DeadDropChannel) Read(b []byte) (n int, err error) {
+	c.startPolling()
+
+	// packets can be bigger than the buffer, what is left is kept for the
+	// next reads
+	if len(c.pending) == 0 {
+		packet, err := c.demux.Get()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = packet.Data
+	}
+
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	sg1.Debug("Read %d bytes from %s channel.\n", n, c.name)
+
+	return n, nil
+}
+
+// Return a timestamp for the name of a new blob, strictly increasing even
+// if several blobs are created within the same millisecond.
+func (c *DeadDropChannel) nextTime() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := sg1.Time()
+	if now <= c.last_time {
+		now = c.last_time + 1
+	}
+	c.last_time = now
+
+	return now
+}
+
+func (c *DeadDropChannel) send(packet *sg1.Packet) error {
+	name := blobName(c.writeStream(), c.nextTime())
+
+	sg1.Log("Sending %s blob for payload of %d bytes.\n", c.name, packet.DataSize)
+
+	return c.drop.Put(name, packet.Raw())
+}
+
+func (c *DeadDropChannel) Write(b []byte) (n int, err error) {
+	sg1.Debug("Writing %d bytes to %s channel as chunks of %d bytes.\n", len(b), c.name, c.chunk_size)
+
+	wrote := 0
+	for _, packet := range c.seq.Packets(b, c.chunk_size) {
+		if err = c.send(packet); err != nil {
+			return wrote, err
+		}
+
+		wrote += int(packet.DataSize)
+
+		c.mutex.Lock()
+		c.stats.TotalWrote += int(packet.DataSize)
+		c.mutex.Unlock()
+	}
+
+	sg1.Debug("Wrote %d bytes to %s channel.\n", wrote, c.name)
+
+	return wrote, nil
+}
+
+func (c *DeadDropChannel) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
@@ -0,0 +1,151 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"flag"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// temporary files being written, never listed
+const DirTempPrefix = ".sg1-"
+
+// DirDrop stores blobs as files of a directory, which can be local or a
+// mounted network share, with their names escaped to be valid file names.
+type DirDrop struct {
+	path string
+}
+
+func NewDirDrop(path string) *DirDrop {
+	return &DirDrop{
+		path: path,
+	}
+}
+
+func (d *DirDrop) Put(name string, data []byte) error {
+	// write to a temporary file first, so that readers never see partial blobs
+	tmp, err := os.CreateTemp(d.path, DirTempPrefix)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	} else if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(d.path, url.QueryEscape(name)))
+}
+
+func (d *DirDrop) List() ([]DeadDropBlob, error) {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make([]DeadDropBlob, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), DirTempPrefix) {
+			continue
+		}
+
+		name, err := url.QueryUnescape(entry.Name())
+		if err != nil {
+			sg1.Debug("Skipping file %s: %s\n", entry.Name(), err)
+			continue
+		}
+
+		blobs = append(blobs, DeadDropBlob{Key: entry.Name(), Name: name})
+	}
+
+	return blobs, nil
+}
+
+func (d *DirDrop) Get(key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(d.path, key))
+}
+
+func (d *DirDrop) Delete(key string) error {
+	return os.Remove(filepath.Join(d.path, key))
+}
+
+type DirChannel struct {
+	*DeadDropChannel
+}
+
+func NewDirChannel() *DirChannel {
+	return &DirChannel{
+		DeadDropChannel: NewDeadDropChannel("dir", DeadDropDefaultStream, DeadDropChunkSize),
+	}
+}
+
+func (c *DirChannel) Copy() interface{} {
+	cp := NewDirChannel()
+	cp.preserve = c.preserve
+	cp.poll_time = c.poll_time
+	return cp
+}
+
+func (c *DirChannel) Name() string {
+	return "dir"
+}
+
+func (c *DirChannel) Register() error {
+	flag.BoolVar(&c.preserve, "dir-preserve", c.preserve, "Do not delete files after reading them.")
+	flag.IntVar(&c.poll_time, "dir-poll-time", c.poll_time, "Number of milliseconds to wait between one listing of the directory and another.")
+	return nil
+}
+
+func (c *DirChannel) Description() string {
+	return "Read and write data as files of a local or shared directory."
+}
+
+func (c *DirChannel) Setup(direction Direction, args string) error {
+	path := c.parseStream(args)
+	if path == "" {
+		return fmt.Errorf("Usage: dir:/path/to/directory(#stream_name)?")
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		return err
+	} else if info.IsDir() == false {
+		return fmt.Errorf("%s is not a directory.", path)
+	}
+
+	c.setup(direction, NewDirDrop(path))
+
+	return nil
+}
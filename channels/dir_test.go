@@ -0,0 +1,145 @@
+package channels
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDirChannels(t *testing.T, path string) (*DirChannel, *DirChannel) {
+	server := NewDirChannel()
+	server.poll_time = 10
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, path+"#TEST"))
+	assert.Nil(t, server.Start())
+
+	client := NewDirChannel()
+	client.poll_time = 10
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, path+"#TEST"))
+	assert.Nil(t, client.Start())
+
+	return server, client
+}
+
+func TestDirDrop(t *testing.T) {
+	drop := NewDirDrop(t.TempDir())
+
+	name := "SG1 some/stream 0x01"
+	assert.Nil(t, drop.Put(name, []byte("hello")))
+
+	blobs, err := drop.List()
+	assert.Nil(t, err)
+	if assert.Len(t, blobs, 1) {
+		assert.Equal(t, name, blobs[0].Name)
+
+		data, err := drop.Get(blobs[0].Key)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+
+		assert.Nil(t, drop.Delete(blobs[0].Key))
+		// a blob can only be claimed once
+		assert.NotNil(t, drop.Delete(blobs[0].Key))
+	}
+
+	blobs, err = drop.List()
+	assert.Nil(t, err)
+	assert.Empty(t, blobs)
+}
+
+func TestDirChannel(t *testing.T) {
+	path := t.TempDir()
+	server, client := newTestDirChannels(t, path)
+
+	// messages are read in the order they were written
+	testRoundTrip(t, server, client, client.chunk_size, []string{"first", "second", "third"}, "hello client")
+
+	// every blob has been claimed
+	entries, err := os.ReadDir(path)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	assert.NotNil(t, NewDirChannel().Setup(INPUT_CHANNEL, filepath.Join(path, "missing")))
+}
+
+func TestDirChannelPreserve(t *testing.T) {
+	path := t.TempDir()
+	drop := NewDirDrop(path)
+
+	writer := NewDirChannel()
+	writer.drop = drop
+	_, err := writer.Write([]byte("preserved"))
+	assert.Nil(t, err)
+
+	// every reader gets the data and the blobs stay where they are
+	for i := 0; i < 2; i++ {
+		reader := NewDirChannel()
+		reader.preserve = true
+		reader.poll_time = 10
+		assert.Nil(t, reader.Setup(INPUT_CHANNEL, path))
+		assert.Nil(t, reader.Start())
+		assert.Equal(t, "preserved", readString(t, reader))
+		reader.Close()
+	}
+
+	blobs, err := drop.List()
+	assert.Nil(t, err)
+	assert.Len(t, blobs, 1)
+}
+
+func TestDirChannelCloseWrite(t *testing.T) {
+	path := t.TempDir()
+	drop := NewDirDrop(path)
+
+	client := NewDirChannel()
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, path+"#TEST"))
+	assert.Nil(t, client.Start())
+
+	_, err := client.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	// only the end of the data sends the FIN packet, not Close
+	client.Close()
+	blobs, err := drop.List()
+	assert.Nil(t, err)
+	assert.Len(t, blobs, 1)
+
+	path = t.TempDir()
+	drop = NewDirDrop(path)
+
+	client = NewDirChannel()
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, path+"#TEST"))
+	assert.Nil(t, client.Start())
+	assert.Nil(t, client.CloseWrite())
+	client.Close()
+
+	blobs, err = drop.List()
+	assert.Nil(t, err)
+	assert.Len(t, blobs, 1)
+}
+
+func TestDirChannelLargeWrite(t *testing.T) {
+	server, client := newTestDirChannels(t, t.TempDir())
+	defer client.Close()
+
+	// a packet bigger than the buffer of the tunnel is read across several
+	// reads
+	tunnel := NewTunnel(server)
+	defer tunnel.Close()
+
+	message := bytes.Repeat([]byte("0123456789abcdef"), 100*1024/16)
+	_, err := client.Write(message)
+	assert.Nil(t, err)
+
+	received := make([]byte, 0)
+	buff := make([]byte, TunnelBufferSize)
+	for len(received) < len(message) {
+		n, err := tunnel.Read(buff)
+		if !assert.Nil(t, err) {
+			break
+		}
+		received = append(received, buff[:n]...)
+	}
+	assert.Equal(t, message, received)
+}
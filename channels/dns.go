@@ -27,47 +27,115 @@
 package channels
 
 import (
-	"encoding/hex"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"github.com/evilsocket/sg1/sg1"
 	"github.com/miekg/dns"
 	"net"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// answers are kept below the size recommended for EDNS0 buffers
+	DNSUDPSize = 1232
+	// default DNS over TLS port
+	DNSTLSPort = 853
+	// how many answers the listener remembers for retried questions
+	DNSAnswerCacheSize = 256
+)
+
+// Each transport maps to the miekg/dns networks, a plain DNS listener also
+// accepts TCP since resolvers retry over it when an answer is truncated.
+var DNSTransports = map[string][]string{
+	"udp": {"udp", "tcp"},
+	"tcp": {"tcp"},
+	"tls": {"tcp-tls"},
+}
+
 var (
-	DNSChunkSize         = 16
 	DNSHostAddressParser = regexp.MustCompile("^([^@]+)@([^:]+):([\\d]+)$")
 	DNSAddressParser     = regexp.MustCompile("^([^:]+):([\\d]+)$")
-	DNSQuestionParser    = regexp.MustCompile("^([a-fA-F0-9]+)\\.(.+)\\.$")
 )
 
+// DNSChannel sends packets in the name of DNS questions, the listener
+// answers each question with one of the packets it has to send back, if
+// any, encoded in records of the -dns-qtype type. When used for reading,
+// the client polls the listener for new data. With -reliable the listener
+// answers data with its ACK, while the client sends its ACKs as questions
+// in place of polls.
 type DNSChannel struct {
-	is_client bool
-	domain    string
-	address   string
-	port      int
-	seq       *sg1.PacketSequencer
-	server    dns.Server
-	client    *dns.Client
-	stats     Stats
+	is_client  bool
+	domain     string
+	address    string
+	port       int
+	qtype_name string
+	qtype      uint16
+	enc_name   string
+	encoding   DNSEncoding
+	poll_time  int
+	transport  string
+	insecure   bool
+	demux      *sg1.PacketDemuxer
+	seq        *sg1.PacketSequencer
+	servers    []*dns.Server
+	resolve    func(m *dns.Msg) (*dns.Msg, error)
+	outbox     []*sg1.Packet
+	acks       []*sg1.Packet
+	pending    []byte
+	reliable   *sg1.ReliableSender
+	answers    map[string][]dns.RR
+	answered   []string
+	running    []*dns.Server
+	closed     bool
+	mutex      *sync.Mutex
+	polling    sync.Once
+	done       chan struct{}
+	stats      Stats
 }
 
 func NewDNSChannel() *DNSChannel {
 	return &DNSChannel{
-		is_client: true,
-		domain:    "google.com",
-		address:   "",
-		port:      53,
-		server:    dns.Server{Addr: ":53", Net: "udp"},
-		client:    nil,
-		seq:       sg1.NewPacketSequencer(),
+		is_client:  true,
+		domain:     "google.com",
+		address:    "",
+		port:       53,
+		qtype_name: "A",
+		qtype:      dns.TypeA,
+		enc_name:   "base32",
+		encoding:   DNSEncodings["base32"],
+		poll_time:  1000,
+		transport:  "udp",
+		insecure:   false,
+		servers:    make([]*dns.Server, 0),
+		resolve:    nil,
+		demux:      sg1.NewPacketDemuxer(),
+		seq:        sg1.NewPacketSequencer(),
+		outbox:     make([]*sg1.Packet, 0),
+		acks:       make([]*sg1.Packet, 0),
+		pending:    nil,
+		reliable:   nil,
+		answers:    make(map[string][]dns.RR),
+		answered:   make([]string, 0),
+		running:    make([]*dns.Server, 0),
+		closed:     false,
+		mutex:      &sync.Mutex{},
+		done:       make(chan struct{}),
 	}
 }
 
 func (c *DNSChannel) Copy() interface{} {
-	return NewDNSChannel()
+	cp := NewDNSChannel()
+	cp.qtype_name = c.qtype_name
+	cp.enc_name = c.enc_name
+	cp.poll_time = c.poll_time
+	cp.transport = c.transport
+	cp.insecure = c.insecure
+	return cp
 }
 
 func (c *DNSChannel) Name() string {
@@ -75,72 +143,218 @@ func (c *DNSChannel) Name() string {
 }
 
 func (c *DNSChannel) Description() string {
-	return "As input, read data from incoming DNS requests (example server: dns:example.com@192.168.1.2:5353), as output write data as DNS requests (example client: dns:example.com@192.168.1.2:5353)."
+	return "As input, read data from incoming DNS requests and send data back in the answers (example server: dns:example.com@192.168.1.2:5353), as output write data as DNS requests and read it from the answers (example client: dns:example.com@192.168.1.2:5353)."
 }
 
 func (c *DNSChannel) Register() error {
+	flag.StringVar(&c.qtype_name, "dns-qtype", c.qtype_name, "Type of the DNS records carrying data from the listener to the client, can be A, AAAA, TXT, CNAME, MX or NULL.")
+	flag.StringVar(&c.transport, "dns-transport", c.transport, "DNS transport, can be udp, tcp or tls ( DNS over TLS ), the listener will use the same.")
+	flag.StringVar(&c.enc_name, "dns-encoding", c.enc_name, "Encoding of the data in the DNS question names, can be hex, base32 or base36.")
+	flag.IntVar(&c.poll_time, "dns-poll-time", c.poll_time, "Number of milliseconds to wait between one DNS poll request and another when reading from the listener.")
+	flag.BoolVar(&c.insecure, "dns-insecure", c.insecure, "Do not verify the certificate of the DNS over TLS server, needed to reach the self signed dns listener.")
 	return nil
 }
 
-func parseQuestion(r *dns.Msg) (chunk []byte, domain string, err error) {
+func parseQuestion(r *dns.Msg, domain string, encoding DNSEncoding) (chunk []byte, err error) {
 	if len(r.Question) != 1 {
-		return nil, "", fmt.Errorf("Unexpected number of questions.")
+		return nil, fmt.Errorf("Unexpected number of questions.")
+	}
+
+	if chunk, err = decodeName(r.Question[0].Name, domain, encoding); err != nil {
+		return nil, fmt.Errorf("Could not decode DNS query question: %s", err)
+	}
+
+	return chunk, nil
+}
+
+// Process the packet of a question and return the answer records, the same
+// question always gets the same answer so that a resolver retrying it won't
+// make us lose data.
+func (c *DNSChannel) answer(question dns.Question, packet *sg1.Packet) []dns.RR {
+	key := fmt.Sprintf("%s/%d", strings.ToLower(question.Name), question.Qtype)
+
+	c.mutex.Lock()
+	if answer, found := c.answers[key]; found {
+		c.mutex.Unlock()
+		sg1.Debug("Answering retried DNS question for %s.\n", question.Name)
+		return answer
+	}
+
+	has_data := packet.IsPoll() == false && packet.IsAck() == false
+
+	answer := []dns.RR{}
+	var reply *sg1.Packet
+	if question.Qtype != c.qtype {
+		sg1.Debug("DNS question type %s does not match %s.\n", dns.TypeToString[question.Qtype], c.qtype_name)
+	} else if c.reliable != nil && has_data {
+		// polls and ACKs will fetch the outbox instead
+		reply = sg1.NewAckPacket(packet)
+	} else if len(c.outbox) > 0 {
+		reply = c.outbox[0]
+		c.outbox = c.outbox[1:]
+	}
+
+	if reply != nil {
+		var err error
+		if answer, err = encodeAnswer(c.qtype, question.Name, c.domain, c.encoding, reply.Raw()); err != nil {
+			sg1.Error("Error while encoding DNS answer: %s\n", err)
+		}
+	}
+
+	c.answers[key] = answer
+	c.answered = append(c.answered, key)
+	if len(c.answered) > DNSAnswerCacheSize {
+		delete(c.answers, c.answered[0])
+		c.answered = c.answered[1:]
+	}
+
+	if has_data {
+		c.stats.TotalRead += int(packet.DataSize)
+	}
+	c.mutex.Unlock()
+
+	if packet.IsAck() {
+		if c.reliable != nil {
+			c.reliable.Ack(packet)
+		}
+	} else if has_data {
+		c.demux.Add(packet)
 	}
 
-	m := DNSQuestionParser.FindStringSubmatch(r.Question[0].Name)
-	if len(m) != 3 {
-		return nil, "", fmt.Errorf("Could not parse DNS query question.")
+	return answer
+}
+
+// Build the reply to a DNS message, or return nil if it's not for us.
+func (c *DNSChannel) reply(r *dns.Msg) *dns.Msg {
+	chunk, err := parseQuestion(r, c.domain, c.encoding)
+	if err != nil {
+		sg1.Debug("Ignoring DNS message: %s\n", err)
+		return nil
 	}
 
-	chunk_hex := m[1]
-	domain = m[2]
-	if chunk, err = hex.DecodeString(chunk_hex); err != nil {
-		return nil, "", fmt.Errorf("Could not decode hex chunk.")
+	packet, err := sg1.DecodePacket(chunk)
+	if err != nil {
+		sg1.Error("Error while decoding packet: %s\n", err)
+		return nil
 	}
 
-	return chunk, domain, nil
+	sg1.Debug("Decoded packet of %d bytes.\n", packet.DataSize)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Answer = c.answer(r.Question[0], packet)
+
+	return m
+}
+
+func (c *DNSChannel) handler(w dns.ResponseWriter, r *dns.Msg) {
+	sg1.Debug("Got DNS message.\n")
+
+	m := c.reply(r)
+	if m == nil {
+		return
+	}
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+		m.SetEdns0(opt.UDPSize(), false)
+	}
+
+	// only UDP answers are limited in size
+	if _, is_udp := w.RemoteAddr().(*net.UDPAddr); is_udp {
+		m.Truncate(size)
+	}
+
+	w.WriteMsg(m)
 }
 
 func (c *DNSChannel) setupServer(args string) error {
 	c.is_client = false
 
+	address := ":53"
 	if c.address != "" {
-		c.server.Addr = fmt.Sprintf("%s:%d", c.address, c.port)
-	}
-
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		sg1.Debug("Got DNS message.\n")
-		if chunk, domain, err := parseQuestion(r); err == nil {
-			if c.domain == "" || c.domain == domain {
-				if packet, err := sg1.DecodePacket(chunk); err == nil {
-					sg1.Debug("Decoded packet of %d bytes.\n", packet.DataSize)
-
-					c.stats.TotalRead += int(packet.DataSize)
-					c.seq.Add(packet)
-
-					m := new(dns.Msg)
-					m.SetReply(r)
-					w.WriteMsg(m)
-				} else {
-					sg1.Error("Error while decoding packet: %s\n", err)
-				}
-			} else {
-				sg1.Debug("Domain did not match '%s': %s.\n", c.domain, domain)
+		address = net.JoinHostPort(c.address, strconv.Itoa(c.port))
+	} else if c.transport == "tls" {
+		address = fmt.Sprintf(":%d", DNSTLSPort)
+	}
+
+	for _, network := range DNSTransports[c.transport] {
+		server := &dns.Server{
+			Addr:    address,
+			Net:     network,
+			Handler: dns.HandlerFunc(c.handler),
+		}
+
+		if network == "tcp-tls" {
+			config, err := getCertificateConfig("", "")
+			if err != nil {
+				return err
 			}
-		} else {
-			sg1.Warning("Error while parsing DNS message: %s\n", err)
+			server.TLSConfig = config
 		}
-	})
+
+		c.servers = append(c.servers, server)
+	}
 
 	return nil
 }
 
 func (c *DNSChannel) setupClient(args string) error {
 	c.is_client = true
+
+	if c.address == "" {
+		// use the system resolver if we can find it, otherwise fall back
+		// to plain lookups and only send data
+		if config, err := dns.ClientConfigFromFile("/etc/resolv.conf"); err == nil && len(config.Servers) > 0 {
+			c.address = config.Servers[0]
+			if c.port, err = strconv.Atoi(config.Port); err != nil {
+				return err
+			} else if c.transport == "tls" {
+				c.port = DNSTLSPort
+			}
+		}
+	}
+
 	if c.address != "" {
-		c.client = new(dns.Client)
+		client := &dns.Client{
+			Net:       DNSTransports[c.transport][0],
+			UDPSize:   DNSUDPSize,
+			TLSConfig: &tls.Config{InsecureSkipVerify: c.insecure},
+		}
+		resolver := net.JoinHostPort(c.address, strconv.Itoa(c.port))
+
+		c.resolve = func(m *dns.Msg) (*dns.Msg, error) {
+			sg1.Debug("Sending DNS question for %s to resolver %s over %s.\n", m.Question[0].Name, resolver, c.transport)
+			r, _, err := client.Exchange(m, resolver)
+			return r, err
+		}
+	} else if sg1.Reliable {
+		return fmt.Errorf("dns client needs a resolver address to read the ACKs of the listener.")
 	} else {
-		c.client = nil
+		c.resolve = nil
+	}
+
+	return nil
+}
+
+// Validate the record type, the encoding and the domain.
+func (c *DNSChannel) setupEncoding() error {
+	qtype, found := DNSQueryTypes[strings.ToUpper(c.qtype_name)]
+	if found == false {
+		return fmt.Errorf("Unsupported DNS record type '%s'.", c.qtype_name)
+	}
+	c.qtype = qtype
+
+	encoding, found := DNSEncodings[strings.ToLower(c.enc_name)]
+	if found == false {
+		return fmt.Errorf("Unsupported DNS encoding '%s'.", c.enc_name)
+	}
+	c.encoding = encoding
+
+	if nameCapacity(c.domain, c.encoding) <= sg1.PACKET_HEADER_SIZE {
+		return fmt.Errorf("Domain '%s' is too long to carry data.", c.domain)
 	}
 
 	return nil
@@ -160,9 +374,18 @@ func (c *DNSChannel) Setup(direction Direction, args string) (err error) {
 		if c.port, err = strconv.Atoi(m[2]); err != nil {
 			return err
 		}
+	} else if args != "" {
+		// dns:evil.com
+		c.domain = args
 	}
 
-	sg1.Debug("Setup DNS channel from args '%s': direction=%d domain='%s' resolver='%s' port=%d\n", args, direction, c.domain, c.address, c.port)
+	if _, found := DNSTransports[c.transport]; found == false {
+		return fmt.Errorf("Unsupported DNS transport '%s'.", c.transport)
+	} else if err = c.setupEncoding(); err != nil {
+		return err
+	}
+
+	sg1.Debug("Setup DNS channel from args '%s': direction=%d domain='%s' resolver='%s' port=%d qtype=%s encoding=%s transport=%s\n", args, direction, c.domain, c.address, c.port, c.qtype_name, c.enc_name, c.transport)
 
 	if direction == INPUT_CHANNEL {
 		return c.setupServer(args)
@@ -171,97 +394,339 @@ func (c *DNSChannel) Setup(direction Direction, args string) (err error) {
 	}
 }
 
+// Create the reliable sender if -reliable was passed, the listener sends
+// packets by queueing them for the client polls.
+func (c *DNSChannel) startReliable() {
+	if sg1.Reliable {
+		c.reliable = sg1.NewReliableSender(c.transmit, sg1.ReliableWindow, time.Duration(sg1.ReliableTimeout)*time.Millisecond, sg1.ReliableRetries)
+		c.reliable.Start()
+	}
+}
+
 func (c *DNSChannel) Start() error {
-	c.seq.Start()
+	c.startReliable()
 
 	if c.is_client == true {
 		sg1.Log("Performing DNS lookups ...\n")
 	} else {
-		sg1.Log("Running DNS server on '%s:%d' ...\n", c.address, c.port)
-
-		go func() {
-			if err := c.server.ListenAndServe(); err != nil {
-				panic(err)
+		for _, server := range c.servers {
+			if err := c.serve(server); err != nil {
+				c.Close()
+				return err
 			}
-		}()
+		}
 	}
 
 	return nil
 }
 
-func (c *DNSChannel) HasReader() bool {
-	if c.is_client == false {
-		return true
-	} else {
-		return false
+// Start the server and wait for it to be listening.
+func (c *DNSChannel) serve(server *dns.Server) error {
+	sg1.Log("Running DNS server on '%s' (%s) ...\n", server.Addr, server.Net)
+
+	running := false
+	started := make(chan error, 1)
+	server.NotifyStartedFunc = func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		running = true
+		c.running = append(c.running, server)
+		started <- nil
 	}
+
+	go func() {
+		err := server.ListenAndServe()
+
+		c.mutex.Lock()
+		was_running, closed := running, c.closed
+		c.mutex.Unlock()
+
+		if was_running == false {
+			// failed to start, let Start return the error
+			started <- err
+		} else if err != nil && closed == false {
+			sg1.Error("DNS server stopped: %s\n", err)
+			c.Close()
+		}
+	}()
+
+	return <-started
 }
 
-func (c *DNSChannel) HasWriter() bool {
-	if c.is_client == false {
-		return false
-	} else {
-		return true
+func (c *DNSChannel) outboxSize() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.outbox)
+}
+
+func (c *DNSChannel) CloseWrite() error {
+	c.mutex.Lock()
+	wrote := c.stats.TotalWrote
+	closed := c.closed
+	c.mutex.Unlock()
+
+	if closed || c.demux.IsClosed() || (c.is_client == false && wrote == 0) {
+		return nil
+	}
+
+	sg1.Debug("Sending DNS FIN packet.\n")
+
+	fin := c.seq.Fin()
+	if c.reliable != nil {
+		if err := c.reliable.Send(fin); err != nil {
+			return err
+		}
+		return c.reliable.Flush()
 	}
+	return c.send(fin)
 }
 
-func (c *DNSChannel) Read(b []byte) (n int, err error) {
-	if c.is_client {
-		return 0, fmt.Errorf("dns client can't be used for reading.")
+func (c *DNSChannel) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
 	}
 
-	packet := c.seq.Get()
-	data := packet.Data
-	for i, c := range data {
-		b[i] = c
+	sg1.Debug("Closing DNS channel.\n")
+
+	c.closed = true
+	c.mutex.Unlock()
+
+	close(c.done)
+	if c.reliable != nil {
+		c.reliable.Close()
 	}
+	c.demux.Close()
 
-	sg1.Debug("Read %d bytes from DNS listener.\n", len(data))
+	c.mutex.Lock()
+	running := c.running
+	c.running = nil
+	c.mutex.Unlock()
 
-	return len(data), nil
+	if c.is_client == false {
+		// give the client the chance to poll what's left
+		for i := 0; i < 20 && c.outboxSize() > 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for _, server := range running {
+		if err := server.Shutdown(); err != nil {
+			sg1.Warning("Error while stopping DNS server: %s\n", err)
+		}
+	}
+	return nil
+}
+
+func (c *DNSChannel) HasReader() bool {
+	return true
+}
+
+func (c *DNSChannel) HasWriter() bool {
+	return true
 }
 
-func (c *DNSChannel) Lookup(fqdn string) error {
-	if c.client == nil {
+// Send a question with the given packet and process the data sent back by
+// the listener. Returns the number of packets received.
+func (c *DNSChannel) exchange(packet *sg1.Packet) (int, error) {
+	fqdn, err := encodeName(packet.Raw(), c.domain, c.encoding)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.resolve == nil {
 		sg1.Debug("Resolving %s ...\n", fqdn)
+		_, err = net.LookupHost(fqdn)
+		return 0, err
+	}
 
-		if _, err := net.LookupHost(fqdn); err != nil {
-			return err
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, c.qtype)
+	m.SetEdns0(DNSUDPSize, false)
+
+	r, err := c.resolve(m)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := decodeAnswer(c.qtype, c.domain, c.encoding, r.Answer)
+	if err != nil {
+		return 0, err
+	} else if len(data) == 0 {
+		return 0, nil
+	}
+
+	// A and AAAA answers might be padded, which DecodePacket ignores
+	reply, err := sg1.DecodePacket(data)
+	if err != nil {
+		return 0, err
+	}
+
+	if reply.IsAck() {
+		if c.reliable != nil {
+			c.reliable.Ack(reply)
 		}
+		return 0, nil
+	}
 
-	} else {
-		sg1.Debug("Sending DNS question for %s to resolver %s:%d.\n", fqdn, c.address, c.port)
+	sg1.Debug("Decoded packet of %d bytes from DNS answer.\n", reply.DataSize)
 
-		m1 := new(dns.Msg)
-		m1.Id = dns.Id()
-		m1.RecursionDesired = true
-		m1.Question = make([]dns.Question, 1)
-		m1.Question[0] = dns.Question{fqdn + ".", dns.TypeA, dns.ClassINET}
+	c.mutex.Lock()
+	c.stats.TotalRead += int(reply.DataSize)
+	if c.reliable != nil {
+		// duplicates are acknowledged too, the first ACK might have been lost
+		c.acks = append(c.acks, sg1.NewAckPacket(reply))
+	}
+	c.mutex.Unlock()
 
-		if _, _, err := c.client.Exchange(m1, fmt.Sprintf("%s:%d", c.address, c.port)); err != nil {
-			return err
+	c.demux.Add(reply)
+
+	return 1, nil
+}
+
+// Start polling the listener for data, this only happens once and only when
+// the client is actually used for reading.
+func (c *DNSChannel) startPolling() {
+	c.polling.Do(func() {
+		go c.poller()
+	})
+}
+
+// Return the next ACK to send, or a new poll packet if there are none, the
+// listener answers both with its outbox.
+func (c *DNSChannel) nextPoll() *sg1.Packet {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.acks) > 0 {
+		ack := c.acks[0]
+		c.acks = c.acks[1:]
+		return ack
+	}
+	return sg1.NewPollPacket(c.seq.StreamID())
+}
+
+func (c *DNSChannel) poller() {
+	sg1.Debug("DNS poller started.\n")
+
+	for {
+		select {
+		case <-c.done:
+			sg1.Debug("DNS poller stopped.\n")
+			return
+		default:
 		}
+
+		// keep polling without waiting as long as we get data
+		received, err := c.exchange(c.nextPoll())
+		if err != nil {
+			sg1.Warning("Error while polling DNS listener: %s\n", err)
+		} else if received > 0 {
+			continue
+		}
+
+		select {
+		case <-time.After(time.Duration(c.poll_time) * time.Millisecond):
+		case <-c.done:
+		}
+	}
+}
+
+func (c *DNSChannel) Read(b []byte) (n int, err error) {
+	if c.is_client {
+		if c.resolve == nil {
+			return 0, fmt.Errorf("dns client needs a resolver address to read data.")
+		}
+		c.startPolling()
+	}
+
+	// packets can be bigger than the buffer, what is left is kept for the
+	// next reads
+	if len(c.pending) == 0 {
+		packet, err := c.demux.Get()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = packet.Data
+	}
+
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	sg1.Debug("Read %d bytes from DNS channel.\n", n)
+
+	return n, nil
+}
+
+// Questions can use the whole name left by the domain, answers depend on
+// the record type.
+func (c *DNSChannel) chunkSize() int {
+	if c.is_client {
+		return nameCapacity(c.domain, c.encoding) - sg1.PACKET_HEADER_SIZE
 	}
+	return answerSize(c.qtype, c.domain, c.encoding) - sg1.PACKET_HEADER_SIZE
+}
 
+func (c *DNSChannel) send(packet *sg1.Packet) error {
+	if c.is_client {
+		_, err := c.exchange(packet)
+		return err
+	}
+
+	// the listener can only answer to questions
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.outbox = append(c.outbox, packet)
 	return nil
 }
 
-func (c *DNSChannel) Write(b []byte) (n int, err error) {
+// Used by the reliable sender, a packet still waiting in the outbox is not
+// queued again and one the client could not send will be retransmitted once
+// its timeout expires.
+func (c *DNSChannel) transmit(packet *sg1.Packet) error {
 	if c.is_client == false {
-		return 0, fmt.Errorf("dns server can't be used for writing.")
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for _, queued := range c.outbox {
+			if queued == packet {
+				return nil
+			}
+		}
+		c.outbox = append(c.outbox, packet)
+	} else if _, err := c.exchange(packet); err != nil {
+		sg1.Warning("Error while sending DNS packet: %s\n", err)
 	}
+	return nil
+}
 
-	sg1.Debug("Sending %d bytes in chunks of %d bytes...\n", len(b), DNSChunkSize)
+func (c *DNSChannel) Write(b []byte) (n int, err error) {
+	sg1.Debug("Sending %d bytes in chunks of %d bytes...\n", len(b), c.chunkSize())
 
 	wrote := 0
-	for _, packet := range c.seq.Packets(b, DNSChunkSize) {
-		fqdn := fmt.Sprintf("%s.%s", packet.Hex(), c.domain)
-		if err := c.Lookup(fqdn); err != nil {
+	for _, packet := range c.seq.Packets(b, c.chunkSize()) {
+		if c.reliable != nil {
+			err = c.reliable.Send(packet)
+		} else {
+			err = c.send(packet)
+		}
+
+		if err != nil {
 			sg1.Error("Error while performing DNS lookup: %s\n", err)
 		} else {
-			sg1.Debug("Wrote %d bytes to DNS client.\n", packet.DataSize)
+			sg1.Debug("Wrote %d bytes to DNS channel.\n", packet.DataSize)
 			wrote += int(packet.DataSize)
+
+			c.mutex.Lock()
 			c.stats.TotalWrote += int(packet.DataSize)
+			c.mutex.Unlock()
+		}
+	}
+
+	if c.reliable != nil {
+		if err = c.reliable.Flush(); err != nil {
+			return wrote, err
 		}
 	}
 
@@ -269,5 +734,7 @@ func (c *DNSChannel) Write(b []byte) (n int, err error) {
 }
 
 func (c *DNSChannel) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.stats
 }
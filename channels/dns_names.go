@@ -0,0 +1,139 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+const (
+	DNSMaxLabelSize = 63
+	// maximum length of a name, without the trailing dot
+	DNSMaxNameSize = 253
+)
+
+// DNSEncoding turns data into characters that can be used in DNS labels,
+// names are case insensitive and resolvers might randomize the case of a
+// question, so decoding must be case insensitive as well.
+type DNSEncoding struct {
+	Encode func(data []byte) string
+	Decode func(encoded string) ([]byte, error)
+	// how many bytes can be encoded in the given number of characters
+	Capacity func(chars int) int
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var DNSEncodings = map[string]DNSEncoding{
+	"hex": {
+		Encode: hex.EncodeToString,
+		Decode: hex.DecodeString,
+		Capacity: func(chars int) int {
+			return chars / 2
+		},
+	},
+	"base32": {
+		Encode: func(data []byte) string {
+			return strings.ToLower(base32NoPadding.EncodeToString(data))
+		},
+		Decode: func(encoded string) ([]byte, error) {
+			return base32NoPadding.DecodeString(strings.ToUpper(encoded))
+		},
+		Capacity: func(chars int) int {
+			return chars * 5 / 8
+		},
+	},
+	"base36": {
+		// a leading 0x01 byte preserves the leading zeros of the data
+		Encode: func(data []byte) string {
+			return new(big.Int).SetBytes(append([]byte{1}, data...)).Text(36)
+		},
+		Decode: func(encoded string) ([]byte, error) {
+			n, ok := new(big.Int).SetString(encoded, 36)
+			if ok == false {
+				return nil, fmt.Errorf("Invalid base36 string.")
+			}
+
+			data := n.Bytes()
+			if len(data) == 0 || data[0] != 1 {
+				return nil, fmt.Errorf("Missing base36 leading byte.")
+			}
+			return data[1:], nil
+		},
+		Capacity: func(chars int) int {
+			return int(float64(chars)*math.Log2(36)/8) - 1
+		},
+	},
+}
+
+// Number of bytes that can be encoded in the labels of a name ending with
+// the given domain.
+func nameCapacity(domain string, encoding DNSEncoding) int {
+	// room left by the domain and the dot before it
+	available := DNSMaxNameSize - len(domain) - 1
+	// every label but the last one is followed by a dot
+	chars := available - available/(DNSMaxLabelSize+1)
+	if chars <= 0 {
+		return 0
+	}
+	return encoding.Capacity(chars)
+}
+
+// Encode data as the labels of a subdomain of the given domain.
+func encodeName(data []byte, domain string, encoding DNSEncoding) (string, error) {
+	encoded := encoding.Encode(data)
+	labels := make([]string, 0)
+	for len(encoded) > DNSMaxLabelSize {
+		labels = append(labels, encoded[:DNSMaxLabelSize])
+		encoded = encoded[DNSMaxLabelSize:]
+	}
+	labels = append(labels, encoded, strings.Trim(domain, "."))
+
+	name := strings.Join(labels, ".")
+	if len(name) > DNSMaxNameSize {
+		return "", fmt.Errorf("Name of %d characters exceeds the maximum of %d.", len(name), DNSMaxNameSize)
+	}
+
+	return name + ".", nil
+}
+
+// Decode the data in the labels of a subdomain of the given domain.
+func decodeName(name string, domain string, encoding DNSEncoding) ([]byte, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	suffix := "." + strings.ToLower(strings.Trim(domain, "."))
+	if strings.HasSuffix(name, suffix) == false {
+		return nil, fmt.Errorf("Name %s is not a subdomain of %s.", name, domain)
+	}
+
+	encoded := strings.Replace(strings.TrimSuffix(name, suffix), ".", "", -1)
+	return encoding.Decode(encoded)
+}
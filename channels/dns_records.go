@@ -0,0 +1,197 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	// A and AAAA records use their first byte as the index of the chunk,
+	// since resolvers are free to shuffle them
+	DNSMaxAddressRecords = 32
+	// maximum size of a single TXT string
+	DNSMaxTXTString = 255
+)
+
+var DNSQueryTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"TXT":   dns.TypeTXT,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"NULL":  dns.TypeNULL,
+}
+
+// Number of bytes of packet that fit in the answer to a query of the given
+// type, leaving enough room for the question in a 1232 bytes EDNS0 response,
+// CNAME and MX answers depend on the domain and encoding instead.
+var DNSAnswerSizes = map[uint16]int{
+	dns.TypeA:    DNSMaxAddressRecords * (net.IPv4len - 1),
+	dns.TypeAAAA: DNSMaxAddressRecords / 2 * (net.IPv6len - 1),
+	dns.TypeTXT:  512,
+	dns.TypeNULL: 512,
+}
+
+func answerSize(qtype uint16, domain string, encoding DNSEncoding) int {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeMX {
+		return nameCapacity(domain, encoding)
+	}
+	return DNSAnswerSizes[qtype]
+}
+
+func splitAddresses(data []byte, size int) []net.IP {
+	ips := make([]net.IP, 0)
+	for i, chunk := range sg1.BufferToChunks(data, size-1) {
+		ip := make(net.IP, size)
+		ip[0] = byte(i)
+		copy(ip[1:], chunk)
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func joinAddresses(ips []net.IP) []byte {
+	sort.Slice(ips, func(i, j int) bool {
+		return ips[i][0] < ips[j][0]
+	})
+
+	data := []byte{}
+	for _, ip := range ips {
+		data = append(data, ip[1:]...)
+	}
+	return data
+}
+
+// Encode data as the answer records of a query of the given type.
+func encodeAnswer(qtype uint16, name string, domain string, encoding DNSEncoding, data []byte) ([]dns.RR, error) {
+	if len(data) > answerSize(qtype, domain, encoding) {
+		return nil, fmt.Errorf("%d bytes don't fit in a %s answer.", len(data), dns.TypeToString[qtype])
+	}
+
+	header := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: 0}
+	answer := make([]dns.RR, 0)
+
+	switch qtype {
+	case dns.TypeA:
+		for _, ip := range splitAddresses(data, net.IPv4len) {
+			answer = append(answer, &dns.A{Hdr: header, A: ip.To4()})
+		}
+
+	case dns.TypeAAAA:
+		for _, ip := range splitAddresses(data, net.IPv6len) {
+			answer = append(answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+
+	case dns.TypeTXT:
+		encoded := []byte(base64.StdEncoding.EncodeToString(data))
+		txt := make([]string, 0)
+		for _, chunk := range sg1.BufferToChunks(encoded, DNSMaxTXTString) {
+			txt = append(txt, string(chunk))
+		}
+		answer = append(answer, &dns.TXT{Hdr: header, Txt: txt})
+
+	case dns.TypeCNAME:
+		target, err := encodeName(data, domain, encoding)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, &dns.CNAME{Hdr: header, Target: target})
+
+	case dns.TypeMX:
+		target, err := encodeName(data, domain, encoding)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, &dns.MX{Hdr: header, Preference: 10, Mx: target})
+
+	case dns.TypeNULL:
+		answer = append(answer, &dns.NULL{Hdr: header, Data: string(data)})
+
+	default:
+		return nil, fmt.Errorf("Unsupported DNS record type %d.", qtype)
+	}
+
+	return answer, nil
+}
+
+// Decode the data carried by the answer records of the given type, records
+// of other types are ignored.
+func decodeAnswer(qtype uint16, domain string, encoding DNSEncoding, answer []dns.RR) ([]byte, error) {
+	ips := make([]net.IP, 0)
+	data := []byte{}
+
+	for _, rr := range answer {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+
+		switch record := rr.(type) {
+		case *dns.A:
+			ips = append(ips, record.A.To4())
+
+		case *dns.AAAA:
+			ips = append(ips, record.AAAA.To16())
+
+		case *dns.TXT:
+			decoded, err := base64.StdEncoding.DecodeString(strings.Join(record.Txt, ""))
+			if err != nil {
+				return nil, fmt.Errorf("Could not decode TXT record: %s.", err)
+			}
+			data = append(data, decoded...)
+
+		case *dns.CNAME:
+			decoded, err := decodeName(record.Target, domain, encoding)
+			if err != nil {
+				return nil, fmt.Errorf("Could not decode CNAME record: %s.", err)
+			}
+			data = append(data, decoded...)
+
+		case *dns.MX:
+			decoded, err := decodeName(record.Mx, domain, encoding)
+			if err != nil {
+				return nil, fmt.Errorf("Could not decode MX record: %s.", err)
+			}
+			data = append(data, decoded...)
+
+		case *dns.NULL:
+			data = append(data, []byte(record.Data)...)
+		}
+	}
+
+	if len(ips) > 0 {
+		data = append(data, joinAddresses(ips)...)
+	}
+
+	return data, nil
+}
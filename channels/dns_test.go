@@ -0,0 +1,260 @@
+package channels
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func freeUDPAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func newTestDNSChannels(t *testing.T, qtype string) (*DNSChannel, *DNSChannel) {
+	address := "sg1.test@" + freeUDPAddress(t)
+
+	server := NewDNSChannel()
+	server.qtype_name = qtype
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+	assert.Nil(t, server.Start())
+
+	client := NewDNSChannel()
+	client.qtype_name = qtype
+	client.poll_time = 10
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, address))
+	assert.Nil(t, client.Start())
+
+	return server, client
+}
+
+func readStringOfSize(t *testing.T, c Channel, size int) string {
+	received := ""
+	for len(received) < size {
+		received += readString(t, c)
+	}
+	return received
+}
+
+func TestDNSNameEncoding(t *testing.T) {
+	domain := "sg1.example.com"
+	for name, encoding := range DNSEncodings {
+		size := nameCapacity(domain, encoding)
+		data := append([]byte{0, 0}, bytes.Repeat([]byte{0xff, 0x01}, size)...)[:size]
+
+		fqdn, err := encodeName(data, domain, encoding)
+		assert.Nil(t, err, name)
+		assert.LessOrEqual(t, len(fqdn), DNSMaxNameSize+1, name)
+		for _, label := range strings.Split(fqdn, ".") {
+			assert.LessOrEqual(t, len(label), DNSMaxLabelSize, name)
+		}
+
+		// resolvers might randomize the case of the question
+		decoded, err := decodeName(strings.ToUpper(fqdn), domain, encoding)
+		assert.Nil(t, err, name)
+		assert.Equal(t, data, decoded, name)
+
+		_, err = decodeName(fqdn, "other.com", encoding)
+		assert.NotNil(t, err, name)
+	}
+
+	// base32 and base36 fit more data than hex
+	assert.Greater(t, nameCapacity(domain, DNSEncodings["base32"]), nameCapacity(domain, DNSEncodings["hex"]))
+	assert.Greater(t, nameCapacity(domain, DNSEncodings["base36"]), nameCapacity(domain, DNSEncodings["base32"]))
+}
+
+func TestDNSAnswerEncoding(t *testing.T) {
+	encoding := DNSEncodings["base32"]
+	for name, qtype := range DNSQueryTypes {
+		data := bytes.Repeat([]byte{0xaa, 0x00, 0x55}, answerSize(qtype, "sg1.test", encoding)/3)
+
+		answer, err := encodeAnswer(qtype, "x.sg1.test.", "sg1.test", encoding, data)
+		assert.Nil(t, err, name)
+
+		// resolvers are free to shuffle the records
+		for i, j := 0, len(answer)-1; i < j; i, j = i+1, j-1 {
+			answer[i], answer[j] = answer[j], answer[i]
+		}
+
+		decoded, err := decodeAnswer(qtype, "sg1.test", encoding, answer)
+		assert.Nil(t, err, name)
+		assert.Equal(t, data, decoded[:len(data)], name)
+	}
+
+	_, err := encodeAnswer(dns.TypeTXT, "x.sg1.test.", "sg1.test", encoding, make([]byte, DNSAnswerSizes[dns.TypeTXT]+1))
+	assert.NotNil(t, err)
+}
+
+func TestDNSChannelEncodings(t *testing.T) {
+	for name := range DNSEncodings {
+		address := "sg1.test@" + freeUDPAddress(t)
+
+		server := NewDNSChannel()
+		server.enc_name = name
+		assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+		assert.Nil(t, server.Start())
+
+		client := NewDNSChannel()
+		client.enc_name = name
+		assert.Nil(t, client.Setup(OUTPUT_CHANNEL, address))
+
+		message := strings.Repeat("hello "+name+" ", 30)
+		_, err := client.Write([]byte(message))
+		assert.Nil(t, err)
+		assert.Equal(t, message, readStringOfSize(t, server, len(message)), name)
+
+		client.Close()
+		server.Close()
+	}
+
+	long := NewDNSChannel()
+	assert.NotNil(t, long.Setup(OUTPUT_CHANNEL, strings.Repeat("a", 240)+".com@127.0.0.1:53"))
+}
+
+func TestDNSChannelAnswers(t *testing.T) {
+	for name := range DNSQueryTypes {
+		server, client := newTestDNSChannels(t, name)
+
+		_, err := client.Write([]byte("hello " + name))
+		assert.Nil(t, err)
+		assert.Equal(t, "hello "+name, readStringOfSize(t, server, len("hello "+name)))
+
+		// data is sent back in the answers to the client polls
+		message := strings.Repeat("hello client ", 20)
+		_, err = server.Write([]byte(message))
+		assert.Nil(t, err)
+		assert.Equal(t, message, readStringOfSize(t, client, len(message)), name)
+
+		// the FIN packet of the client ends the listener stream
+		assert.Nil(t, client.CloseWrite())
+		_, err = server.Read(make([]byte, 16))
+		assert.NotNil(t, err)
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestDNSChannelTransports(t *testing.T) {
+	for transport := range DNSTransports {
+		address := "sg1.test@" + freeAddress(t)
+
+		server := NewDNSChannel()
+		server.transport = transport
+		assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+		assert.Nil(t, server.Start())
+
+		client := NewDNSChannel()
+		client.transport = transport
+		client.poll_time = 10
+		// the certificate of the tls listener is self signed
+		client.insecure = true
+		assert.Nil(t, client.Setup(OUTPUT_CHANNEL, address))
+
+		_, err := client.Write([]byte("hello " + transport))
+		assert.Nil(t, err)
+		assert.Equal(t, "hello "+transport, readStringOfSize(t, server, len("hello "+transport)))
+
+		_, err = server.Write([]byte("hello client"))
+		assert.Nil(t, err)
+		assert.Equal(t, "hello client", readStringOfSize(t, client, len("hello client")), transport)
+
+		client.Close()
+		server.Close()
+	}
+
+	server := NewDNSChannel()
+	server.transport = "doh"
+	assert.NotNil(t, server.Setup(INPUT_CHANNEL, "sg1.test@127.0.0.1:53"))
+}
+
+func TestDNSChannelVerifiesCertificate(t *testing.T) {
+	address := "sg1.test@" + freeAddress(t)
+
+	server := NewDNSChannel()
+	server.transport = "tls"
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+	assert.Nil(t, server.Start())
+	defer server.Close()
+
+	client := NewDNSChannel()
+	client.transport = "tls"
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, address))
+
+	m := new(dns.Msg)
+	m.SetQuestion("test.sg1.test.", dns.TypeA)
+	_, err := client.resolve(m)
+	assert.NotNil(t, err)
+}
+
+func TestDNSChannelReliable(t *testing.T) {
+	enableReliable(t)
+	server, client := newTestDNSChannels(t, "TXT")
+	defer server.Close()
+	defer client.Close()
+
+	// lose some questions and some answers
+	resolve := client.resolve
+	exchanges := int32(0)
+	client.resolve = func(m *dns.Msg) (*dns.Msg, error) {
+		n := atomic.AddInt32(&exchanges, 1)
+		if n%3 == 0 {
+			return nil, fmt.Errorf("Question lost.")
+		}
+		r, err := resolve(m)
+		if n%5 == 0 {
+			return nil, fmt.Errorf("Answer lost.")
+		}
+		return r, err
+	}
+
+	message := strings.Repeat("hello reliable listener ", 20)
+	_, err := client.Write([]byte(message))
+	assert.Nil(t, err)
+	assert.Equal(t, message, readStringOfSize(t, server, len(message)))
+
+	// the listener waits for the ACKs of the client, which only polls when reading
+	reply := strings.Repeat("hello reliable client ", 20)
+	received := make(chan string)
+	go func() {
+		received <- readStringOfSize(t, client, len(reply))
+	}()
+
+	_, err = server.Write([]byte(reply))
+	assert.Nil(t, err)
+	assert.Equal(t, reply, <-received)
+
+	assert.Nil(t, client.CloseWrite())
+	_, err = server.Read(make([]byte, 16))
+	assert.NotNil(t, err)
+}
+
+func TestDNSChannelSmallReads(t *testing.T) {
+	server, client := newTestDNSChannels(t, "TXT")
+	defer server.Close()
+	defer client.Close()
+
+	// every packet is read with a buffer smaller than its data
+	message := strings.Repeat("hello small buffer ", 10)
+	_, err := client.Write([]byte(message))
+	assert.Nil(t, err)
+
+	received := ""
+	buff := make([]byte, 3)
+	for len(received) < len(message) {
+		n, err := server.Read(buff)
+		if !assert.Nil(t, err) {
+			break
+		}
+		received += string(buff[:n])
+	}
+	assert.Equal(t, message, received)
+}
@@ -0,0 +1,287 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	DoHDefaultURL  = "https://cloudflare-dns.com/dns-query"
+	DoHDefaultPath = "/dns-query"
+	DoHContentType = "application/dns-message"
+)
+
+// DoHChannel sends the same questions of the dns channel as RFC 8484 DNS over
+// HTTPS requests, either to a public DoH resolver forwarding them to a dns
+// listener, or directly to a DoH listener.
+type DoHChannel struct {
+	*DNSChannel
+	url    string
+	path   string
+	server *http.Server
+	client *http.Client
+}
+
+func NewDoHChannel() *DoHChannel {
+	return &DoHChannel{
+		DNSChannel: NewDNSChannel(),
+		url:        DoHDefaultURL,
+		path:       DoHDefaultPath,
+		server:     nil,
+		client:     nil,
+	}
+}
+
+func (c *DoHChannel) Copy() interface{} {
+	cp := NewDoHChannel()
+	cp.qtype_name = c.qtype_name
+	cp.enc_name = c.enc_name
+	cp.poll_time = c.poll_time
+	cp.insecure = c.insecure
+	return cp
+}
+
+func (c *DoHChannel) Name() string {
+	return "doh"
+}
+
+func (c *DoHChannel) Description() string {
+	return "As input, run a DNS over HTTPS server reading data from DNS questions and sending data back in the answers (example server: doh:example.com@0.0.0.0:8443), as output send DNS questions to a DoH resolver (example client: doh:example.com@https://192.168.1.2:8443/dns-query)."
+}
+
+func (c *DoHChannel) Register() error {
+	flag.StringVar(&c.qtype_name, "doh-qtype", c.qtype_name, "Same as -dns-qtype, for the doh channel.")
+	flag.StringVar(&c.enc_name, "doh-encoding", c.enc_name, "Same as -dns-encoding, for the doh channel.")
+	flag.IntVar(&c.poll_time, "doh-poll-time", c.poll_time, "Same as -dns-poll-time, for the doh channel.")
+	flag.BoolVar(&c.insecure, "doh-insecure", c.insecure, "Do not verify the certificate of the DoH server, needed to reach the self signed doh listener.")
+	return nil
+}
+
+func (c *DoHChannel) Setup(direction Direction, args string) (err error) {
+	target := args
+	if idx := strings.Index(args, "@"); idx != -1 {
+		// doh:evil.com@https://1.1.1.1/dns-query
+		c.domain = args[:idx]
+		target = args[idx+1:]
+	} else if strings.Contains(args, "/") == false && strings.Contains(args, ":") == false && args != "" {
+		// doh:evil.com <- use default resolver
+		c.domain = args
+		target = ""
+	}
+
+	if err = c.setupEncoding(); err != nil {
+		return err
+	}
+
+	if direction == INPUT_CHANNEL {
+		c.is_client = false
+		c.address = target
+		if idx := strings.Index(target, "/"); idx != -1 {
+			c.address = target[:idx]
+			c.path = target[idx:]
+		}
+
+		if _, _, err = net.SplitHostPort(c.address); err != nil {
+			return fmt.Errorf("Usage: doh:DOMAIN@ADDRESS:PORT(/path)?")
+		}
+	} else {
+		c.is_client = true
+		if target != "" {
+			c.url = target
+		}
+
+		if strings.HasPrefix(c.url, "https://") == false && strings.HasPrefix(c.url, "http://") == false {
+			return fmt.Errorf("Usage: doh:DOMAIN@https://RESOLVER/PATH")
+		}
+
+		c.resolve = c.request
+	}
+
+	sg1.Debug("Setup DoH channel from args '%s': direction=%d domain='%s' url='%s' address='%s' path='%s'\n", args, direction, c.domain, c.url, c.address, c.path)
+
+	return nil
+}
+
+func (c *DoHChannel) Start() error {
+	c.startReliable()
+
+	if c.is_client {
+		transport := &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: c.insecure},
+			ForceAttemptHTTP2: true,
+		}
+		c.client = &http.Client{Transport: transport, Timeout: HTTPTimeout}
+
+		sg1.Log("Sending DNS questions to %s ...\n", c.url)
+		return nil
+	}
+
+	config, err := getCertificateConfig("", "")
+	if err != nil {
+		return err
+	}
+
+	listener, err := tls.Listen("tcp", c.address, config)
+	if err != nil {
+		return err
+	}
+
+	c.server = &http.Server{Handler: http.HandlerFunc(c.handler)}
+
+	go func() {
+		sg1.Log("Started DoH server on https://%s%s ...\n", c.address, c.path)
+
+		if err := c.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			sg1.Error("DoH server stopped: %s\n", err)
+			c.Close()
+		}
+	}()
+
+	return nil
+}
+
+// Send a DNS message as a RFC 8484 GET request and return the answer.
+func (c *DoHChannel) request(m *dns.Msg) (*dns.Msg, error) {
+	// the id should be zero to be cache friendly, questions are unique anyway
+	m.Id = 0
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	url := c.url + "?dns=" + base64.RawURLEncoding.EncodeToString(packed)
+	if strings.Contains(c.url, "?") {
+		url = c.url + "&dns=" + base64.RawURLEncoding.EncodeToString(packed)
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", DoHContentType)
+
+	sg1.Debug("Sending DNS question for %s to %s.\n", m.Question[0].Name, c.url)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected DoH status %s.", res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err = r.Unpack(data); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Read the DNS message of a GET or POST RFC 8484 request.
+func (c *DoHChannel) message(r *http.Request) (*dns.Msg, error) {
+	var data []byte
+	var err error
+
+	if r.Method == "GET" {
+		data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	} else if r.Method == "POST" && r.Header.Get("Content-Type") == DoHContentType {
+		data, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	} else {
+		err = fmt.Errorf("Unexpected %s request.", r.Method)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	if err = m.Unpack(data); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (c *DoHChannel) handler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != c.path {
+		sg1.Debug("Ignoring DoH request for %s from %s.\n", r.URL.Path, r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	}
+
+	m, err := c.message(r)
+	if err != nil {
+		sg1.Debug("Ignoring DoH request from %s: %s\n", r.RemoteAddr, err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	sg1.Debug("Got DoH request from %s.\n", r.RemoteAddr)
+
+	reply := c.reply(m)
+	if reply == nil {
+		// not for us, answer as any other resolver would
+		reply = new(dns.Msg)
+		reply.SetRcode(m, dns.RcodeRefused)
+	}
+
+	packed, err := reply.Pack()
+	if err != nil {
+		sg1.Error("Error while packing DoH answer: %s\n", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", DoHContentType)
+	w.Write(packed)
+}
+
+func (c *DoHChannel) Close() error {
+	err := c.DNSChannel.Close()
+	if c.server != nil {
+		c.server.Close()
+	}
+	return err
+}
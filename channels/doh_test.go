@@ -0,0 +1,75 @@
+package channels
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDoHChannels(t *testing.T) (*DoHChannel, *DoHChannel) {
+	address := freeAddress(t)
+
+	server := NewDoHChannel()
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, "sg1.test@"+address))
+	assert.Nil(t, server.Start())
+
+	client := NewDoHChannel()
+	client.poll_time = 10
+	client.insecure = true
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, "sg1.test@https://"+address+DoHDefaultPath))
+	assert.Nil(t, client.Start())
+
+	return server, client
+}
+
+func TestDoHChannel(t *testing.T) {
+	server, client := newTestDoHChannels(t)
+
+	// answers carry a few bytes each, so data is always read in chunks
+	testRoundTrip(t, server, client, 0, []string{"hello doh"}, "hello client")
+}
+
+func TestDoHChannelIgnoresForeignRequests(t *testing.T) {
+	server, client := newTestDoHChannels(t)
+	defer server.Close()
+	defer client.Close()
+
+	res, err := client.client.Get("https://" + server.address + "/")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res.Body.Close()
+
+	res, err = client.client.Get("https://" + server.address + DoHDefaultPath + "?dns=nope")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+}
+
+func TestDoHChannelSetup(t *testing.T) {
+	client := NewDoHChannel()
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, "sg1.test"))
+	assert.Equal(t, "sg1.test", client.domain)
+	assert.Equal(t, DoHDefaultURL, client.url)
+
+	assert.NotNil(t, NewDoHChannel().Setup(OUTPUT_CHANNEL, "sg1.test@ftp://nope"))
+	assert.NotNil(t, NewDoHChannel().Setup(INPUT_CHANNEL, "sg1.test"))
+}
+
+func TestDoHChannelVerifiesCertificate(t *testing.T) {
+	address := freeAddress(t)
+
+	server := NewDoHChannel()
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, "sg1.test@"+address))
+	assert.Nil(t, server.Start())
+	defer server.Close()
+
+	// the self signed certificate of the listener is refused by default
+	client := NewDoHChannel()
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, "sg1.test@https://"+address+DoHDefaultPath))
+	assert.Nil(t, client.Start())
+	defer client.Close()
+
+	_, err := client.client.Get("https://" + address + DoHDefaultPath)
+	assert.NotNil(t, err)
+}
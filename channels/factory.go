@@ -62,10 +62,15 @@ func Registered() map[string]Channel {
 	return registered
 }
 
-func Factory(channel_name string, direction Direction) (channel Channel, err error) {
+func lookup(channel_name string) (channel Channel, found bool) {
 	mt.Lock()
 	defer mt.Unlock()
 
+	channel, found = registered[channel_name]
+	return
+}
+
+func Factory(channel_name string, direction Direction) (channel Channel, err error) {
 	if channel_name == "" {
 		return nil, fmt.Errorf("channel name can not be empty.")
 	}
@@ -81,7 +86,9 @@ func Factory(channel_name string, direction Direction) (channel Channel, err err
 		channel_args = parts[1]
 	}
 
-	instance, found := registered[channel_name]
+	// the registry is not kept locked during Setup since channels wrapping
+	// other channels will call the Factory themselves
+	instance, found := lookup(channel_name)
 	if found == false {
 		return nil, fmt.Errorf("No channel with name %s has been registered.", channel_name)
 	}
@@ -106,3 +113,18 @@ func Factory(channel_name string, direction Direction) (channel Channel, err err
 
 	return channel, nil
 }
+
+// Create a channel which is going to be used as a bidirectional tunnel, hence
+// it must support both reading and writing regardless of its direction.
+func TunnelFactory(channel_name string, direction Direction) (tunnel *Tunnel, err error) {
+	channel, err := Factory(channel_name, direction)
+	if err != nil {
+		return nil, err
+	}
+
+	if channel.HasReader() == false || channel.HasWriter() == false {
+		return nil, fmt.Errorf("Can't use channel '%s' as a tunnel.", channel.Name())
+	}
+
+	return NewTunnel(channel), nil
+}
@@ -0,0 +1,259 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"flag"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	FileFollowInterval = 250 * time.Millisecond
+)
+
+// FileChannel reads or writes a regular file or a named pipe, which is
+// created if it does not exist yet. Since opening a named pipe blocks until
+// the other end is opened too, this only happens on the first read or write.
+type FileChannel struct {
+	fifo     bool
+	append   bool
+	follow   bool
+	reading  bool
+	path     string
+	file     *os.File
+	created  bool
+	opening  sync.Once
+	open_err error
+	closed   bool
+	mutex    *sync.Mutex
+	stats    Stats
+}
+
+func newFileChannel(fifo bool) *FileChannel {
+	return &FileChannel{
+		fifo:    fifo,
+		append:  false,
+		follow:  false,
+		reading: true,
+		path:    "",
+		file:    nil,
+		created: false,
+		closed:  false,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func NewFileChannel() *FileChannel {
+	return newFileChannel(false)
+}
+
+func NewFIFOChannel() *FileChannel {
+	return newFileChannel(true)
+}
+
+func (c *FileChannel) Copy() interface{} {
+	cp := newFileChannel(c.fifo)
+	cp.append = c.append
+	cp.follow = c.follow
+	return cp
+}
+
+func (c *FileChannel) Name() string {
+	if c.fifo {
+		return "fifo"
+	}
+	return "file"
+}
+
+func (c *FileChannel) Description() string {
+	if c.fifo {
+		return "Read from or write to a named pipe, it will be created if it does not exist ( example: fifo:/tmp/sg1.fifo )."
+	}
+	return "Read from or write to a file, use -file-append to append to it and -file-follow to keep reading as it grows ( example: file:/tmp/data.bin )."
+}
+
+func (c *FileChannel) Register() error {
+	if c.fifo == false {
+		flag.BoolVar(&c.append, "file-append", c.append, "Append to the output file instead of truncating it.")
+		flag.BoolVar(&c.follow, "file-follow", c.follow, "Keep reading the input file as it grows, like tail -f does.")
+	}
+	return nil
+}
+
+func (c *FileChannel) Setup(direction Direction, args string) error {
+	if args == "" {
+		return fmt.Errorf("Usage: %s:/path/to/file", c.Name())
+	}
+
+	c.path = args
+	c.reading = direction == INPUT_CHANNEL
+
+	if c.fifo {
+		if info, err := os.Stat(c.path); os.IsNotExist(err) {
+			sg1.Debug("Creating named pipe %s.\n", c.path)
+			if err = mkfifo(c.path); err != nil {
+				return err
+			}
+			c.created = true
+		} else if err != nil {
+			return err
+		} else if info.Mode()&os.ModeNamedPipe == 0 {
+			return fmt.Errorf("%s exists and it's not a named pipe.", c.path)
+		}
+	}
+
+	sg1.Debug("Setup %s channel: direction=%d path=%s append=%v follow=%v\n", c.Name(), direction, c.path, c.append, c.follow)
+
+	return nil
+}
+
+func (c *FileChannel) open() error {
+	c.opening.Do(func() {
+		var file *os.File
+
+		if c.reading {
+			sg1.Debug("Opening %s for reading ...\n", c.path)
+			file, c.open_err = os.Open(c.path)
+		} else {
+			flags := os.O_WRONLY | os.O_CREATE
+			if c.fifo == false {
+				if c.append {
+					flags |= os.O_APPEND
+				} else {
+					flags |= os.O_TRUNC
+				}
+			}
+
+			sg1.Debug("Opening %s for writing ...\n", c.path)
+			file, c.open_err = os.OpenFile(c.path, flags, 0644)
+		}
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		if c.open_err == nil && c.closed {
+			file.Close()
+			c.open_err = io.EOF
+		} else {
+			c.file = file
+		}
+	})
+
+	return c.open_err
+}
+
+func (c *FileChannel) Start() error {
+	if c.fifo {
+		sg1.Log("Waiting for the other end of named pipe %s ...\n\n", c.path)
+		return nil
+	}
+
+	return c.open()
+}
+
+func (c *FileChannel) HasReader() bool {
+	return c.reading
+}
+
+func (c *FileChannel) HasWriter() bool {
+	return c.reading == false
+}
+
+func (c *FileChannel) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *FileChannel) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	sg1.Debug("Closing %s channel.\n", c.Name())
+
+	c.closed = true
+	if c.file != nil {
+		c.file.Close()
+	}
+	if c.created {
+		os.Remove(c.path)
+	}
+
+	return nil
+}
+
+func (c *FileChannel) Read(b []byte) (n int, err error) {
+	if err = c.open(); err != nil {
+		return 0, err
+	}
+
+	for {
+		n, err = c.file.Read(b)
+		if n > 0 {
+			c.stats.TotalRead += n
+		}
+
+		if err == io.EOF && n == 0 && c.follow && c.fifo == false && c.isClosed() == false {
+			time.Sleep(FileFollowInterval)
+			continue
+		} else if err != nil && c.isClosed() {
+			err = io.EOF
+		}
+
+		sg1.Debug("Read %d bytes from %s.\n", n, c.path)
+
+		return n, err
+	}
+}
+
+func (c *FileChannel) Write(b []byte) (n int, err error) {
+	if err = c.open(); err != nil {
+		return 0, err
+	}
+
+	n, err = c.file.Write(b)
+	if n > 0 {
+		c.stats.TotalWrote += n
+	}
+
+	sg1.Debug("Wrote %d bytes to %s.\n", n, c.path)
+
+	return n, err
+}
+
+func (c *FileChannel) Stats() Stats {
+	return c.stats
+}
@@ -0,0 +1,104 @@
+package channels
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFileChannel(t *testing.T, fifo bool, direction Direction, path string) *FileChannel {
+	c := newFileChannel(fifo)
+	assert.Nil(t, c.Setup(direction, path))
+	return c
+}
+
+func TestFileChannelWriteAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+
+	out := newTestFileChannel(t, false, OUTPUT_CHANNEL, path)
+	assert.Nil(t, out.Start())
+	_, err := out.Write([]byte("hello file"))
+	assert.Nil(t, err)
+	out.Close()
+
+	in := newTestFileChannel(t, false, INPUT_CHANNEL, path)
+	assert.Nil(t, in.Start())
+	assert.Equal(t, "hello file", readString(t, in))
+
+	_, err = in.Read(make([]byte, 16))
+	assert.NotNil(t, err)
+	in.Close()
+}
+
+func TestFileChannelAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	assert.Nil(t, os.WriteFile(path, []byte("hello "), 0644))
+
+	out := newFileChannel(false)
+	out.append = true
+	assert.Nil(t, out.Setup(OUTPUT_CHANNEL, path))
+	assert.Nil(t, out.Start())
+	_, err := out.Write([]byte("world"))
+	assert.Nil(t, err)
+	out.Close()
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(data))
+}
+
+func TestFileChannelFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	assert.Nil(t, os.WriteFile(path, []byte("first"), 0644))
+
+	in := newFileChannel(false)
+	in.follow = true
+	assert.Nil(t, in.Setup(INPUT_CHANNEL, path))
+	assert.Nil(t, in.Start())
+	assert.Equal(t, "first", readString(t, in))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		f.Write([]byte("second"))
+		f.Close()
+	}()
+
+	// blocks until the file grows
+	assert.Equal(t, "second", readString(t, in))
+	in.Close()
+}
+
+func TestFIFOChannel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Named pipes are not supported on windows.")
+	}
+
+	path := filepath.Join(t.TempDir(), "pipe")
+
+	in := newTestFileChannel(t, true, INPUT_CHANNEL, path)
+	assert.Nil(t, in.Start())
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, info.Mode()&os.ModeNamedPipe)
+
+	out := newTestFileChannel(t, true, OUTPUT_CHANNEL, path)
+	assert.Nil(t, out.Start())
+
+	go func() {
+		out.Write([]byte("hello fifo"))
+		out.Close()
+	}()
+
+	assert.Equal(t, "hello fifo", readString(t, in))
+
+	// the pipe is removed by the end which created it
+	in.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,296 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// every blob is a branch of its own, pointing to a commit with the data
+	// as its only file
+	GitRefPrefix = "refs/heads/sg1/"
+	GitDataFile  = "data"
+	GitPollTime  = 5000
+	GitAuthor    = "sg1"
+	GitEmail     = "sg1@localhost"
+)
+
+// GitDrop stores blobs as branches of a git repository, which can be a local
+// path or any remote git itself can push to and fetch from. The key of a blob
+// is its branch and the commit it points to, so that the deletion of a branch
+// is only pushed if it still points to that commit and only one reader can
+// claim each blob. Objects are created in a temporary bare repository.
+type GitDrop struct {
+	remote  string
+	scratch string
+}
+
+// Return true if the remote is a local path and not an URL or the scp like
+// user@host:path syntax, which git recognizes by a colon before any slash.
+func gitIsLocal(remote string) bool {
+	if filepath.IsAbs(remote) {
+		return true
+	} else if strings.Contains(remote, "://") {
+		return false
+	}
+
+	colon := strings.Index(remote, ":")
+	return colon == -1 || strings.Contains(remote[:colon], "/")
+}
+
+func NewGitDrop(remote string) (*GitDrop, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("The git channel requires git: %s.", err)
+	} else if strings.HasPrefix(remote, "-") {
+		// it would be taken as an option by git
+		return nil, fmt.Errorf("Invalid git remote '%s'.", remote)
+	}
+
+	// git runs in the scratch repository, so local paths must be absolute
+	if gitIsLocal(remote) {
+		abs, err := filepath.Abs(remote)
+		if err != nil {
+			return nil, err
+		}
+		remote = abs
+	}
+
+	scratch, err := os.MkdirTemp("", "sg1-git-")
+	if err != nil {
+		return nil, err
+	}
+
+	d := &GitDrop{
+		remote:  remote,
+		scratch: scratch,
+	}
+
+	if _, err = d.git(nil, "init", "-q", "--bare", scratch); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Run a git command in the scratch repository and return its output.
+func (d *GitDrop) git(stdin []byte, args ...string) ([]byte, error) {
+	sg1.Debug("Running git %s\n", strings.Join(args, " "))
+
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = d.scratch
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// never wait for credentials on a terminal nobody is looking at
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME="+GitAuthor,
+		"GIT_AUTHOR_EMAIL="+GitEmail,
+		"GIT_COMMITTER_NAME="+GitAuthor,
+		"GIT_COMMITTER_EMAIL="+GitEmail)
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s failed: %s %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// Escape a blob name to a valid branch name by percent encoding anything
+// which is not a letter, a digit, a dash or an underscore.
+func gitRefName(name string) string {
+	ref := strings.Builder{}
+	for _, b := range []byte(name) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '-' || b == '_' {
+			ref.WriteByte(b)
+		} else {
+			fmt.Fprintf(&ref, "%%%02X", b)
+		}
+	}
+	return GitRefPrefix + ref.String()
+}
+
+func (d *GitDrop) Put(name string, data []byte) error {
+	blob, err := d.git(data, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+
+	entry := fmt.Sprintf("100644 blob %s\t%s\n", strings.TrimSpace(string(blob)), GitDataFile)
+	tree, err := d.git([]byte(entry), "mktree")
+	if err != nil {
+		return err
+	}
+
+	commit, err := d.git(nil, "commit-tree", "-m", name, strings.TrimSpace(string(tree)))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.git(nil, "push", "-q", d.remote, strings.TrimSpace(string(commit))+":"+gitRefName(name))
+	return err
+}
+
+func (d *GitDrop) List() ([]DeadDropBlob, error) {
+	out, err := d.git(nil, "ls-remote", "-q", d.remote, GitRefPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make([]DeadDropBlob, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasPrefix(fields[1], GitRefPrefix) == false {
+			continue
+		} else if name, err := url.PathUnescape(fields[1][len(GitRefPrefix):]); err == nil {
+			blobs = append(blobs, DeadDropBlob{Key: fields[1] + "@" + fields[0], Name: name})
+		}
+	}
+
+	return blobs, nil
+}
+
+// Split a key in the branch and the commit it points to.
+func parseGitKey(key string) (string, string, error) {
+	idx := strings.LastIndex(key, "@")
+	if idx == -1 || strings.HasPrefix(key, GitRefPrefix) == false {
+		return "", "", fmt.Errorf("Unexpected git blob key '%s'.", key)
+	}
+	return key[:idx], key[idx+1:], nil
+}
+
+func (d *GitDrop) Get(key string) ([]byte, error) {
+	ref, commit, err := parseGitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetch to a local ref of our own, since the poller might be fetching
+	// while the writer is pushing
+	local := "refs/sg1/" + ref[len(GitRefPrefix):]
+	if _, err = d.git(nil, "fetch", "-q", "--no-write-fetch-head", d.remote, "+"+ref+":"+local); err != nil {
+		return nil, err
+	}
+	defer d.git(nil, "update-ref", "-d", local)
+
+	return d.git(nil, "cat-file", "blob", commit+":"+GitDataFile)
+}
+
+func (d *GitDrop) Delete(key string) error {
+	ref, commit, err := parseGitKey(key)
+	if err != nil {
+		return err
+	}
+
+	// pushing the deletion of a missing branch would succeed otherwise
+	_, err = d.git(nil, "push", "-q", "--force-with-lease="+ref+":"+commit, d.remote, "--delete", ref)
+	return err
+}
+
+// Remove the scratch repository.
+func (d *GitDrop) Close() error {
+	return os.RemoveAll(d.scratch)
+}
+
+type GitChannel struct {
+	*DeadDropChannel
+	git *GitDrop
+}
+
+func NewGitChannel() *GitChannel {
+	c := &GitChannel{
+		DeadDropChannel: NewDeadDropChannel("git", DeadDropDefaultStream, DeadDropChunkSize),
+		git:             nil,
+	}
+	c.poll_time = GitPollTime
+	return c
+}
+
+func (c *GitChannel) Copy() interface{} {
+	cp := NewGitChannel()
+	cp.preserve = c.preserve
+	cp.poll_time = c.poll_time
+	return cp
+}
+
+func (c *GitChannel) Name() string {
+	return "git"
+}
+
+func (c *GitChannel) Register() error {
+	flag.BoolVar(&c.preserve, "git-preserve", c.preserve, "Do not delete branches after reading them.")
+	flag.IntVar(&c.poll_time, "git-poll-time", c.poll_time, "Number of milliseconds to wait between one listing of the repository branches and another.")
+	return nil
+}
+
+func (c *GitChannel) Description() string {
+	return "Read and write data as branches of a git repository."
+}
+
+func (c *GitChannel) Setup(direction Direction, args string) error {
+	remote := c.parseStream(args)
+	if remote == "" {
+		return fmt.Errorf("Usage: git:/path/to/repo.git|file:///path/to/repo.git|ssh://user@host/repo.git(#stream_name)?")
+	}
+
+	drop, err := NewGitDrop(remote)
+	if err != nil {
+		return err
+	}
+
+	// fail early if the repository can't be reached
+	if _, err = drop.List(); err != nil {
+		drop.Close()
+		return err
+	}
+
+	c.git = drop
+	c.setup(direction, drop)
+
+	return nil
+}
+
+func (c *GitChannel) Close() error {
+	err := c.DeadDropChannel.Close()
+	if c.git != nil {
+		c.git.Close()
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package channels
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGitRepository(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available.")
+	}
+
+	path := t.TempDir()
+	assert.Nil(t, exec.Command("git", "init", "-q", "--bare", path).Run())
+	return path
+}
+
+func TestGitDrop(t *testing.T) {
+	drop, err := NewGitDrop(newTestGitRepository(t))
+	assert.Nil(t, err)
+	defer drop.Close()
+
+	name := "SG1 some/stream~ 0x01"
+	assert.Nil(t, drop.Put(name, []byte("hello\x00git")))
+
+	blobs, err := drop.List()
+	assert.Nil(t, err)
+	if assert.Len(t, blobs, 1) {
+		assert.Equal(t, name, blobs[0].Name)
+
+		data, err := drop.Get(blobs[0].Key)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello\x00git", string(data))
+
+		assert.Nil(t, drop.Delete(blobs[0].Key))
+		// a blob can only be claimed once
+		assert.NotNil(t, drop.Delete(blobs[0].Key))
+	}
+
+	blobs, err = drop.List()
+	assert.Nil(t, err)
+	assert.Empty(t, blobs)
+}
+
+func TestGitDropRemotes(t *testing.T) {
+	repository := newTestGitRepository(t)
+	cwd, err := os.Getwd()
+	assert.Nil(t, err)
+	relative, err := filepath.Rel(cwd, repository)
+	assert.Nil(t, err)
+
+	// relative paths are not resolved from the scratch repository
+	drop, err := NewGitDrop(relative)
+	assert.Nil(t, err)
+	defer drop.Close()
+	assert.Equal(t, repository, drop.remote)
+	assert.Nil(t, drop.Put("SG1 TEST 0x01", []byte("relative")))
+
+	blobs, err := drop.List()
+	assert.Nil(t, err)
+	assert.Len(t, blobs, 1)
+
+	_, err = NewGitDrop("--upload-pack=touch /tmp/pwned")
+	assert.NotNil(t, err)
+
+	assert.True(t, gitIsLocal("repo.git"))
+	assert.True(t, gitIsLocal("./host:repo.git"))
+	assert.False(t, gitIsLocal("git@example.com:repo.git"))
+	assert.False(t, gitIsLocal("https://example.com/repo.git"))
+}
+
+func TestGitChannel(t *testing.T) {
+	remote := "file://" + newTestGitRepository(t)
+
+	server := NewGitChannel()
+	server.poll_time = 10
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, remote+"#TEST"))
+	assert.Nil(t, server.Start())
+
+	client := NewGitChannel()
+	client.poll_time = 10
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, remote+"#TEST"))
+	assert.Nil(t, client.Start())
+
+	testRoundTrip(t, server, client, client.chunk_size, []string{"first", "second", "third"}, "hello client")
+
+	assert.NotNil(t, NewGitChannel().Setup(INPUT_CHANNEL, t.TempDir()+"/missing.git"))
+}
+
+func TestGitChannelClose(t *testing.T) {
+	server := NewGitChannel()
+	server.poll_time = 1
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, newTestGitRepository(t)+"#TEST"))
+	assert.Nil(t, server.Start())
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the poller is done with the scratch repository before it's removed
+	scratch := server.git.scratch
+	assert.Nil(t, server.Close())
+	_, err := os.Stat(scratch)
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, server.git.Put("SG1 TEST 0x01", []byte("closed")))
+}
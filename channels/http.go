@@ -0,0 +1,566 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// used when data is in the query string, a header or a cookie
+	HTTPSmallChunkSize = 1024
+	// used when data is in the POST body
+	HTTPChunkSize   = 64 * 1024
+	HTTPMaxBodySize = 1024 * 1024
+	HTTPUserAgent   = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	HTTPTimeout     = 30 * time.Second
+)
+
+var HTTPDefaultFields = map[string]string{
+	"query":  "q",
+	"header": "X-Request-Id",
+	"cookie": "session",
+	"body":   "",
+}
+
+// HTTPChannel sends packets as HTTP requests, the listener answers each
+// request with the packets it has to send back, if any. When used for
+// reading, the client polls the listener for new data. Like the inbound
+// packets, the outbound ones are keyed by the stream id of the client, the
+// listener sends data back to the last client it got a request from.
+type HTTPChannel struct {
+	is_client bool
+	address   string
+	url       string
+	shape     string
+	field     string
+	path      string
+	use_tls   bool
+	insecure  bool
+	poll_time int
+	server    *http.Server
+	client    *http.Client
+	demux     *sg1.PacketDemuxer
+	seq       *sg1.PacketSequencer
+	outbox    map[uint32][]*sg1.Packet
+	last      uint32
+	has_last  bool
+	pending   []byte
+	mutex     *sync.Mutex
+	polling   sync.Once
+	done      chan struct{}
+	closing   sync.Once
+	stats     Stats
+}
+
+func NewHTTPChannel() *HTTPChannel {
+	return &HTTPChannel{
+		is_client: true,
+		address:   "",
+		url:       "",
+		shape:     "body",
+		field:     "",
+		path:      "/",
+		use_tls:   false,
+		insecure:  false,
+		poll_time: 1000,
+		server:    nil,
+		client:    nil,
+		demux:     sg1.NewPacketDemuxer(),
+		seq:       sg1.NewPacketSequencer(),
+		outbox:    make(map[uint32][]*sg1.Packet),
+		last:      0,
+		has_last:  false,
+		mutex:     &sync.Mutex{},
+		done:      make(chan struct{}),
+	}
+}
+
+func (c *HTTPChannel) Copy() interface{} {
+	cp := NewHTTPChannel()
+	cp.shape = c.shape
+	cp.field = c.field
+	cp.path = c.path
+	cp.use_tls = c.use_tls
+	cp.insecure = c.insecure
+	cp.poll_time = c.poll_time
+	return cp
+}
+
+func (c *HTTPChannel) Name() string {
+	return "http"
+}
+
+func (c *HTTPChannel) Description() string {
+	return "As input, run an HTTP server decoding data from requests and sending data back in its responses to the last client it got a request from, as output send data as HTTP requests ( example: http:192.168.1.2:8080, see the -http-* arguments )."
+}
+
+func (c *HTTPChannel) Register() error {
+	flag.StringVar(&c.shape, "http-shape", c.shape, "Where to put data in HTTP requests, can be 'query', 'header', 'cookie' or 'body'.")
+	flag.StringVar(&c.field, "http-field", c.field, "Name of the query parameter, header or cookie carrying data, by default 'q', 'X-Request-Id' or 'session'.")
+	flag.StringVar(&c.path, "http-path", c.path, "Path of the HTTP requests.")
+	flag.BoolVar(&c.use_tls, "http-tls", c.use_tls, "Use HTTPS, the listener will generate a self signed certificate.")
+	flag.BoolVar(&c.insecure, "http-insecure", c.insecure, "Do not verify the certificate of the HTTPS server, needed to reach the self signed http listener.")
+	flag.IntVar(&c.poll_time, "http-poll-time", c.poll_time, "Number of milliseconds to wait between one HTTP poll request and another when reading from the listener.")
+	return nil
+}
+
+func (c *HTTPChannel) Setup(direction Direction, args string) (err error) {
+	if direction == INPUT_CHANNEL {
+		c.is_client = false
+	} else {
+		c.is_client = true
+	}
+
+	if _, _, err = net.SplitHostPort(args); err != nil {
+		return fmt.Errorf("Usage: http:ADDRESS:PORT")
+	}
+	c.address = args
+
+	if default_field, found := HTTPDefaultFields[c.shape]; found == false {
+		return fmt.Errorf("Unknown HTTP request shape '%s'.", c.shape)
+	} else if c.field == "" {
+		c.field = default_field
+	}
+
+	scheme := "http"
+	if c.use_tls {
+		scheme = "https"
+	}
+	c.url = fmt.Sprintf("%s://%s%s", scheme, c.address, c.path)
+
+	sg1.Debug("Setup HTTP channel: direction=%d url=%s shape=%s field=%s\n", direction, c.url, c.shape, c.field)
+
+	return nil
+}
+
+func (c *HTTPChannel) Start() error {
+	if c.is_client {
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: c.insecure},
+		}
+		c.client = &http.Client{Transport: transport, Timeout: HTTPTimeout}
+
+		sg1.Log("Sending data to %s ...\n\n", c.url)
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", c.address)
+	if err != nil {
+		return err
+	}
+
+	if c.use_tls {
+		config, err := getCertificateConfig("", "")
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, config)
+	}
+
+	c.server = &http.Server{Handler: http.HandlerFunc(c.handler)}
+
+	go func() {
+		sg1.Log("Started HTTP server on %s ...\n\n", c.url)
+
+		if err := c.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			sg1.Error("HTTP server stopped: %s\n", err)
+			c.Close()
+		}
+	}()
+
+	return nil
+}
+
+func (c *HTTPChannel) HasReader() bool {
+	return true
+}
+
+func (c *HTTPChannel) HasWriter() bool {
+	return true
+}
+
+func (c *HTTPChannel) chunkSize() int {
+	if c.shape == "body" {
+		return HTTPChunkSize
+	}
+	return HTTPSmallChunkSize
+}
+
+// Build a request carrying the given packet.
+func (c *HTTPChannel) request(packet *sg1.Packet) (req *http.Request, err error) {
+	data := packet.Raw()
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+
+	switch c.shape {
+	case "query":
+		req, err = http.NewRequest("GET", c.url+"?"+c.field+"="+encoded, nil)
+	case "header":
+		if req, err = http.NewRequest("GET", c.url, nil); err == nil {
+			req.Header.Set(c.field, encoded)
+		}
+	case "cookie":
+		if req, err = http.NewRequest("GET", c.url, nil); err == nil {
+			req.AddCookie(&http.Cookie{Name: c.field, Value: encoded})
+		}
+	default:
+		if req, err = http.NewRequest("POST", c.url, bytes.NewReader(data)); err == nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+	}
+
+	if err == nil {
+		req.Header.Set("User-Agent", HTTPUserAgent)
+	}
+
+	return req, err
+}
+
+// Extract the data of a request, returns an error if the request was not
+// sent by sg1 and an empty payload for poll requests.
+func (c *HTTPChannel) payload(r *http.Request) ([]byte, error) {
+	encoded := ""
+
+	switch c.shape {
+	case "query":
+		values, found := r.URL.Query()[c.field]
+		if found == false {
+			return nil, fmt.Errorf("No '%s' query parameter.", c.field)
+		}
+		encoded = values[0]
+	case "header":
+		values, found := r.Header[http.CanonicalHeaderKey(c.field)]
+		if found == false {
+			return nil, fmt.Errorf("No '%s' header.", c.field)
+		}
+		encoded = values[0]
+	case "cookie":
+		cookie, err := r.Cookie(c.field)
+		if err != nil {
+			return nil, fmt.Errorf("No '%s' cookie.", c.field)
+		}
+		encoded = cookie.Value
+	default:
+		if r.Method != "POST" {
+			return nil, fmt.Errorf("Unexpected %s request.", r.Method)
+		}
+		return io.ReadAll(io.LimitReader(r.Body, HTTPMaxBodySize))
+	}
+
+	return base64.RawURLEncoding.DecodeString(encoded)
+}
+
+// Decode the packets of a request or response payload, polls only tell the
+// listener which client is asking and are not passed on.
+func (c *HTTPChannel) receive(buffer []byte) []*sg1.Packet {
+	packets, err := sg1.DecodePackets(buffer)
+	if err != nil {
+		sg1.Error("Error while decoding HTTP payload: %s\n", err)
+	}
+
+	for _, packet := range packets {
+		if packet.IsPoll() {
+			continue
+		}
+
+		sg1.Debug("Decoded packet of %d bytes from HTTP payload.\n", packet.DataSize)
+
+		c.mutex.Lock()
+		c.stats.TotalRead += int(packet.DataSize)
+		c.mutex.Unlock()
+
+		c.demux.Add(packet)
+	}
+
+	return packets
+}
+
+func (c *HTTPChannel) outboxSize() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	size := 0
+	for _, queued := range c.outbox {
+		size += len(queued)
+	}
+	return size
+}
+
+// Make the given client stream the one the listener sends data to, packets
+// queued before any client showed up are handed to the first one.
+func (c *HTTPChannel) setLast(stream uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.has_last == false && stream != c.last {
+		if queued, found := c.outbox[c.last]; found {
+			c.outbox[stream] = queued
+			delete(c.outbox, c.last)
+		}
+	}
+
+	c.last = stream
+	c.has_last = true
+}
+
+// Queue packets for the last client, all of them go to the same one.
+func (c *HTTPChannel) queue(packets []*sg1.Packet) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.outbox[c.last] = append(c.outbox[c.last], packets...)
+}
+
+// Return the packets queued for the given client stream as a single buffer,
+// up to the maximum body size the client will read, the others are left
+// queued for the next requests.
+func (c *HTTPChannel) drain(stream uint32) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	queued := c.outbox[stream]
+	buffer := []byte{}
+	sent := 0
+	for _, packet := range queued {
+		raw := packet.Raw()
+		if len(buffer)+len(raw) > HTTPMaxBodySize {
+			break
+		}
+		buffer = append(buffer, raw...)
+		sent++
+	}
+
+	if sent == len(queued) {
+		delete(c.outbox, stream)
+	} else {
+		c.outbox[stream] = queued[sent:]
+	}
+
+	return buffer
+}
+
+func (c *HTTPChannel) handler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != c.path {
+		sg1.Debug("Ignoring HTTP request for %s from %s.\n", r.URL.Path, r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := c.payload(r)
+	if err != nil {
+		sg1.Debug("Ignoring HTTP request from %s: %s\n", r.RemoteAddr, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	sg1.Debug("Got HTTP request from %s with %d bytes of payload.\n", r.RemoteAddr, len(data))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	// every request of our clients carries at least a poll packet
+	packets := c.receive(data)
+	if len(packets) == 0 {
+		return
+	}
+
+	stream := packets[0].StreamID
+	c.setLast(stream)
+	w.Write(c.drain(stream))
+}
+
+// Send a request with the given packet, or poll if nil, and process the data
+// sent back by the listener. Returns the number of packets received.
+func (c *HTTPChannel) roundTrip(packet *sg1.Packet) (int, error) {
+	if packet == nil {
+		packet = sg1.NewPollPacket(c.seq.StreamID())
+	}
+
+	req, err := c.request(packet)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Unexpected HTTP status %s.", res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, HTTPMaxBodySize))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(c.receive(data)), nil
+}
+
+// Start polling the listener for data, this only happens once and only when
+// the client is actually used for reading.
+func (c *HTTPChannel) startPolling() {
+	c.polling.Do(func() {
+		go c.poller()
+	})
+}
+
+func (c *HTTPChannel) poller() {
+	sg1.Debug("HTTP poller started.\n")
+
+	for {
+		select {
+		case <-c.done:
+			sg1.Debug("HTTP poller stopped.\n")
+			return
+		default:
+		}
+
+		// keep polling without waiting as long as we get data
+		received, err := c.roundTrip(nil)
+		if err != nil {
+			sg1.Warning("Error while polling HTTP listener: %s\n", err)
+		} else if received > 0 {
+			continue
+		}
+
+		select {
+		case <-time.After(time.Duration(c.poll_time) * time.Millisecond):
+		case <-c.done:
+		}
+	}
+}
+
+func (c *HTTPChannel) Read(b []byte) (n int, err error) {
+	if c.is_client {
+		c.startPolling()
+	}
+
+	// packets can be bigger than the buffer, what is left is kept for the
+	// next reads
+	if len(c.pending) == 0 {
+		packet, err := c.demux.Get()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = packet.Data
+	}
+
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	sg1.Debug("Read %d bytes from HTTP channel.\n", n)
+
+	return n, nil
+}
+
+// Send the packets as requests, or queue them for the last client if we're
+// the listener since it can only answer to requests. Returns the number of
+// bytes of data sent or queued.
+func (c *HTTPChannel) send(packets []*sg1.Packet) (wrote int, err error) {
+	if c.is_client == false {
+		c.queue(packets)
+	}
+
+	for _, packet := range packets {
+		if c.is_client {
+			if _, err = c.roundTrip(packet); err != nil {
+				return wrote, err
+			}
+		}
+
+		wrote += int(packet.DataSize)
+
+		c.mutex.Lock()
+		c.stats.TotalWrote += int(packet.DataSize)
+		c.mutex.Unlock()
+	}
+
+	return wrote, nil
+}
+
+func (c *HTTPChannel) Write(b []byte) (n int, err error) {
+	sg1.Debug("Writing %d bytes to HTTP channel as chunks of %d bytes.\n", len(b), c.chunkSize())
+
+	wrote, err := c.send(c.seq.Packets(b, c.chunkSize()))
+	if err != nil {
+		return wrote, err
+	}
+
+	sg1.Debug("Wrote %d bytes to HTTP channel.\n", wrote)
+
+	return wrote, nil
+}
+
+func (c *HTTPChannel) CloseWrite() error {
+	c.mutex.Lock()
+	wrote := c.stats.TotalWrote
+	c.mutex.Unlock()
+
+	if c.demux.IsClosed() || (c.is_client == false && wrote == 0) {
+		return nil
+	}
+
+	sg1.Debug("Sending HTTP FIN packet.\n")
+	_, err := c.send([]*sg1.Packet{c.seq.Fin()})
+	return err
+}
+
+func (c *HTTPChannel) Close() error {
+	c.closing.Do(func() {
+		sg1.Debug("Closing HTTP channel.\n")
+
+		close(c.done)
+		c.demux.Close()
+
+		if c.server != nil {
+			// give the client the chance to poll what's left
+			for i := 0; i < 20 && c.outboxSize() > 0; i++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+			c.server.Close()
+		}
+	})
+	return nil
+}
+
+func (c *HTTPChannel) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
@@ -0,0 +1,171 @@
+package channels
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func newTestHTTPChannels(t *testing.T, shape string, use_tls bool) (*HTTPChannel, *HTTPChannel) {
+	address := freeAddress(t)
+
+	server := NewHTTPChannel()
+	server.shape = shape
+	server.use_tls = use_tls
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+	assert.Nil(t, server.Start())
+
+	client := NewHTTPChannel()
+	client.shape = shape
+	client.use_tls = use_tls
+	// the certificate of the https listener is self signed
+	client.insecure = use_tls
+	client.poll_time = 10
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, address))
+	assert.Nil(t, client.Start())
+
+	return server, client
+}
+
+func readString(t *testing.T, c Channel) string {
+	buff := make([]byte, HTTPChunkSize)
+	n, err := c.Read(buff)
+	assert.Nil(t, err)
+	return string(buff[:n])
+}
+
+func TestHTTPChannelShapes(t *testing.T) {
+	for shape := range HTTPDefaultFields {
+		server, client := newTestHTTPChannels(t, shape, false)
+
+		_, err := client.Write([]byte("hello " + shape))
+		assert.Nil(t, err)
+		assert.Equal(t, "hello "+shape, readString(t, server))
+
+		// data is sent back in the responses to the client polls
+		_, err = server.Write([]byte("hello client"))
+		assert.Nil(t, err)
+		assert.Equal(t, "hello client", readString(t, client))
+
+		// the FIN packet of the client ends the listener stream
+		assert.Nil(t, client.CloseWrite())
+		_, err = server.Read(make([]byte, 16))
+		assert.NotNil(t, err)
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestHTTPSChannel(t *testing.T) {
+	server, client := newTestHTTPChannels(t, "body", true)
+	defer server.Close()
+	defer client.Close()
+
+	_, err := client.Write([]byte("hello over https"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello over https", readString(t, server))
+}
+
+func TestHTTPSChannelVerifiesCertificate(t *testing.T) {
+	address := freeAddress(t)
+
+	server := NewHTTPChannel()
+	server.use_tls = true
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+	assert.Nil(t, server.Start())
+	defer server.Close()
+
+	client := NewHTTPChannel()
+	client.use_tls = true
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, address))
+	assert.Nil(t, client.Start())
+	defer client.Close()
+
+	_, err := client.client.Get(client.url)
+	assert.NotNil(t, err)
+}
+
+func TestHTTPChannelIgnoresForeignRequests(t *testing.T) {
+	server, client := newTestHTTPChannels(t, "query", false)
+	defer server.Close()
+	defer client.Close()
+
+	res, err := client.client.Get("http://" + server.address + "/")
+	assert.Nil(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+
+	res, err = client.client.Get("http://" + server.address + "/other?q=")
+	assert.Nil(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestHTTPChannelLargeReply(t *testing.T) {
+	server, client := newTestHTTPChannels(t, "body", false)
+	defer server.Close()
+	defer client.Close()
+
+	// more than a response body can carry is queued before the first poll,
+	// and read with a buffer smaller than the packets
+	message := bytes.Repeat([]byte("0123456789abcdef"), 2*HTTPMaxBodySize/16)
+	_, err := server.Write(message)
+	assert.Nil(t, err)
+
+	received := make([]byte, 0)
+	buff := make([]byte, 16*1024)
+	for len(received) < len(message) {
+		n, err := client.Read(buff)
+		if !assert.Nil(t, err) {
+			break
+		}
+		received = append(received, buff[:n]...)
+	}
+	assert.Equal(t, message, received)
+}
+
+func TestHTTPChannelRepliesToItsClient(t *testing.T) {
+	server, first := newTestHTTPChannels(t, "body", false)
+	defer server.Close()
+	defer first.Close()
+
+	second := NewHTTPChannel()
+	second.poll_time = 10
+	assert.Nil(t, second.Setup(OUTPUT_CHANNEL, server.address))
+	assert.Nil(t, second.Start())
+	defer second.Close()
+
+	_, err := first.Write([]byte("from first"))
+	assert.Nil(t, err)
+	assert.Equal(t, "from first", readString(t, server))
+
+	_, err = server.Write([]byte("for first"))
+	assert.Nil(t, err)
+
+	// the second client polls before the first one, but the reply is not
+	// for it
+	stolen := make(chan string, 1)
+	go func() {
+		buff := make([]byte, 64)
+		if n, err := second.Read(buff); err == nil {
+			stolen <- string(buff[:n])
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Equal(t, "for first", readString(t, first))
+	select {
+	case data := <-stolen:
+		t.Fatalf("The second client got '%s'.", data)
+	default:
+	}
+}
@@ -27,39 +27,160 @@
 package channels
 
 import (
+	"encoding/binary"
+	"flag"
 	"fmt"
 	"github.com/evilsocket/sg1/sg1"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"net"
-	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	ProtocolICMP   = 1 /* from iana.ProtocolICMP which being internal I can't use -.- */
-	ICMPChunkSize  = 128
-	ICMPBufferSize = 512
+	ProtocolICMP     = 1  /* from iana.ProtocolICMP which being internal I can't use -.- */
+	ProtocolIPv6ICMP = 58 /* from iana.ProtocolIPv6ICMP */
+	ICMPChunkSize    = 128
+	// default -icmp-mtu, payloads are kept within an ethernet frame to avoid
+	// fragmentation
+	ICMPMTU        = 1500
+	ICMPHeaderSize = 8
+	// big enough for the echoes of a peer using a bigger MTU
+	ICMPBufferSize = 64 * 1024
 )
 
+// ICMPLayout mimics the echo payload of a common ping implementation, the
+// sg1 packet is placed after the prefix and the rest of the payload is filled
+// with the pattern of the implementation.
+type ICMPLayout struct {
+	// default payload size
+	Size       int
+	PrefixSize int
+	Prefix     func() []byte
+	Fill       func(offset int) byte
+}
+
+var ICMPLayouts = map[string]ICMPLayout{
+	"none": {
+		Size: ICMPChunkSize + sg1.PACKET_HEADER_SIZE,
+	},
+	// iputils ping, a 64 bit struct timeval followed by incrementing bytes
+	"linux": {
+		Size:       56,
+		PrefixSize: 16,
+		Prefix: func() []byte {
+			now := time.Now()
+			tv := make([]byte, 16)
+			binary.LittleEndian.PutUint64(tv[0:8], uint64(now.Unix()))
+			binary.LittleEndian.PutUint64(tv[8:16], uint64(now.Nanosecond()/1000))
+			return tv
+		},
+		Fill: func(offset int) byte {
+			return byte(offset)
+		},
+	},
+	// windows ping.exe, the alphabet up to 'w' over and over
+	"windows": {
+		Size: 32,
+		Fill: func(offset int) byte {
+			return byte('a' + offset%23)
+		},
+	},
+}
+
+// icmpPeer is a client the listener got echoes from, with its own stream of
+// packets to send back in the replies to its requests.
+type icmpPeer struct {
+	addr     net.Addr
+	id       int
+	seq      *sg1.PacketSequencer
+	reliable *sg1.ReliableSender
+	outbox   []*sg1.Packet
+}
+
+// ICMPChannel sends packets as the payload of ICMP echo requests, the
+// listener answers each request with one of the packets it has to send back,
+// if any, as the payload of an echo reply. When used for reading, the client
+// polls the listener for new data. With -reliable the listener answers data
+// with its ACK, while the client sends its ACKs as requests which the
+// listener answers like polls.
 type ICMPChannel struct {
 	is_client bool
 	address   string
+	ip        net.IP
+	network   string
+	protocol  int
+	echo_id   int
+	echo_seq  int
+	peer      string
+	peer_ip   net.IP
+	peer_id   int
+	size      int
+	mtu       int
+	mimic     string
+	layout    ICMPLayout
+	poll_time int
+	demux     *sg1.PacketDemuxer
 	seq       *sg1.PacketSequencer
+	reliable  *sg1.ReliableSender
+	pending   []byte
 	conn      *icmp.PacketConn
+	peers     map[string]*icmpPeer
+	last      *icmpPeer
+	received  chan struct{}
+	polling   sync.Once
+	done      chan struct{}
+	closed    bool
+	mutex     *sync.Mutex
+	cond      *sync.Cond
 	stats     Stats
 }
 
 func NewICMPChannel() *ICMPChannel {
+	mutex := &sync.Mutex{}
 	return &ICMPChannel{
 		is_client: true,
 		address:   "0.0.0.0",
+		ip:        nil,
+		network:   "",
+		protocol:  ProtocolICMP,
+		echo_id:   0,
+		echo_seq:  0,
+		peer:      "",
+		peer_ip:   nil,
+		peer_id:   0,
+		size:      0,
+		mtu:       ICMPMTU,
+		mimic:     "none",
+		layout:    ICMPLayouts["none"],
+		poll_time: 1000,
+		demux:     sg1.NewPacketDemuxer(),
 		seq:       sg1.NewPacketSequencer(),
+		reliable:  nil,
+		pending:   nil,
 		conn:      nil,
+		peers:     make(map[string]*icmpPeer),
+		last:      nil,
+		received:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		closed:    false,
+		mutex:     mutex,
+		cond:      sync.NewCond(mutex),
 	}
 }
 
 func (c *ICMPChannel) Copy() interface{} {
-	return NewICMPChannel()
+	cp := NewICMPChannel()
+	cp.poll_time = c.poll_time
+	cp.echo_id = c.echo_id
+	cp.peer = c.peer
+	cp.size = c.size
+	cp.mtu = c.mtu
+	cp.mimic = c.mimic
+	return cp
 }
 
 func (c *ICMPChannel) Name() string {
@@ -67,10 +188,16 @@ func (c *ICMPChannel) Name() string {
 }
 
 func (c *ICMPChannel) Description() string {
-	return "Send data as ICMP packets and read data as ICMP packets ( example: icmp:192.168.1.24 or just icmp for 0.0.0.0 )."
+	return "Send data as ICMP echo requests and read data from ICMP echo replies, as input read data from ICMP echo requests from any number of peers and send data back as echo replies to the last peer it got echoes from, the other peers never get data back ( example: icmp:192.168.1.24, icmp:::1 or just icmp for 0.0.0.0 )."
 }
 
 func (c *ICMPChannel) Register() error {
+	flag.IntVar(&c.size, "icmp-payload-size", c.size, "Size of the ICMP echo payload, by default 152 bytes or the size used by the -icmp-mimic layout.")
+	flag.IntVar(&c.mtu, "icmp-mtu", c.mtu, "MTU of the path to the other end, the ICMP payload size must fit in it together with the IP and ICMP headers.")
+	flag.StringVar(&c.mimic, "icmp-mimic", c.mimic, "Make ICMP echo payloads look like the ones of a common ping implementation, can be 'none', 'linux' or 'windows'.")
+	flag.IntVar(&c.echo_id, "icmp-id", c.echo_id, "ICMP echo identifier, a client will use a random one by default, a listener will only accept echoes with this identifier.")
+	flag.StringVar(&c.peer, "icmp-peer", c.peer, "Only accept ICMP echoes from this address, by default the listener accepts echoes from any address.")
+	flag.IntVar(&c.poll_time, "icmp-poll-time", c.poll_time, "Number of milliseconds to wait between one ICMP poll request and another when reading from the listener.")
 	return nil
 }
 
@@ -86,105 +213,504 @@ func (c *ICMPChannel) Setup(direction Direction, args string) (err error) {
 		c.address = args
 	}
 
-	sg1.Debug("Setup ICMP channel: direction=%d address=%s\n", direction, c.address)
+	if c.ip = net.ParseIP(c.address); c.ip == nil {
+		return fmt.Errorf("Could not parse ICMP address '%s'.", c.address)
+	} else if c.ip.To4() == nil {
+		c.protocol = ProtocolIPv6ICMP
+	}
+
+	if err = c.setupPayload(); err != nil {
+		return err
+	}
+
+	if c.is_client && c.echo_id == 0 {
+		c.echo_id = int(sg1.NewStreamID() & 0xffff)
+	} else if c.is_client == false && c.echo_id != 0 {
+		c.peer_id = c.echo_id
+	}
+
+	if c.peer != "" {
+		if c.peer_ip = net.ParseIP(c.peer); c.peer_ip == nil {
+			return fmt.Errorf("Could not parse ICMP peer address '%s'.", c.peer)
+		}
+	}
+
+	sg1.Debug("Setup ICMP channel: direction=%d address=%s id=%d peer=%s payload=%d mimic=%s\n", direction, c.address, c.echo_id, c.peer, c.size, c.mimic)
+
+	return nil
+}
+
+// Validate the payload layout and size.
+func (c *ICMPChannel) setupPayload() error {
+	layout, found := ICMPLayouts[strings.ToLower(c.mimic)]
+	if found == false {
+		return fmt.Errorf("Unsupported ICMP payload layout '%s'.", c.mimic)
+	}
+	c.layout = layout
+
+	if c.size == 0 {
+		c.size = layout.Size
+	}
+
+	ip_header := 20
+	if c.isIPv6() {
+		ip_header = 40
+	}
+
+	if max_size := c.mtu - ip_header - ICMPHeaderSize; c.size > max_size {
+		return fmt.Errorf("ICMP payload size %d exceeds the maximum of %d bytes for a MTU of %d bytes.", c.size, max_size, c.mtu)
+	} else if c.chunkSize() <= 0 {
+		return fmt.Errorf("ICMP payload size %d is too small for the '%s' layout.", c.size, c.mimic)
+	}
 
 	return nil
 }
 
+func (c *ICMPChannel) chunkSize() int {
+	return c.size - c.layout.PrefixSize - sg1.PACKET_HEADER_SIZE
+}
+
+// Lay out the packet in an echo payload.
+func (c *ICMPChannel) payload(packet *sg1.Packet) []byte {
+	data := []byte{}
+	if c.layout.Prefix != nil {
+		data = append(data, c.layout.Prefix()...)
+	}
+	data = append(data, packet.Raw()...)
+
+	if c.layout.Fill != nil {
+		for offset := len(data); offset < c.size; offset++ {
+			data = append(data, c.layout.Fill(offset))
+		}
+	}
+
+	return data
+}
+
+// Return the packet in an echo payload, the padding is ignored by DecodePacket.
+func (c *ICMPChannel) unpayload(data []byte) (*sg1.Packet, error) {
+	if len(data) < c.layout.PrefixSize {
+		return nil, fmt.Errorf("Payload of %d bytes is shorter than the %d bytes prefix.", len(data), c.layout.PrefixSize)
+	}
+	return sg1.DecodePacket(data[c.layout.PrefixSize:])
+}
+
+// Return the peer sending the echo, or nil if it's not the address and id we
+// were told to accept. Every address and id pair is a different peer with its
+// own replies, so that several senders can share the listener without
+// getting each other's packets.
+func (c *ICMPChannel) accept(addr net.Addr, id int) *icmpPeer {
+	ip := peerIP(addr)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed || (c.peer_ip != nil && c.peer_ip.Equal(ip) == false) || (c.peer_id != 0 && c.peer_id != id) {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s/%d", ip, id)
+	peer, found := c.peers[key]
+	if found == false {
+		sg1.Log("Accepting ICMP echoes from %s with id %d.\n", ip, id)
+		peer = &icmpPeer{
+			addr:     addr,
+			id:       id,
+			seq:      sg1.NewPacketSequencer(),
+			reliable: nil,
+			outbox:   make([]*sg1.Packet, 0),
+		}
+		if sg1.Reliable {
+			// sequence numbers are per peer, so are the packets waiting for their ACK
+			peer.reliable = sg1.NewReliableSender(func(packet *sg1.Packet) error {
+				c.queue(peer, packet)
+				return nil
+			}, sg1.ReliableWindow, time.Duration(sg1.ReliableTimeout)*time.Millisecond, sg1.ReliableRetries)
+			peer.reliable.Start()
+		}
+		c.peers[key] = peer
+	}
+
+	if c.last != peer {
+		sg1.Debug("Replying to ICMP peer %s with id %d.\n", ip, id)
+		c.last = peer
+		c.cond.Broadcast()
+	}
+
+	return peer
+}
+
+// Return the last peer we got echoes from, waiting for one if needed.
+func (c *ICMPChannel) lastPeer() *icmpPeer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.last == nil && c.closed == false {
+		sg1.Debug("Waiting for ICMP peer ...\n")
+		c.cond.Wait()
+	}
+
+	return c.last
+}
+
+func peerIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func (c *ICMPChannel) isIPv6() bool {
+	return c.protocol == ProtocolIPv6ICMP
+}
+
+// Open a raw ICMP socket, or an unprivileged datagram one if we're a client
+// and the system allows it for our group ( see net.ipv4.ping_group_range ).
+func (c *ICMPChannel) listen() (err error) {
+	raw, datagram, any := "ip4:icmp", "udp4", "0.0.0.0"
+	if c.isIPv6() {
+		raw, datagram, any = "ip6:ipv6-icmp", "udp6", "::"
+	}
+
+	address := c.address
+	if c.is_client {
+		address = any
+	}
+
+	if c.conn, err = icmp.ListenPacket(raw, address); err == nil {
+		c.network = raw
+		return nil
+	} else if c.is_client == false {
+		return err
+	}
+
+	sg1.Debug("Could not open raw ICMP socket (%s), trying unprivileged one.\n", err)
+
+	if c.conn, err = icmp.ListenPacket(datagram, address); err != nil {
+		return fmt.Errorf("Could not open raw or unprivileged ICMP socket: %s", err)
+	}
+
+	c.network = datagram
+	return nil
+}
+
+func (c *ICMPChannel) isUnprivileged() bool {
+	return c.network == "udp4" || c.network == "udp6"
+}
+
 func (c *ICMPChannel) Start() (err error) {
-	c.seq.Start()
+	if err = c.listen(); err != nil {
+		return err
+	}
 
-	if c.is_client == true {
-		if c.conn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0"); err != nil {
-			return err
+	if c.is_client {
+		if sg1.Reliable {
+			c.reliable = sg1.NewReliableSender(c.send, sg1.ReliableWindow, time.Duration(sg1.ReliableTimeout)*time.Millisecond, sg1.ReliableRetries)
+			c.reliable.Start()
 		}
+		sg1.Log("Sending ICMP echo requests to %s (%s) ...\n\n", c.address, c.network)
 	} else {
-		if c.conn, err = icmp.ListenPacket("ip4:icmp", c.address); err != nil {
-			return err
+		sg1.Log("Started ICMP listener on %s ...\n\n", c.address)
+	}
+
+	go c.reader()
+
+	return nil
+}
+
+func (c *ICMPChannel) echoTypes() (request icmp.Type, reply icmp.Type) {
+	if c.isIPv6() {
+		return ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	return ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+}
+
+func (c *ICMPChannel) reader() {
+	request_type, reply_type := c.echoTypes()
+	// the listener reads requests, the client reads replies
+	expected := request_type
+	if c.is_client {
+		expected = reply_type
+	}
+
+	buffer := make([]byte, ICMPBufferSize)
+	for {
+		n, peer, err := c.conn.ReadFrom(buffer)
+		if err != nil {
+			if c.isClosed() {
+				sg1.Debug("ICMP reader stopped.\n")
+				return
+			}
+			sg1.Warning("Error while reading ICMP packet: %s.\n", err)
+			continue
 		}
 
-		go func() {
-			defer c.conn.Close()
-
-			sg1.Log("Started ICMP listener on %s ...\n\n", c.address)
-
-			buffer := make([]byte, ICMPBufferSize)
-			for {
-				n, peer, err := c.conn.ReadFrom(buffer)
-				if err != nil {
-					sg1.Warning("Error while reading ICMP packet: %s.\n", err)
-					continue
-				}
-
-				sg1.Debug("Read %d bytes of ICMP packet from %s .\n", n, peer)
-
-				msg, err := icmp.ParseMessage(ProtocolICMP, buffer[:n])
-				if err != nil {
-					sg1.Warning("Error while parsing ICMP packet sent by %s: %s.\n", peer, err)
-					continue
-				}
-
-				if msg.Type == ipv4.ICMPTypeEcho {
-					sg1.Debug("Got ICMP echo.\n")
-					echo := msg.Body.(*icmp.Echo)
-					if packet, err := sg1.DecodePacket(echo.Data); err == nil {
-						sg1.Debug("Decoded packet of %d bytes from ICMP echo payload (seqn=%d).\n", packet.DataSize, packet.SeqNumber)
-
-						c.stats.TotalRead += int(packet.DataSize)
-						c.seq.Add(packet)
-					} else {
-						sg1.Error("Error while decoding ICMP payload: %s.\n", err)
-					}
-				} else {
-					sg1.Debug("ICMP packet is not an echo.\n")
-				}
+		sg1.Debug("Read %d bytes of ICMP packet from %s .\n", n, peer)
+
+		msg, err := icmp.ParseMessage(c.protocol, buffer[:n])
+		if err != nil {
+			sg1.Warning("Error while parsing ICMP packet sent by %s: %s.\n", peer, err)
+			continue
+		} else if msg.Type != expected {
+			sg1.Debug("ICMP packet is not an %s.\n", expected)
+			continue
+		}
+
+		echo := msg.Body.(*icmp.Echo)
+		if c.is_client {
+			// unprivileged sockets only get our replies, with the id set by the kernel
+			if c.isUnprivileged() == false && echo.ID != c.echo_id {
+				sg1.Debug("Ignoring ICMP echo reply with id %d.\n", echo.ID)
+				continue
+			} else if c.ip.Equal(peerIP(peer)) == false {
+				sg1.Debug("Ignoring ICMP echo reply from %s.\n", peer)
+				continue
 			}
-		}()
+		}
+
+		packet, err := c.unpayload(echo.Data)
+		if err != nil {
+			sg1.Debug("Ignoring ICMP echo which is not an sg1 packet: %s.\n", err)
+			continue
+		} else if packet.StreamID == c.seq.StreamID() && packet.IsAck() == false {
+			// the kernel of the listener answers as well, echoing our own packet
+			sg1.Debug("Ignoring ICMP echo with our own packet.\n")
+			continue
+		}
+
+		if c.is_client == false {
+			from := c.accept(peer, echo.ID)
+			if from == nil {
+				sg1.Debug("Ignoring ICMP echo from %s with id %d.\n", peer, echo.ID)
+				continue
+			}
+			c.reply(from, echo, packet)
+
+			if packet.IsAck() && from.reliable != nil {
+				from.reliable.Ack(packet)
+			}
+		}
+
+		sg1.Debug("Decoded packet of %d bytes from ICMP echo payload (stream=%x seqn=%d).\n", packet.DataSize, packet.StreamID, packet.SeqNumber)
+
+		if packet.IsPoll() {
+			continue
+		} else if packet.IsAck() {
+			if c.is_client && c.reliable != nil {
+				c.reliable.Ack(packet)
+			}
+			continue
+		}
+
+		c.mutex.Lock()
+		c.stats.TotalRead += int(packet.DataSize)
+		c.mutex.Unlock()
+
+		c.demux.Add(packet)
+
+		// the listener acknowledges data in its reply
+		if c.is_client && sg1.Reliable {
+			if err := c.send(sg1.NewAckPacket(packet)); err != nil {
+				sg1.Warning("Error while sending ICMP ACK: %s.\n", err)
+			}
+		}
+
+		// let the poller know there might be more
+		select {
+		case c.received <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Answer an echo request with the next packet we have to send to its peer,
+// if any, or with the ACK of the packet it carries if -reliable is used.
+func (c *ICMPChannel) reply(peer *icmpPeer, echo *icmp.Echo, received *sg1.Packet) {
+	var packet *sg1.Packet
+
+	c.mutex.Lock()
+	if peer.reliable != nil && received.IsPoll() == false && received.IsAck() == false {
+		packet = sg1.NewAckPacket(received)
+	} else if len(peer.outbox) > 0 {
+		packet = peer.outbox[0]
+		peer.outbox = peer.outbox[1:]
+	}
+	c.mutex.Unlock()
+
+	if packet == nil {
+		return
+	}
+
+	_, reply_type := c.echoTypes()
+	if err := c.sendEcho(peer.addr, reply_type, echo.ID, echo.Seq, packet); err != nil {
+		sg1.Error("Error while sending ICMP echo reply: %s\n", err)
+	}
+}
+
+func (c *ICMPChannel) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *ICMPChannel) outboxSize() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	size := 0
+	for _, peer := range c.peers {
+		size += len(peer.outbox)
+	}
+	return size
+}
+
+func (c *ICMPChannel) CloseWrite() error {
+	c.mutex.Lock()
+	wrote := c.stats.TotalWrote
+	closed := c.closed
+	c.mutex.Unlock()
+
+	if closed || c.conn == nil || c.demux.IsClosed() || (c.is_client == false && wrote == 0) {
+		return nil
+	}
+
+	sg1.Debug("Sending ICMP FIN packet.\n")
+
+	seq, reliable := c.seq, c.reliable
+	var peer *icmpPeer
+	if c.is_client == false {
+		if peer = c.lastPeer(); peer == nil {
+			return nil
+		}
+		seq, reliable = peer.seq, peer.reliable
+	}
+
+	fin := seq.Fin()
+	if reliable != nil {
+		if err := reliable.Send(fin); err != nil {
+			return err
+		}
+		return reliable.Flush()
+	} else if peer != nil {
+		c.queue(peer, fin)
+		return nil
+	}
+	return c.send(fin)
+}
+
+func (c *ICMPChannel) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+
+	sg1.Debug("Closing ICMP channel.\n")
+
+	c.closed = true
+	c.cond.Broadcast()
+	reliable := make([]*sg1.ReliableSender, 0)
+	if c.reliable != nil {
+		reliable = append(reliable, c.reliable)
+	}
+	for _, peer := range c.peers {
+		if peer.reliable != nil {
+			reliable = append(reliable, peer.reliable)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, r := range reliable {
+		r.Close()
+	}
+
+	if c.is_client == false {
+		// give the client the chance to poll what's left
+		for i := 0; i < 20 && c.outboxSize() > 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
 	}
 
+	close(c.done)
+	c.demux.Close()
+
+	if c.conn != nil {
+		return c.conn.Close()
+	}
 	return nil
 }
 
 func (c *ICMPChannel) HasReader() bool {
-	if c.is_client {
-		return false
-	}
 	return true
 }
 
 func (c *ICMPChannel) HasWriter() bool {
-	if c.is_client {
-		return true
+	return true
+}
+
+// Start polling the listener for data, this only happens once and only when
+// the client is actually used for reading.
+func (c *ICMPChannel) startPolling() {
+	c.polling.Do(func() {
+		go c.poller()
+	})
+}
+
+func (c *ICMPChannel) poller() {
+	sg1.Debug("ICMP poller started.\n")
+
+	for {
+		if err := c.send(sg1.NewPollPacket(c.seq.StreamID())); err != nil && c.isClosed() == false {
+			sg1.Warning("Error while polling ICMP listener: %s\n", err)
+		}
+
+		// keep polling without waiting as long as we get data
+		select {
+		case <-c.received:
+		case <-time.After(time.Duration(c.poll_time) * time.Millisecond):
+		case <-c.done:
+			sg1.Debug("ICMP poller stopped.\n")
+			return
+		}
 	}
-	return false
 }
 
 func (c *ICMPChannel) Read(b []byte) (n int, err error) {
 	if c.is_client {
-		return 0, fmt.Errorf("icmp client can't be used for reading.")
+		c.startPolling()
 	}
 
-	packet := c.seq.Get()
-	data := packet.Data
-	for i, c := range data {
-		b[i] = c
+	// packets can be bigger than the buffer, what is left is kept for the
+	// next reads
+	if len(c.pending) == 0 {
+		packet, err := c.demux.Get()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = packet.Data
 	}
 
-	sg1.Debug("Read %d bytes from ICMP listener.\n", len(data))
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
 
-	return len(data), nil
+	sg1.Debug("Read %d bytes from ICMP channel.\n", n)
+
+	return n, nil
 }
 
-func (c *ICMPChannel) sendPacket(packet *sg1.Packet) error {
-	sg1.Debug("Encapsulating %d bytes of packet in ICMP echo payload for address %s.\n", packet.DataSize, c.address)
+func (c *ICMPChannel) sendEcho(to net.Addr, kind icmp.Type, id int, seqn int, packet *sg1.Packet) error {
+	sg1.Debug("Encapsulating %d bytes of packet in ICMP %s payload for address %s.\n", packet.DataSize, kind, to)
 
-	data := packet.Raw()
+	data := c.payload(packet)
 	sg1.Debug("HEX: %s\n", sg1.Hex(data))
 	msg := icmp.Message{
-		Type: ipv4.ICMPTypeEcho,
+		Type: kind,
 		Code: 0,
 		Body: &icmp.Echo{
-			ID: os.Getpid() & 0xffff, Seq: int(packet.SeqNumber),
+			ID: id, Seq: seqn,
 			Data: data,
 		},
 	}
@@ -194,30 +720,83 @@ func (c *ICMPChannel) sendPacket(packet *sg1.Packet) error {
 		return err
 	}
 
-	if _, err := c.conn.WriteTo(raw, &net.IPAddr{IP: net.ParseIP(c.address)}); err != nil {
+	if _, err := c.conn.WriteTo(raw, to); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// The listener can only send packets as replies to the requests of the peer,
+// a retransmitted packet still waiting in the outbox is not queued twice.
+func (c *ICMPChannel) queue(peer *icmpPeer, packet *sg1.Packet) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, queued := range peer.outbox {
+		if queued == packet {
+			return
+		}
+	}
+	peer.outbox = append(peer.outbox, packet)
+}
+
+func (c *ICMPChannel) send(packet *sg1.Packet) error {
+	var to net.Addr = &net.IPAddr{IP: c.ip}
+	if c.isUnprivileged() {
+		to = &net.UDPAddr{IP: c.ip}
+	}
+
+	// like ping, every request has the next sequence number
+	c.mutex.Lock()
+	c.echo_seq = (c.echo_seq + 1) & 0xffff
+	seqn := c.echo_seq
+	c.mutex.Unlock()
+
+	request_type, _ := c.echoTypes()
+	return c.sendEcho(to, request_type, c.echo_id, seqn, packet)
+}
+
 func (c *ICMPChannel) Write(b []byte) (n int, err error) {
+	sg1.Debug("Writing %d bytes to ICMP channel as chunks of %d bytes.\n", len(b), c.chunkSize())
+
+	seq, reliable := c.seq, c.reliable
+	var peer *icmpPeer
 	if c.is_client == false {
-		return 0, fmt.Errorf("icmp server can't be used for writing.")
+		if peer = c.lastPeer(); peer == nil {
+			return 0, fmt.Errorf("ICMP channel is closed.")
+		}
+		seq, reliable = peer.seq, peer.reliable
 	}
 
-	sg1.Debug("Writing %d bytes to ICMP channel as chunks of %d bytes.\n", len(b), ICMPChunkSize)
-
 	wrote := 0
-	for _, packet := range c.seq.Packets(b, ICMPChunkSize) {
+	for _, packet := range seq.Packets(b, c.chunkSize()) {
 		sg1.Debug("Sending %d bytes of encoded packet (seqn=%d).\n", packet.DataSize, packet.SeqNumber)
 
-		if err := c.sendPacket(packet); err != nil {
+		var err error
+		if reliable != nil {
+			err = reliable.Send(packet)
+		} else if peer != nil {
+			c.queue(peer, packet)
+		} else {
+			err = c.send(packet)
+		}
+
+		if err != nil {
 			sg1.Error("Error while sending ICMP packet: %s\n", err)
 		} else {
 			sg1.Debug("Wrote %d bytes.\n", packet.DataSize)
 			wrote += int(packet.DataSize)
+
+			c.mutex.Lock()
 			c.stats.TotalWrote += int(packet.DataSize)
+			c.mutex.Unlock()
+		}
+	}
+
+	if reliable != nil {
+		if err = reliable.Flush(); err != nil {
+			return wrote, err
 		}
 	}
 
@@ -227,5 +806,7 @@ func (c *ICMPChannel) Write(b []byte) (n int, err error) {
 }
 
 func (c *ICMPChannel) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.stats
 }
@@ -0,0 +1,236 @@
+package channels
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evilsocket/sg1/sg1"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestICMPChannels(t *testing.T, address string, mimic string) (*ICMPChannel, *ICMPChannel) {
+	server := NewICMPChannel()
+	server.mimic = mimic
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+	if err := server.Start(); err != nil {
+		t.Skipf("Can't open raw ICMP socket: %s", err)
+	}
+
+	client := NewICMPChannel()
+	client.mimic = mimic
+	client.poll_time = 10
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, address))
+	assert.Nil(t, client.Start())
+
+	return server, client
+}
+
+func testICMPChannels(t *testing.T, address string, mimic string) {
+	server, client := newTestICMPChannels(t, address, mimic)
+
+	testRoundTrip(t, server, client, client.chunkSize(), []string{"hello icmp"}, "hello client")
+}
+
+func TestICMPChannel(t *testing.T) {
+	testICMPChannels(t, "127.0.0.1", "none")
+}
+
+func TestICMPv6Channel(t *testing.T) {
+	testICMPChannels(t, "::1", "none")
+}
+
+func TestICMPChannelMimic(t *testing.T) {
+	for mimic := range ICMPLayouts {
+		testICMPChannels(t, "127.0.0.1", mimic)
+	}
+}
+
+func TestICMPPayloadLayouts(t *testing.T) {
+	packet := sg1.NewPacket(1, 0, 1, 4, []byte("data"))
+
+	c := NewICMPChannel()
+	c.mimic = "linux"
+	assert.Nil(t, c.Setup(OUTPUT_CHANNEL, "127.0.0.1"))
+
+	payload := c.payload(packet)
+	assert.Equal(t, 56, len(payload))
+	// the padding follows the iputils pattern
+	assert.Equal(t, byte(55), payload[55])
+
+	decoded, err := c.unpayload(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data"), decoded.Data)
+
+	c = NewICMPChannel()
+	c.mimic = "windows"
+	assert.Nil(t, c.Setup(OUTPUT_CHANNEL, "127.0.0.1"))
+
+	payload = c.payload(packet)
+	assert.Equal(t, 32, len(payload))
+	assert.True(t, bytes.HasSuffix(payload, []byte("fghi")))
+
+	// payloads must fit the MTU and the layout
+	c = NewICMPChannel()
+	c.size = 1500
+	assert.NotNil(t, c.Setup(OUTPUT_CHANNEL, "127.0.0.1"))
+
+	c = NewICMPChannel()
+	c.size = 1453
+	assert.NotNil(t, c.Setup(OUTPUT_CHANNEL, "::1"))
+
+	c = NewICMPChannel()
+	c.size = 1500
+	c.mtu = 9000
+	assert.Nil(t, c.Setup(OUTPUT_CHANNEL, "127.0.0.1"))
+
+	c = NewICMPChannel()
+	c.mimic = "linux"
+	c.size = 32
+	assert.NotNil(t, c.Setup(OUTPUT_CHANNEL, "127.0.0.1"))
+}
+
+func TestICMPChannelPeers(t *testing.T) {
+	c := NewICMPChannel()
+	assert.Nil(t, c.Setup(INPUT_CHANNEL, "127.0.0.1"))
+
+	first := &net.IPAddr{IP: net.ParseIP("10.0.0.1")}
+	other := &net.IPAddr{IP: net.ParseIP("10.0.0.2")}
+
+	// every address and id is a different peer
+	peer := c.accept(first, 1234)
+	assert.NotNil(t, peer)
+	assert.Equal(t, peer, c.accept(first, 1234))
+	assert.NotEqual(t, peer, c.accept(first, 4321))
+	last := c.accept(other, 1234)
+	assert.NotEqual(t, peer, last)
+
+	// data is only sent back to the last peer
+	_, err := c.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Empty(t, peer.outbox)
+	assert.Len(t, last.outbox, 1)
+
+	c = NewICMPChannel()
+	c.peer = "10.0.0.2"
+	c.echo_id = 4321
+	assert.Nil(t, c.Setup(INPUT_CHANNEL, "127.0.0.1"))
+
+	assert.Nil(t, c.accept(first, 4321))
+	assert.Nil(t, c.accept(other, 1234))
+	assert.NotNil(t, c.accept(other, 4321))
+}
+
+func TestICMPChannelSharedListener(t *testing.T) {
+	server, first := newTestICMPChannels(t, "127.0.0.1", "none")
+	defer server.Close()
+	defer first.Close()
+
+	second := NewICMPChannel()
+	assert.Nil(t, second.Setup(OUTPUT_CHANNEL, "127.0.0.1"))
+	assert.Nil(t, second.Start())
+	defer second.Close()
+
+	_, err := first.Write([]byte("first"))
+	assert.Nil(t, err)
+	_, err = second.Write([]byte("second"))
+	assert.Nil(t, err)
+
+	// the streams of both senders are read
+	received := readStringOfSize(t, server, len("firstsecond"))
+	assert.Contains(t, received, "first")
+	assert.Contains(t, received, "second")
+}
+
+func TestICMPChannelReliable(t *testing.T) {
+	enableReliable(t)
+	server, client := newTestICMPChannels(t, "127.0.0.1", "none")
+	defer server.Close()
+	defer client.Close()
+
+	message := strings.Repeat("hello reliable listener ", 20)
+	_, err := client.Write([]byte(message))
+	assert.Nil(t, err)
+	assert.Equal(t, message, readStringOfSize(t, server, len(message)))
+
+	// the listener waits for the ACKs of the client, which only polls when reading
+	reply := strings.Repeat("hello reliable client ", 20)
+	received := make(chan string)
+	go func() {
+		received <- readStringOfSize(t, client, len(reply))
+	}()
+
+	_, err = server.Write([]byte(reply))
+	assert.Nil(t, err)
+	assert.Equal(t, reply, <-received)
+
+	assert.Nil(t, client.CloseWrite())
+	_, err = server.Read(make([]byte, 16))
+	assert.NotNil(t, err)
+}
+
+func TestICMPChannelRetransmission(t *testing.T) {
+	enableReliable(t)
+	c := NewICMPChannel()
+	assert.Nil(t, c.Setup(INPUT_CHANNEL, "127.0.0.1"))
+	defer c.Close()
+
+	peer := c.accept(&net.IPAddr{IP: net.ParseIP("10.0.0.1")}, 1234)
+	assert.NotNil(t, peer.reliable)
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Write([]byte("hello"))
+		done <- err
+	}()
+
+	// the reply carrying the packet is lost
+	var packet *sg1.Packet
+	assert.Eventually(t, func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if len(peer.outbox) == 0 {
+			return false
+		}
+		packet = peer.outbox[0]
+		peer.outbox = peer.outbox[1:]
+		return true
+	}, time.Second, time.Millisecond)
+
+	// and queued again once its timeout expires
+	assert.Eventually(t, func() bool {
+		return c.outboxSize() == 1
+	}, time.Second, time.Millisecond)
+
+	peer.reliable.Ack(sg1.NewAckPacket(packet))
+	assert.Nil(t, <-done)
+
+	// nobody will poll the retransmitted packet
+	c.mutex.Lock()
+	peer.outbox = nil
+	c.mutex.Unlock()
+}
+
+func TestICMPChannelSmallReads(t *testing.T) {
+	server, client := newTestICMPChannels(t, "127.0.0.1", "none")
+	defer server.Close()
+	defer client.Close()
+
+	// every packet is read with a buffer smaller than its data
+	message := strings.Repeat("hello small buffer ", 10)
+	_, err := client.Write([]byte(message))
+	assert.Nil(t, err)
+
+	received := ""
+	buff := make([]byte, 3)
+	for len(received) < len(message) {
+		n, err := server.Read(buff)
+		if !assert.Nil(t, err) {
+			break
+		}
+		received += string(buff[:n])
+	}
+	assert.Equal(t, message, received)
+}
@@ -0,0 +1,144 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// KVDrop stores blobs in an HTTP key-value store, where the value of a key
+// is created with a PUT request to BASE/KEY, read with a GET and deleted with
+// a DELETE one, while a GET request to BASE/ lists the keys one per line.
+// Keys are the escaped names of the blobs.
+type KVDrop struct {
+	url string
+}
+
+func NewKVDrop(base_url string) *KVDrop {
+	return &KVDrop{
+		url: strings.TrimSuffix(base_url, "/"),
+	}
+}
+
+func (d *KVDrop) request(method string, key string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, d.url+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("%s request for '%s' failed with status %d.", method, key, res.StatusCode)
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+func (d *KVDrop) Put(name string, data []byte) error {
+	_, err := d.request("PUT", url.PathEscape(name), data)
+	return err
+}
+
+func (d *KVDrop) List() ([]DeadDropBlob, error) {
+	body, err := d.request("GET", "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make([]DeadDropBlob, 0)
+	for _, key := range strings.Split(string(body), "\n") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		} else if name, err := url.PathUnescape(key); err == nil {
+			blobs = append(blobs, DeadDropBlob{Key: key, Name: name})
+		}
+	}
+
+	return blobs, nil
+}
+
+func (d *KVDrop) Get(key string) ([]byte, error) {
+	return d.request("GET", key, nil)
+}
+
+func (d *KVDrop) Delete(key string) error {
+	_, err := d.request("DELETE", key, nil)
+	return err
+}
+
+type KVChannel struct {
+	*DeadDropChannel
+}
+
+func NewKVChannel() *KVChannel {
+	return &KVChannel{
+		DeadDropChannel: NewDeadDropChannel("kv", DeadDropDefaultStream, DeadDropChunkSize),
+	}
+}
+
+func (c *KVChannel) Copy() interface{} {
+	cp := NewKVChannel()
+	cp.preserve = c.preserve
+	cp.poll_time = c.poll_time
+	return cp
+}
+
+func (c *KVChannel) Name() string {
+	return "kv"
+}
+
+func (c *KVChannel) Register() error {
+	flag.BoolVar(&c.preserve, "kv-preserve", c.preserve, "Do not delete keys after reading them.")
+	flag.IntVar(&c.poll_time, "kv-poll-time", c.poll_time, "Number of milliseconds to wait between one listing of the keys and another.")
+	return nil
+}
+
+func (c *KVChannel) Description() string {
+	return "Read and write data as keys of an HTTP key-value store ( see -kv-server )."
+}
+
+func (c *KVChannel) Setup(direction Direction, args string) error {
+	base_url := c.parseStream(args)
+	if u, err := url.Parse(base_url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Usage: kv:http(s)://host:port/path(#stream_name)?")
+	}
+
+	c.setup(direction, NewKVDrop(base_url))
+
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KVServer is an in-memory HTTP key-value store for the kv channel. Every
+// path is a separate bucket of keys, so that several pairs of channels can
+// share the same server.
+type KVServer struct {
+	buckets map[string]map[string][]byte
+	mutex   *sync.Mutex
+}
+
+func NewKVServer() *KVServer {
+	return &KVServer{
+		buckets: make(map[string]map[string][]byte),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (s *KVServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	escaped := r.URL.EscapedPath()
+	idx := strings.LastIndex(escaped, "/")
+	bucket, key := escaped[:idx+1], escaped[idx+1:]
+
+	sg1.Debug("KV server got %s request for key '%s' of bucket '%s' from %s.\n", r.Method, key, bucket, r.RemoteAddr)
+
+	if key == "" {
+		if r.Method == "GET" {
+			s.list(w, bucket)
+		} else {
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		s.put(w, r, bucket, key)
+	case "GET":
+		s.get(w, bucket, key)
+	case "DELETE":
+		s.delete(w, bucket, key)
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *KVServer) list(w http.ResponseWriter, bucket string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := make([]string, 0)
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\n", key)
+	}
+}
+
+func (s *KVServer) put(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Could not read body.", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+	s.buckets[bucket][key] = data
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *KVServer) get(w http.ResponseWriter, bucket string, key string) {
+	s.mutex.Lock()
+	data, found := s.buckets[bucket][key]
+	s.mutex.Unlock()
+
+	if found == false {
+		http.Error(w, "Key not found.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+func (s *KVServer) delete(w http.ResponseWriter, bucket string, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, found := s.buckets[bucket][key]; found == false {
+		http.Error(w, "Key not found.", http.StatusNotFound)
+		return
+	}
+
+	delete(s.buckets[bucket], key)
+	if len(s.buckets[bucket]) == 0 {
+		delete(s.buckets, bucket)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
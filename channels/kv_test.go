@@ -0,0 +1,58 @@
+package channels
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVDrop(t *testing.T) {
+	server := httptest.NewServer(NewKVServer())
+	defer server.Close()
+
+	drop := NewKVDrop(server.URL + "/bucket/")
+	other := NewKVDrop(server.URL + "/other")
+
+	name := "SG1 some/stream 0x01"
+	assert.Nil(t, drop.Put(name, []byte("hello")))
+
+	// buckets are separate
+	blobs, err := other.List()
+	assert.Nil(t, err)
+	assert.Empty(t, blobs)
+
+	blobs, err = drop.List()
+	assert.Nil(t, err)
+	if assert.Len(t, blobs, 1) {
+		assert.Equal(t, name, blobs[0].Name)
+
+		data, err := drop.Get(blobs[0].Key)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data))
+
+		assert.Nil(t, drop.Delete(blobs[0].Key))
+		assert.NotNil(t, drop.Delete(blobs[0].Key))
+		_, err = drop.Get(blobs[0].Key)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestKVChannel(t *testing.T) {
+	api := httptest.NewServer(NewKVServer())
+	defer api.Close()
+
+	server := NewKVChannel()
+	server.poll_time = 10
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, api.URL+"/sg1#TEST"))
+	assert.Nil(t, server.Start())
+
+	client := NewKVChannel()
+	client.poll_time = 10
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, api.URL+"/sg1#TEST"))
+	assert.Nil(t, client.Start())
+
+	testRoundTrip(t, server, client, client.chunk_size, []string{"hello kv"}, "hello client")
+
+	assert.NotNil(t, NewKVChannel().Setup(INPUT_CHANNEL, "127.0.0.1:8080"))
+}
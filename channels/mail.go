@@ -0,0 +1,479 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MailPollTime = 5000
+	MailTimeout  = 30 * time.Second
+	// length of the lines of base64 encoded bodies
+	MailLineSize = 76
+)
+
+// MailDrop stores blobs as emails sent to a mailbox through an SMTP server
+// and read back from it with POP3. Since a POP3 server only removes a message
+// when the session deleting it ends successfully and that message is not
+// listed anymore by other sessions, only one reader can claim each blob.
+type MailDrop struct {
+	user     string
+	password string
+	address  string
+	smtp     string
+	pop3     string
+	tls      bool
+	insecure bool
+	// subjects of the messages already listed, by unique id
+	subjects map[string]string
+	mutex    *sync.Mutex
+}
+
+func NewMailDrop(user, password, address, smtp_address, pop3_address string, use_tls bool, insecure bool) *MailDrop {
+	return &MailDrop{
+		user:     user,
+		password: password,
+		address:  address,
+		smtp:     smtp_address,
+		pop3:     pop3_address,
+		tls:      use_tls,
+		insecure: insecure,
+		subjects: make(map[string]string),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (d *MailDrop) tlsConfig(host string) *tls.Config {
+	return &tls.Config{ServerName: host, InsecureSkipVerify: d.insecure}
+}
+
+func (d *MailDrop) dial(address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: MailTimeout}
+	if d.tls {
+		host, _, _ := net.SplitHostPort(address)
+		return tls.DialWithDialer(dialer, "tcp", address, d.tlsConfig(host))
+	}
+	return dialer.Dial("tcp", address)
+}
+
+func (d *MailDrop) Put(name string, data []byte) error {
+	conn, err := d.dial(d.smtp)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(MailTimeout))
+
+	host, _, _ := net.SplitHostPort(d.smtp)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && d.tls == false {
+		if err = client.StartTLS(d.tlsConfig(host)); err != nil {
+			return err
+		}
+	}
+
+	if ok, _ := client.Extension("AUTH"); ok && d.password != "" {
+		if err = client.Auth(smtp.PlainAuth("", d.user, d.password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(d.address); err != nil {
+		return err
+	} else if err = client.Rcpt(d.address); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "From: <%s>\r\n", d.address)
+	fmt.Fprintf(w, "To: <%s>\r\n", d.address)
+	fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", name))
+	fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(w, "Content-Type: application/octet-stream\r\n")
+	fmt.Fprintf(w, "Content-Transfer-Encoding: base64\r\n\r\n")
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > MailLineSize {
+		fmt.Fprintf(w, "%s\r\n", encoded[:MailLineSize])
+		encoded = encoded[MailLineSize:]
+	}
+	fmt.Fprintf(w, "%s\r\n", encoded)
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+type pop3Session struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// Open an authenticated POP3 session.
+func (d *MailDrop) session() (*pop3Session, error) {
+	conn, err := d.dial(d.pop3)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(MailTimeout))
+
+	s := &pop3Session{
+		conn: conn,
+		text: textproto.NewConn(conn),
+	}
+
+	if _, err = s.response(); err != nil {
+		s.Close()
+		return nil, err
+	} else if d.tls == false {
+		host, _, _ := net.SplitHostPort(d.pop3)
+		if err = s.startTLS(d.pop3, d.tlsConfig(host)); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	if _, err = s.cmd("USER %s", d.user); err != nil {
+		s.Close()
+		return nil, err
+	} else if _, err = s.cmd("PASS %s", d.password); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Upgrade the session to TLS if the server supports STLS, otherwise refuse
+// to send the credentials in cleartext unless the server is local.
+func (s *pop3Session) startTLS(address string, config *tls.Config) error {
+	host, _, _ := net.SplitHostPort(address)
+
+	if s.hasCapability("STLS") {
+		if _, err := s.cmd("STLS"); err != nil {
+			return err
+		}
+
+		conn := tls.Client(s.conn, config)
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+
+		s.conn = conn
+		s.text = textproto.NewConn(conn)
+		return nil
+	} else if isLocalhost(host) == false {
+		return fmt.Errorf("The POP3 server %s does not support STLS, use -mail-tls to connect to it over TLS.", address)
+	}
+
+	return nil
+}
+
+// Servers which don't support CAPA have no capabilities as far as we know.
+func (s *pop3Session) hasCapability(name string) bool {
+	raw, err := s.lines("CAPA")
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && strings.EqualFold(fields[0], name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isLocalhost(host string) bool {
+	if host == "localhost" {
+		return true
+	} else if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return false
+}
+
+func (s *pop3Session) response() (string, error) {
+	line, err := s.text.ReadLine()
+	if err != nil {
+		return "", err
+	} else if strings.HasPrefix(line, "+OK") == false {
+		return "", fmt.Errorf("POP3 error: %s", line)
+	}
+	return strings.TrimSpace(line[3:]), nil
+}
+
+func (s *pop3Session) cmd(format string, args ...interface{}) (string, error) {
+	if err := s.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return s.response()
+}
+
+// Send a command with a multi-line response.
+func (s *pop3Session) lines(format string, args ...interface{}) ([]byte, error) {
+	if _, err := s.cmd(format, args...); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(s.text.DotReader())
+}
+
+// Return the message numbers by unique id.
+func (s *pop3Session) uids() (map[string]string, error) {
+	raw, err := s.lines("UIDL")
+	if err != nil {
+		return nil, err
+	}
+
+	uids := make(map[string]string)
+	for _, line := range strings.Split(string(raw), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			uids[fields[1]] = fields[0]
+		}
+	}
+
+	return uids, nil
+}
+
+func (s *pop3Session) find(uid string) (string, error) {
+	uids, err := s.uids()
+	if err != nil {
+		return "", err
+	} else if n, found := uids[uid]; found {
+		return n, nil
+	}
+	return "", fmt.Errorf("Message %s not found.", uid)
+}
+
+// End the session, committing deletions.
+func (s *pop3Session) Quit() error {
+	_, err := s.cmd("QUIT")
+	s.Close()
+	return err
+}
+
+func (s *pop3Session) Close() error {
+	return s.text.Close()
+}
+
+func (d *MailDrop) List() ([]DeadDropBlob, error) {
+	s, err := d.session()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Quit()
+
+	uids, err := s.uids()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	decoder := &mime.WordDecoder{}
+	subjects := make(map[string]string)
+	blobs := make([]DeadDropBlob, 0)
+	for uid, n := range uids {
+		subject, found := d.subjects[uid]
+		if found == false {
+			// only fetch the headers of messages we haven't seen yet
+			raw, err := s.lines("TOP %s 0", n)
+			if err != nil {
+				return nil, err
+			}
+
+			msg, err := mail.ReadMessage(strings.NewReader(string(raw) + "\n"))
+			if err != nil {
+				sg1.Debug("Skipping message %s: %s\n", uid, err)
+			} else if subject, err = decoder.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+				sg1.Debug("Skipping message %s: %s\n", uid, err)
+			}
+		}
+
+		subjects[uid] = subject
+		blobs = append(blobs, DeadDropBlob{Key: uid, Name: subject})
+	}
+	d.subjects = subjects
+
+	return blobs, nil
+}
+
+func (d *MailDrop) Get(key string) ([]byte, error) {
+	s, err := d.session()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Quit()
+
+	n, err := s.find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := s.lines("RETR %s", n)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		return nil, err
+	} else if encoding := msg.Header.Get("Content-Transfer-Encoding"); strings.EqualFold(encoding, "base64") == false {
+		return nil, fmt.Errorf("Unexpected transfer encoding '%s' of message %s.", encoding, key)
+	}
+
+	return io.ReadAll(base64.NewDecoder(base64.StdEncoding, msg.Body))
+}
+
+func (d *MailDrop) Delete(key string) error {
+	s, err := d.session()
+	if err != nil {
+		return err
+	}
+
+	n, err := s.find(key)
+	if err != nil {
+		s.Quit()
+		return err
+	} else if _, err = s.cmd("DELE %s", n); err != nil {
+		s.Quit()
+		return err
+	}
+
+	return s.Quit()
+}
+
+type MailChannel struct {
+	*DeadDropChannel
+	address  string
+	use_tls  bool
+	insecure bool
+}
+
+func NewMailChannel() *MailChannel {
+	c := &MailChannel{
+		DeadDropChannel: NewDeadDropChannel("mail", DeadDropDefaultStream, DeadDropChunkSize),
+		address:         "",
+		use_tls:         false,
+		insecure:        false,
+	}
+	c.poll_time = MailPollTime
+	return c
+}
+
+func (c *MailChannel) Copy() interface{} {
+	cp := NewMailChannel()
+	cp.address = c.address
+	cp.use_tls = c.use_tls
+	cp.insecure = c.insecure
+	cp.preserve = c.preserve
+	cp.poll_time = c.poll_time
+	return cp
+}
+
+func (c *MailChannel) Name() string {
+	return "mail"
+}
+
+func (c *MailChannel) Register() error {
+	flag.StringVar(&c.address, "mail-address", c.address, "Address of the mailbox to exchange emails with, by default the user name.")
+	flag.BoolVar(&c.use_tls, "mail-tls", c.use_tls, "Connect to the SMTP and POP3 servers over TLS instead of using STARTTLS when available.")
+	flag.BoolVar(&c.insecure, "mail-insecure", c.insecure, "Do not verify the certificates of the SMTP and POP3 servers, needed to reach the self signed -mail-server stand-in.")
+	flag.BoolVar(&c.preserve, "mail-preserve", c.preserve, "Do not delete emails after reading them.")
+	flag.IntVar(&c.poll_time, "mail-poll-time", c.poll_time, "Number of milliseconds to wait between one check of the mailbox and another.")
+	return nil
+}
+
+func (c *MailChannel) Description() string {
+	return "Send data as emails with SMTP and read them back with POP3, IMAP is not supported."
+}
+
+func (c *MailChannel) Setup(direction Direction, args string) error {
+	usage := fmt.Errorf("Usage: mail:USER:PASSWORD@SMTP-HOST:PORT/POP3-HOST:PORT(#stream_name)?")
+
+	// the password might contain any character, while hosts and stream names
+	// can't have @
+	idx := strings.LastIndex(args, "@")
+	if idx == -1 {
+		return usage
+	}
+
+	credentials, servers := args[:idx], c.parseStream(args[idx+1:])
+	user, password := credentials, ""
+	if i := strings.Index(credentials, ":"); i != -1 {
+		user, password = credentials[:i], credentials[i+1:]
+	}
+
+	parts := strings.Split(servers, "/")
+	if user == "" || len(parts) != 2 {
+		return usage
+	}
+
+	for _, address := range parts {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return usage
+		}
+	}
+
+	if c.address == "" {
+		c.address = user
+	}
+
+	c.setup(direction, NewMailDrop(user, password, c.address, parts[0], parts[1], c.use_tls, c.insecure))
+
+	return nil
+}
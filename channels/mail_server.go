@@ -0,0 +1,402 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type storedMail struct {
+	uid  string
+	data []byte
+}
+
+type mailbox struct {
+	messages []*storedMail
+	locked   bool
+}
+
+// MailServer is a local stand-in for a mail provider, with an SMTP server
+// delivering every message to the mailbox of its recipients and a POP3 server
+// where any password is accepted for any mailbox, keeping everything in
+// memory so that the mail channel can be used and tested without one. The
+// POP3 server supports STLS with a self signed certificate.
+type MailServer struct {
+	mailboxes map[string]*mailbox
+	next_uid  int
+	listeners []net.Listener
+	config    *tls.Config
+	mutex     *sync.Mutex
+}
+
+func NewMailServer() *MailServer {
+	return &MailServer{
+		mailboxes: make(map[string]*mailbox),
+		next_uid:  1,
+		listeners: make([]net.Listener, 0),
+		config:    nil,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Start the SMTP and POP3 servers on the given addresses.
+func (s *MailServer) Start(smtp_address string, pop3_address string) (err error) {
+	if s.config, err = getCertificateConfig("", ""); err != nil {
+		return err
+	}
+
+	for _, server := range []struct {
+		address string
+		handler func(net.Conn)
+	}{
+		{smtp_address, s.smtp},
+		{pop3_address, s.pop3},
+	} {
+		listener, err := net.Listen("tcp", server.address)
+		if err != nil {
+			s.Close()
+			return err
+		}
+
+		s.mutex.Lock()
+		s.listeners = append(s.listeners, listener)
+		s.mutex.Unlock()
+
+		go s.accept(listener, server.handler)
+	}
+
+	return nil
+}
+
+// Return the addresses the SMTP and POP3 servers are listening on.
+func (s *MailServer) Addresses() (string, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listeners[0].Addr().String(), s.listeners[1].Addr().String()
+}
+
+func (s *MailServer) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = s.listeners[:0]
+
+	return nil
+}
+
+func (s *MailServer) accept(listener net.Listener, handler func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(MailTimeout))
+			handler(conn)
+		}()
+	}
+}
+
+func (s *MailServer) deliver(to []string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, address := range to {
+		box := s.mailboxes[address]
+		if box == nil {
+			box = &mailbox{}
+			s.mailboxes[address] = box
+		}
+
+		box.messages = append(box.messages, &storedMail{
+			uid:  strconv.Itoa(s.next_uid),
+			data: data,
+		})
+		s.next_uid++
+	}
+}
+
+// Parse the address of a MAIL FROM or RCPT TO command.
+func mailCommandAddress(arg string) string {
+	if idx := strings.Index(arg, ":"); idx != -1 {
+		arg = arg[idx+1:]
+	}
+	return strings.ToLower(strings.Trim(strings.TrimSpace(arg), "<>"))
+}
+
+func (s *MailServer) smtp(conn net.Conn) {
+	sg1.Debug("SMTP connection from %s.\n", conn.RemoteAddr())
+
+	text := textproto.NewConn(conn)
+	from := ""
+	to := make([]string, 0)
+
+	text.PrintfLine("220 sg1 ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg := line, ""
+		if idx := strings.Index(line, " "); idx != -1 {
+			cmd, arg = line[:idx], line[idx+1:]
+		}
+
+		switch strings.ToUpper(cmd) {
+		case "EHLO":
+			text.PrintfLine("250-sg1")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "HELO":
+			text.PrintfLine("250 sg1")
+		case "AUTH":
+			text.PrintfLine("235 Authentication successful")
+		case "MAIL":
+			from, to = mailCommandAddress(arg), to[:0]
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if from == "" {
+				text.PrintfLine("503 Need MAIL command")
+			} else {
+				to = append(to, mailCommandAddress(arg))
+				text.PrintfLine("250 OK")
+			}
+		case "DATA":
+			if len(to) == 0 {
+				text.PrintfLine("503 Need RCPT command")
+				continue
+			}
+
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+
+			s.deliver(to, data)
+			from, to = "", to[:0]
+			text.PrintfLine("250 OK")
+		case "RSET":
+			from, to = "", to[:0]
+			text.PrintfLine("250 OK")
+		case "NOOP":
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// Return the message with the given number of a POP3 command, counting from 1.
+func popMessage(messages []*storedMail, deleted map[*storedMail]bool, arg string) *storedMail {
+	n, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(arg, " ", 2)[0]))
+	if err != nil || n < 1 || n > len(messages) || deleted[messages[n-1]] {
+		return nil
+	}
+	return messages[n-1]
+}
+
+func (s *MailServer) pop3(conn net.Conn) {
+	sg1.Debug("POP3 connection from %s.\n", conn.RemoteAddr())
+
+	text := textproto.NewConn(conn)
+	secure := false
+	user := ""
+	var box *mailbox
+	var messages []*storedMail
+	deleted := make(map[*storedMail]bool)
+
+	// release the mailbox if the session doesn't end with a QUIT
+	defer func() {
+		if box != nil {
+			s.mutex.Lock()
+			box.locked = false
+			s.mutex.Unlock()
+		}
+	}()
+
+	text.PrintfLine("+OK sg1 POP3 server ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg := line, ""
+		if idx := strings.Index(line, " "); idx != -1 {
+			cmd, arg = line[:idx], line[idx+1:]
+		}
+		cmd = strings.ToUpper(cmd)
+
+		if box == nil {
+			switch cmd {
+			case "USER":
+				user = strings.ToLower(strings.TrimSpace(arg))
+				text.PrintfLine("+OK")
+			case "PASS":
+				if user == "" {
+					text.PrintfLine("-ERR USER first")
+					continue
+				}
+
+				s.mutex.Lock()
+				if s.mailboxes[user] == nil {
+					s.mailboxes[user] = &mailbox{}
+				}
+				if s.mailboxes[user].locked {
+					s.mutex.Unlock()
+					text.PrintfLine("-ERR maildrop already locked")
+					continue
+				}
+				box = s.mailboxes[user]
+				box.locked = true
+				messages = append([]*storedMail{}, box.messages...)
+				s.mutex.Unlock()
+
+				text.PrintfLine("+OK maildrop locked and ready")
+			case "CAPA":
+				text.PrintfLine("+OK")
+				w := text.DotWriter()
+				fmt.Fprintf(w, "USER\r\nUIDL\r\nTOP\r\n")
+				if secure == false {
+					fmt.Fprintf(w, "STLS\r\n")
+				}
+				w.Close()
+			case "STLS":
+				if secure {
+					text.PrintfLine("-ERR already using TLS")
+					continue
+				}
+
+				text.PrintfLine("+OK begin TLS negotiation")
+				tls_conn := tls.Server(conn, s.config)
+				if err := tls_conn.Handshake(); err != nil {
+					sg1.Debug("POP3 TLS handshake with %s failed: %s\n", conn.RemoteAddr(), err)
+					return
+				}
+				text = textproto.NewConn(tls_conn)
+				secure = true
+			case "QUIT":
+				text.PrintfLine("+OK")
+				return
+			default:
+				text.PrintfLine("-ERR authenticate first")
+			}
+			continue
+		}
+
+		switch cmd {
+		case "STAT":
+			count, size := 0, 0
+			for _, msg := range messages {
+				if deleted[msg] == false {
+					count++
+					size += len(msg.data)
+				}
+			}
+			text.PrintfLine("+OK %d %d", count, size)
+		case "LIST", "UIDL":
+			text.PrintfLine("+OK")
+			w := text.DotWriter()
+			for i, msg := range messages {
+				if deleted[msg] {
+					continue
+				} else if cmd == "LIST" {
+					fmt.Fprintf(w, "%d %d\r\n", i+1, len(msg.data))
+				} else {
+					fmt.Fprintf(w, "%d %s\r\n", i+1, msg.uid)
+				}
+			}
+			w.Close()
+		case "RETR", "TOP":
+			msg := popMessage(messages, deleted, arg)
+			if msg == nil {
+				text.PrintfLine("-ERR no such message")
+				continue
+			}
+
+			data := msg.data
+			if cmd == "TOP" {
+				// only the headers, the number of body lines is ignored
+				if idx := strings.Index(string(data), "\n\n"); idx != -1 {
+					data = data[:idx+1]
+				}
+			}
+
+			text.PrintfLine("+OK")
+			w := text.DotWriter()
+			w.Write(data)
+			w.Close()
+		case "DELE":
+			msg := popMessage(messages, deleted, arg)
+			if msg == nil {
+				text.PrintfLine("-ERR no such message")
+				continue
+			}
+
+			deleted[msg] = true
+			text.PrintfLine("+OK message deleted")
+		case "RSET":
+			deleted = make(map[*storedMail]bool)
+			text.PrintfLine("+OK")
+		case "NOOP":
+			text.PrintfLine("+OK")
+		case "QUIT":
+			s.mutex.Lock()
+			kept := make([]*storedMail, 0)
+			for _, msg := range box.messages {
+				if deleted[msg] == false {
+					kept = append(kept, msg)
+				}
+			}
+			box.messages = kept
+			s.mutex.Unlock()
+
+			text.PrintfLine("+OK bye")
+			return
+		default:
+			text.PrintfLine("-ERR unknown command")
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package channels
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMailServer(t *testing.T) (*MailServer, string) {
+	server := NewMailServer()
+	assert.Nil(t, server.Start("127.0.0.1:0", "127.0.0.1:0"))
+
+	smtp_address, pop3_address := server.Addresses()
+	return server, smtp_address + "/" + pop3_address
+}
+
+func TestMailDrop(t *testing.T) {
+	server, _ := newTestMailServer(t)
+	defer server.Close()
+
+	smtp_address, pop3_address := server.Addresses()
+	// the certificate of the stand-in is self signed
+	drop := NewMailDrop("sg1@example.com", "secret", "sg1@example.com", smtp_address, pop3_address, false, true)
+	other := NewMailDrop("other@example.com", "secret", "other@example.com", smtp_address, pop3_address, false, true)
+
+	name := "SG1 söme/stream 0x01"
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	assert.Nil(t, drop.Put(name, data))
+
+	// messages are only delivered to their mailbox
+	blobs, err := other.List()
+	assert.Nil(t, err)
+	assert.Empty(t, blobs)
+
+	blobs, err = drop.List()
+	assert.Nil(t, err)
+	if assert.Len(t, blobs, 1) {
+		assert.Equal(t, name, blobs[0].Name)
+
+		got, err := drop.Get(blobs[0].Key)
+		assert.Nil(t, err)
+		assert.Equal(t, data, got)
+
+		assert.Nil(t, drop.Delete(blobs[0].Key))
+		// a blob can only be claimed once
+		assert.NotNil(t, drop.Delete(blobs[0].Key))
+	}
+
+	blobs, err = drop.List()
+	assert.Nil(t, err)
+	assert.Empty(t, blobs)
+}
+
+func TestMailChannel(t *testing.T) {
+	mail, servers := newTestMailServer(t)
+	defer mail.Close()
+
+	args := "sg1@example.com:p@ss#word@" + servers + "#TEST"
+
+	server := NewMailChannel()
+	server.insecure = true
+	server.poll_time = 10
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, args))
+	assert.Nil(t, server.Start())
+
+	client := NewMailChannel()
+	client.insecure = true
+	client.poll_time = 10
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, args))
+	assert.Nil(t, client.Start())
+
+	testRoundTrip(t, server, client, client.chunk_size, []string{"first", "second", "third"}, "hello client")
+
+	// the stream is only parsed after the credentials
+	drop := client.drop.(*MailDrop)
+	assert.Equal(t, "sg1@example.com", drop.user)
+	assert.Equal(t, "p@ss#word", drop.password)
+	assert.Equal(t, "TEST", client.stream)
+
+	assert.NotNil(t, NewMailChannel().Setup(INPUT_CHANNEL, "sg1@example.com"))
+	assert.NotNil(t, NewMailChannel().Setup(INPUT_CHANNEL, "sg1:pass@127.0.0.1:25"))
+}
+
+func TestMailDropSTLS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	// a server supporting STLS, which hangs up instead of the TLS handshake
+	received := make(chan string, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("+OK ready\r\n"))
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(received)
+				return
+			}
+
+			line = strings.TrimSpace(line)
+			received <- line
+			if line == "CAPA" {
+				conn.Write([]byte("+OK\r\nUSER\r\nSTLS\r\n.\r\n"))
+			} else if line == "STLS" {
+				conn.Write([]byte("+OK begin TLS\r\n"))
+				close(received)
+				return
+			}
+		}
+	}()
+
+	drop := NewMailDrop("sg1@example.com", "secret", "sg1@example.com", "", listener.Addr().String(), false, false)
+	_, err = drop.List()
+	assert.NotNil(t, err)
+
+	// the credentials are never sent in cleartext
+	commands := []string{}
+	for line := range received {
+		commands = append(commands, line)
+	}
+	assert.Equal(t, []string{"CAPA", "STLS"}, commands)
+}
+
+func TestMailServerSTLS(t *testing.T) {
+	server, _ := newTestMailServer(t)
+	defer server.Close()
+
+	smtp_address, pop3_address := server.Addresses()
+
+	drop := NewMailDrop("sg1@example.com", "secret", "sg1@example.com", smtp_address, pop3_address, false, true)
+	session, err := drop.session()
+	if assert.Nil(t, err) {
+		_, is_tls := session.conn.(*tls.Conn)
+		assert.True(t, is_tls)
+		assert.Nil(t, session.Quit())
+	}
+
+	// the self signed certificate is only accepted with -mail-insecure
+	drop = NewMailDrop("sg1@example.com", "secret", "sg1@example.com", smtp_address, pop3_address, false, false)
+	_, err = drop.List()
+	assert.NotNil(t, err)
+}
+
+func TestIsLocalhost(t *testing.T) {
+	assert.True(t, isLocalhost("localhost"))
+	assert.True(t, isLocalhost("127.0.0.1"))
+	assert.True(t, isLocalhost("::1"))
+	assert.False(t, isLocalhost("pop.example.com"))
+	assert.False(t, isLocalhost("192.168.1.2"))
+}
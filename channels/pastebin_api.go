@@ -28,12 +28,15 @@ package channels
 
 import (
 	"bytes"
+	"encoding/xml"
 	"fmt"
 	"github.com/evilsocket/sg1/sg1"
 	"net/http"
 	"net/url"
-	"regexp"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
@@ -48,11 +51,19 @@ const (
 	Public   = "0"
 	Unlisted = "1"
 	Private  = "2"
+
+	PastebinDefaultURL = "https://pastebin.com/api/"
+	// the maximum number of pastes the list API returns at once
+	PastebinPageSize = 1000
+	// pastebin answers with a 200 status code and this prefix on errors
+	PastebinErrorPrefix = "Bad API request"
 )
 
-type XmlPaste struct {
-	key   string
-	title string
+type PasteInfo struct {
+	Key   string
+	Title string
+	// unix timestamp of the creation of the paste
+	Date int64
 }
 
 type Paste struct {
@@ -62,13 +73,33 @@ type Paste struct {
 	ExpireDate string
 }
 
+// PasteService is a paste site the pastebin channel can exchange data with,
+// either pastebin.com, a service with a compatible API or any other one.
+type PasteService interface {
+	// List the pastes of the account.
+	List() ([]PasteInfo, error)
+	// Create a new paste and return its key.
+	Create(paste Paste) (string, error)
+	// Return the text of a paste.
+	Show(key string) (string, error)
+	Delete(key string) error
+}
+
 type PastebinAPI struct {
+	BaseURL string
 	ApiKey  string
 	UserKey string
+	// warn only once if the service can't page through the pastes
+	truncated sync.Once
 }
 
-func NewPastebinAPI(ApiKey, UserKey string) *PastebinAPI {
+func NewPastebinAPI(BaseURL, ApiKey, UserKey string) *PastebinAPI {
+	if strings.HasSuffix(BaseURL, "/") == false {
+		BaseURL += "/"
+	}
+
 	return &PastebinAPI{
+		BaseURL: BaseURL,
 		ApiKey:  ApiKey,
 		UserKey: UserKey,
 	}
@@ -80,7 +111,7 @@ func (api *PastebinAPI) Request(page string, values url.Values) (body string, er
 
 	sg1.Debug("PastebinAPI.Request( %s, %s )\n", page, values)
 
-	response, err := http.PostForm("https://pastebin.com/api/"+page, values)
+	response, err := http.PostForm(api.BaseURL+page, values)
 	if err != nil {
 		return "", err
 	}
@@ -97,10 +128,15 @@ func (api *PastebinAPI) Request(page string, values url.Values) (body string, er
 		return "", err
 	}
 
-	return buf.String(), nil
+	body = buf.String()
+	if strings.HasPrefix(body, PastebinErrorPrefix) {
+		return "", fmt.Errorf("%s", body)
+	}
+
+	return body, nil
 }
 
-func (api *PastebinAPI) GetPaste(key string) (body string, err error) {
+func (api *PastebinAPI) Show(key string) (body string, err error) {
 	values := url.Values{}
 	values.Set("api_paste_key", key)
 	values.Set("api_option", "show_paste")
@@ -108,54 +144,91 @@ func (api *PastebinAPI) GetPaste(key string) (body string, err error) {
 	return api.Request("api_raw.php", values)
 }
 
-func (api *PastebinAPI) parseXmlPastes(body string) []XmlPaste {
-	keyParser := regexp.MustCompile("^<paste_key>(.+)</paste_key>$")
-	titleParser := regexp.MustCompile("^<paste_title>SG1 (.+) (0x[a-fA-F0-9]+)</paste_title>$")
-	pastes := make([]XmlPaste, 0)
-	lines := strings.Split(body, "\n")
-	paste := XmlPaste{}
-
-	for _, line := range lines {
-		line = strings.Trim(line, " \n\r\t")
-		// skip empty lines
-		if line == "" {
-			continue
-		} else if line == "<paste>" {
-			paste = XmlPaste{}
-		} else if line == "</paste>" {
-			pastes = append(pastes, paste)
-		} else if m := keyParser.FindStringSubmatch(line); len(m) == 2 {
-			paste.key = m[1]
-		} else if m := titleParser.FindStringSubmatch(line); len(m) == 3 {
-			paste.title = m[1] + " " + m[2]
-		}
+type xmlPaste struct {
+	Key   string `xml:"paste_key"`
+	Date  int64  `xml:"paste_date"`
+	Title string `xml:"paste_title"`
+}
+
+// The list API returns a sequence of <paste> elements without a root one.
+type xmlPasteList struct {
+	Pastes []xmlPaste `xml:"paste"`
+}
+
+func (api *PastebinAPI) parseXmlPastes(body string) ([]PasteInfo, error) {
+	list := xmlPasteList{}
+	if err := xml.Unmarshal([]byte("<pastes>"+body+"</pastes>"), &list); err != nil {
+		return nil, fmt.Errorf("Could not parse list of pastes: %s", err)
+	}
+
+	pastes := make([]PasteInfo, 0)
+	for _, paste := range list.Pastes {
+		pastes = append(pastes, PasteInfo{
+			Key:   paste.Key,
+			Title: paste.Title,
+			Date:  paste.Date,
+		})
 	}
 
-	return pastes
+	return pastes, nil
 }
 
-func (api *PastebinAPI) GetPastes() (pastes []XmlPaste, err error) {
-	values := url.Values{}
-	values.Set("api_option", "list")
-	values.Set("api_results_limit", "1000")
+// List every paste of the account, a page at a time since the service lists
+// the newest ones first. Services which ignore api_results_offset, like
+// pastebin.com, return the same page again, in which case only the newest
+// PastebinPageSize pastes can be listed.
+func (api *PastebinAPI) List() (pastes []PasteInfo, err error) {
+	pastes = make([]PasteInfo, 0)
+	seen := make(map[string]bool)
+
+	for offset := 0; ; offset += PastebinPageSize {
+		values := url.Values{}
+		values.Set("api_option", "list")
+		values.Set("api_results_limit", strconv.Itoa(PastebinPageSize))
+		values.Set("api_results_offset", strconv.Itoa(offset))
+
+		body, err := api.Request("api_post.php", values)
+		if err != nil {
+			return nil, err
+		}
 
-	body, err := api.Request("api_post.php", values)
-	if err != nil {
-		return nil, err
+		page, err := api.parseXmlPastes(body)
+		if err != nil {
+			return nil, err
+		}
+
+		added := 0
+		for _, paste := range page {
+			if seen[paste.Key] == false {
+				seen[paste.Key] = true
+				pastes = append(pastes, paste)
+				added++
+			}
+		}
+
+		if len(page) < PastebinPageSize {
+			break
+		} else if added == 0 {
+			api.truncated.Do(func() {
+				sg1.Warning("The paste service can't page through the pastes, only the newest %d can be read until they are deleted.\n", PastebinPageSize)
+			})
+			break
+		}
 	}
 
-	return api.parseXmlPastes(body), nil
+	return pastes, nil
 }
 
-func (api *PastebinAPI) DeletePaste(paste XmlPaste) (resp string, err error) {
+func (api *PastebinAPI) Delete(key string) error {
 	values := url.Values{}
-	values.Set("api_paste_key", paste.key)
+	values.Set("api_paste_key", key)
 	values.Set("api_option", "delete")
 
-	return api.Request("api_post.php", values)
+	_, err := api.Request("api_post.php", values)
+	return err
 }
 
-func (api *PastebinAPI) CreatePaste(paste Paste) (resp string, err error) {
+func (api *PastebinAPI) Create(paste Paste) (key string, err error) {
 	values := url.Values{}
 	values.Set("api_option", "paste")
 	values.Set("api_paste_code", paste.Text)
@@ -163,5 +236,15 @@ func (api *PastebinAPI) CreatePaste(paste Paste) (resp string, err error) {
 	values.Set("api_paste_private", paste.Privacy)
 	values.Set("api_paste_expire_date", paste.ExpireDate)
 
-	return api.Request("api_post.php", values)
+	resp, err := api.Request("api_post.php", values)
+	if err != nil {
+		return "", err
+	} else if strings.Contains(resp, "://") == false {
+		return "", fmt.Errorf("Could not create paste: %s", resp)
+	}
+
+	sg1.Debug("Created paste %s\n", resp)
+
+	// the response is the url of the new paste
+	return path.Base(strings.TrimSpace(resp)), nil
 }
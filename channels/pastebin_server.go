@@ -0,0 +1,185 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"html"
+	"math/rand"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const PastebinKeyChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+type storedPaste struct {
+	key   string
+	date  int64
+	paste Paste
+}
+
+// PastebinServer is a local stand-in for the pastebin.com API, it keeps the
+// pastes of every user key in memory and implements the list, paste, delete
+// and show_paste options, plus an api_results_offset parameter to page
+// through the list, so that the pastebin channel can be used and tested
+// without pastebin.com .
+type PastebinServer struct {
+	pastes map[string][]*storedPaste
+	mutex  *sync.Mutex
+}
+
+func NewPastebinServer() *PastebinServer {
+	return &PastebinServer{
+		pastes: make(map[string][]*storedPaste),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+func newPasteKey() string {
+	key := make([]byte, 8)
+	for i := range key {
+		key[i] = PastebinKeyChars[rand.Intn(len(PastebinKeyChars))]
+	}
+	return string(key)
+}
+
+func (s *PastebinServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := r.PostFormValue("api_user_key")
+	option := r.PostFormValue("api_option")
+	page := path.Base(r.URL.Path)
+
+	sg1.Debug("Pastebin server got %s request for %s from %s.\n", option, page, r.RemoteAddr)
+
+	if r.PostFormValue("api_dev_key") == "" {
+		fmt.Fprintf(w, "%s, invalid api_dev_key", PastebinErrorPrefix)
+	} else if page == "api_raw.php" && option == "show_paste" {
+		s.show(w, user, r.PostFormValue("api_paste_key"))
+	} else if page != "api_post.php" {
+		http.NotFound(w, r)
+	} else if option == "paste" {
+		s.create(w, r, user)
+	} else if option == "list" {
+		limit, err := strconv.Atoi(r.PostFormValue("api_results_limit"))
+		if err != nil || limit <= 0 {
+			limit = 50
+		}
+		offset, err := strconv.Atoi(r.PostFormValue("api_results_offset"))
+		if err != nil || offset < 0 {
+			offset = 0
+		}
+		s.list(w, user, limit, offset)
+	} else if option == "delete" {
+		s.delete(w, user, r.PostFormValue("api_paste_key"))
+	} else {
+		fmt.Fprintf(w, "%s, invalid api_option", PastebinErrorPrefix)
+	}
+}
+
+func (s *PastebinServer) create(w http.ResponseWriter, r *http.Request, user string) {
+	stored := &storedPaste{
+		key:  newPasteKey(),
+		date: time.Now().Unix(),
+		paste: Paste{
+			Text:       r.PostFormValue("api_paste_code"),
+			Name:       r.PostFormValue("api_paste_name"),
+			Privacy:    r.PostFormValue("api_paste_private"),
+			ExpireDate: r.PostFormValue("api_paste_expire_date"),
+		},
+	}
+
+	if stored.paste.Text == "" {
+		fmt.Fprintf(w, "%s, api_paste_code was empty", PastebinErrorPrefix)
+		return
+	}
+
+	s.mutex.Lock()
+	s.pastes[user] = append(s.pastes[user], stored)
+	s.mutex.Unlock()
+
+	fmt.Fprintf(w, "http://%s/%s", r.Host, stored.key)
+}
+
+func (s *PastebinServer) find(user string, key string) int {
+	for i, stored := range s.pastes[user] {
+		if stored.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *PastebinServer) show(w http.ResponseWriter, user string, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if i := s.find(user, key); i == -1 {
+		fmt.Fprintf(w, "%s, invalid permission to view this paste or invalid api_paste_key", PastebinErrorPrefix)
+	} else {
+		fmt.Fprint(w, s.pastes[user][i].paste.Text)
+	}
+}
+
+func (s *PastebinServer) delete(w http.ResponseWriter, user string, key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if i := s.find(user, key); i == -1 {
+		fmt.Fprintf(w, "%s, invalid permission to remove paste", PastebinErrorPrefix)
+	} else {
+		s.pastes[user] = append(s.pastes[user][:i], s.pastes[user][i+1:]...)
+		fmt.Fprint(w, "Paste Removed")
+	}
+}
+
+// Like pastebin.com, list the newest pastes first, skipping the first offset
+// ones.
+func (s *PastebinServer) list(w http.ResponseWriter, user string, limit int, offset int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pastes := s.pastes[user]
+	last := len(pastes) - 1 - offset
+	for i := last; i >= 0 && last-i < limit; i-- {
+		stored := pastes[i]
+		fmt.Fprintf(w, "<paste>\n")
+		fmt.Fprintf(w, "\t<paste_key>%s</paste_key>\n", stored.key)
+		fmt.Fprintf(w, "\t<paste_date>%d</paste_date>\n", stored.date)
+		fmt.Fprintf(w, "\t<paste_title>%s</paste_title>\n", html.EscapeString(stored.paste.Name))
+		fmt.Fprintf(w, "\t<paste_size>%d</paste_size>\n", len(stored.paste.Text))
+		fmt.Fprintf(w, "\t<paste_private>%s</paste_private>\n", stored.paste.Privacy)
+		fmt.Fprintf(w, "</paste>\n")
+	}
+}
@@ -0,0 +1,172 @@
+package channels
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testPastebinDevKey  = "0123456789abcdef0123456789abcdef"
+	testPastebinUserKey = "fedcba9876543210fedcba9876543210"
+)
+
+func newTestPastebinChannels(t *testing.T, url string) (*Pastebin, *Pastebin) {
+	args := testPastebinDevKey + "/" + testPastebinUserKey + "#TEST"
+
+	server := NewPastebinChannel()
+	server.url = url
+	server.poll_time = 10
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, args))
+	assert.Nil(t, server.Start())
+
+	client := NewPastebinChannel()
+	client.url = url
+	client.poll_time = 10
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, args))
+	assert.Nil(t, client.Start())
+
+	return server, client
+}
+
+func TestPastebinAPI(t *testing.T) {
+	server := httptest.NewServer(NewPastebinServer())
+	defer server.Close()
+
+	api := NewPastebinAPI(server.URL, testPastebinDevKey, testPastebinUserKey)
+
+	key, err := api.Create(Paste{Text: "hello", Name: "SG1 <TEST> & co", Privacy: Private, ExpireDate: Hour})
+	assert.Nil(t, err)
+
+	pastes, err := api.List()
+	assert.Nil(t, err)
+	if assert.Len(t, pastes, 1) {
+		assert.Equal(t, key, pastes[0].Key)
+		assert.Equal(t, "SG1 <TEST> & co", pastes[0].Title)
+		assert.NotZero(t, pastes[0].Date)
+	}
+
+	text, err := api.Show(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", text)
+
+	// pastes belong to the user key
+	other := NewPastebinAPI(server.URL, testPastebinDevKey, "other")
+	pastes, err = other.List()
+	assert.Nil(t, err)
+	assert.Empty(t, pastes)
+	assert.NotNil(t, other.Delete(key))
+
+	assert.Nil(t, api.Delete(key))
+	_, err = api.Show(key)
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), PastebinErrorPrefix))
+}
+
+func TestPastebinAPIPages(t *testing.T) {
+	pastebin := NewPastebinServer()
+	server := httptest.NewServer(pastebin)
+	defer server.Close()
+
+	// more than a page of pastes, oldest first
+	for i := 0; i < PastebinPageSize+10; i++ {
+		pastebin.pastes[testPastebinUserKey] = append(pastebin.pastes[testPastebinUserKey], &storedPaste{
+			key:   fmt.Sprintf("key%d", i),
+			date:  int64(i),
+			paste: Paste{Text: "hello", Name: fmt.Sprintf("paste %d", i)},
+		})
+	}
+
+	api := NewPastebinAPI(server.URL, testPastebinDevKey, testPastebinUserKey)
+	pastes, err := api.List()
+	assert.Nil(t, err)
+	if assert.Len(t, pastes, PastebinPageSize+10) {
+		assert.Equal(t, "key0", pastes[len(pastes)-1].Key)
+	}
+
+	// a service ignoring the offset only gives the newest page
+	ignoring := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		r.PostForm.Del("api_results_offset")
+		pastebin.ServeHTTP(w, r)
+	}))
+	defer ignoring.Close()
+
+	api = NewPastebinAPI(ignoring.URL, testPastebinDevKey, testPastebinUserKey)
+	pastes, err = api.List()
+	assert.Nil(t, err)
+	if assert.Len(t, pastes, PastebinPageSize) {
+		assert.Equal(t, "key10", pastes[len(pastes)-1].Key)
+	}
+}
+
+func TestPastebinChannel(t *testing.T) {
+	api := httptest.NewServer(NewPastebinServer())
+	defer api.Close()
+
+	server, client := newTestPastebinChannels(t, api.URL)
+
+	testRoundTrip(t, server, client, client.chunk_size, []string{"hello pastebin"}, "hello client")
+}
+
+func TestPastebinChannelChunks(t *testing.T) {
+	api := httptest.NewServer(NewPastebinServer())
+	defer api.Close()
+
+	server, client := newTestPastebinChannels(t, api.URL)
+	defer server.Close()
+	defer client.Close()
+
+	// several pastes, listed newest first by the service
+	message := bytes.Repeat([]byte("0123456789abcdef"), PastebinChunkSize*3/16+1)
+	n, err := client.Write(message)
+	assert.Nil(t, err)
+	assert.Equal(t, len(message), n)
+
+	received := make([]byte, 0)
+	buff := make([]byte, PastebinChunkSize)
+	for len(received) < len(message) {
+		n, err := server.Read(buff)
+		if !assert.Nil(t, err) {
+			break
+		}
+		received = append(received, buff[:n]...)
+	}
+	assert.Equal(t, message, received)
+}
+
+func TestPastebinChannelClaim(t *testing.T) {
+	api := httptest.NewServer(NewPastebinServer())
+	defer api.Close()
+
+	drop := NewPasteDrop(NewPastebinAPI(api.URL, testPastebinDevKey, testPastebinUserKey))
+	writer := NewPastebinChannel()
+	writer.drop = drop
+	assert.Nil(t, writer.send(writer.seq.Packet([]byte("claimed"), 1)))
+
+	blobs, err := drop.List()
+	assert.Nil(t, err)
+	assert.Len(t, blobs, 1)
+
+	// two listeners of the same stream see the same paste, only the first
+	// one to delete it gets its data
+	first := NewPastebinChannel()
+	first.drop = drop
+	second := NewPastebinChannel()
+	second.drop = drop
+
+	first.process(blobs[0])
+	second.process(blobs[0])
+
+	assert.Equal(t, len("claimed"), first.Stats().TotalRead)
+	assert.Equal(t, 0, second.Stats().TotalRead)
+
+	blobs, err = drop.List()
+	assert.Nil(t, err)
+	assert.Empty(t, blobs)
+}
@@ -0,0 +1,267 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SecureChannel wraps another bidirectional channel, runs an ephemeral key
+// exchange with the sg1 instance on the other end when started and then
+// encrypts and authenticates everything going through it.
+type SecureChannel struct {
+	key_file   string
+	peers      string
+	direction  Direction
+	channel    Channel
+	reader     *bufio.Reader
+	identity   ed25519.PrivateKey
+	pinned     []ed25519.PublicKey
+	session    *sg1.SecureSession
+	pending    []byte
+	read_lock  *sync.Mutex
+	write_lock *sync.Mutex
+	stats      Stats
+}
+
+func NewSecureChannel() *SecureChannel {
+	return &SecureChannel{
+		key_file:   "",
+		peers:      "",
+		channel:    nil,
+		reader:     nil,
+		identity:   nil,
+		pinned:     make([]ed25519.PublicKey, 0),
+		session:    nil,
+		pending:    nil,
+		read_lock:  &sync.Mutex{},
+		write_lock: &sync.Mutex{},
+	}
+}
+
+func (c *SecureChannel) Copy() interface{} {
+	cp := NewSecureChannel()
+	cp.key_file = c.key_file
+	cp.peers = c.peers
+	return cp
+}
+
+func (c *SecureChannel) Name() string {
+	return "secure"
+}
+
+func (c *SecureChannel) Description() string {
+	return "Wrap a bidirectional channel, exchange ephemeral keys with the other end and encrypt the data with per-session keys, use -secure-key and -secure-peer to authenticate peers ( example: secure:tcp:127.0.0.1:8080 )."
+}
+
+func (c *SecureChannel) Register() error {
+	flag.StringVar(&c.key_file, "secure-key", "", "Ed25519 identity key file for the secure channel, it will be generated if it does not exist.")
+	flag.StringVar(&c.peers, "secure-peer", "", "Comma separated list of hex encoded identity public keys the secure channel peer is allowed to use.")
+	return nil
+}
+
+func loadIdentity(filename string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		sg1.Log("Generating new identity key %s ...\n", filename)
+
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err = os.WriteFile(filename, data, 0600); err != nil {
+			return nil, err
+		}
+
+		return priv, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Could not decode PEM data from %s.", filename)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+	if ok == false {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key.", filename)
+	}
+
+	return priv, nil
+}
+
+func (c *SecureChannel) Setup(direction Direction, args string) (err error) {
+	c.direction = direction
+
+	if c.channel, err = Factory(args, direction); err != nil {
+		return err
+	} else if c.channel.HasReader() == false || c.channel.HasWriter() == false {
+		return fmt.Errorf("Channel '%s' can't be used for both reading and writing, hence it can't be secured.", c.channel.Name())
+	}
+
+	if c.key_file != "" {
+		if c.identity, err = loadIdentity(c.key_file); err != nil {
+			return err
+		}
+	}
+
+	for _, peer := range strings.Split(c.peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			key, err := sg1.ParseIdentity(peer)
+			if err != nil {
+				return err
+			}
+			c.pinned = append(c.pinned, key)
+		}
+	}
+
+	c.reader = bufio.NewReaderSize(c.channel, TunnelBufferSize)
+
+	sg1.Debug("Setup secure channel: direction=%d channel=%s pinned=%d\n", direction, c.channel.Name(), len(c.pinned))
+
+	return nil
+}
+
+// Read and write the handshake messages on the wrapped channel.
+type secureTransport struct {
+	c *SecureChannel
+}
+
+func (t secureTransport) Read(b []byte) (int, error) {
+	return t.c.reader.Read(b)
+}
+
+func (t secureTransport) Write(b []byte) (int, error) {
+	return t.c.channel.Write(b)
+}
+
+func (c *SecureChannel) Start() (err error) {
+	if err = c.channel.Start(); err != nil {
+		return err
+	}
+
+	if c.identity != nil {
+		sg1.Log("Secure channel identity is %s\n", sg1.IdentityString(c.identity.Public().(ed25519.PublicKey)))
+	} else if len(c.pinned) == 0 {
+		sg1.Warning("No -secure-key or -secure-peer specified, the secure channel peers won't be authenticated.\n")
+	}
+
+	sg1.Log("Exchanging keys over %s channel ...\n", c.channel.Name())
+
+	// the output side of the channel is the one initiating the handshake
+	initiator := c.direction == OUTPUT_CHANNEL
+	if c.session, err = sg1.Handshake(secureTransport{c}, initiator, c.identity, c.pinned); err != nil {
+		return err
+	}
+
+	if peer := c.session.Peer(); peer != nil {
+		sg1.Log("Secure session established with peer %s.\n\n", sg1.IdentityString(peer))
+	} else {
+		sg1.Log("Secure session established with anonymous peer.\n\n")
+	}
+
+	return nil
+}
+
+// Let the other end of the wrapped channel know that nothing else will be
+// written.
+func (c *SecureChannel) CloseWrite() error {
+	return CloseWrite(c.channel)
+}
+
+func (c *SecureChannel) Close() error {
+	return c.channel.Close()
+}
+
+func (c *SecureChannel) HasReader() bool {
+	return true
+}
+
+func (c *SecureChannel) HasWriter() bool {
+	return true
+}
+
+func (c *SecureChannel) Read(b []byte) (n int, err error) {
+	c.read_lock.Lock()
+	defer c.read_lock.Unlock()
+
+	if len(c.pending) == 0 {
+		if c.pending, err = c.session.ReadRecord(c.reader); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	c.stats.TotalRead += n
+
+	sg1.Debug("Read %d bytes from secure channel.\n", n)
+
+	return n, nil
+}
+
+func (c *SecureChannel) Write(b []byte) (n int, err error) {
+	c.write_lock.Lock()
+	defer c.write_lock.Unlock()
+
+	if _, err = c.channel.Write(c.session.Seal(b)); err != nil {
+		return 0, err
+	}
+
+	c.stats.TotalWrote += len(b)
+
+	sg1.Debug("Wrote %d bytes to secure channel.\n", len(b))
+
+	return len(b), nil
+}
+
+func (c *SecureChannel) Stats() Stats {
+	return c.stats
+}
@@ -0,0 +1,121 @@
+package channels
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evilsocket/sg1/sg1"
+	"github.com/stretchr/testify/assert"
+)
+
+// Generate an identity key file and return its name and public key.
+func newTestIdentity(t *testing.T, name string) (string, string) {
+	filename := filepath.Join(t.TempDir(), name+".key")
+	key, err := loadIdentity(filename)
+	assert.Nil(t, err)
+	return filename, sg1.IdentityString(key.Public().(ed25519.PublicKey))
+}
+
+// The wrapped channels are created by name, registering them again only
+// returns an error.
+func registerTestSecureChannels() {
+	Register(NewTCPChannel())
+	Register(NewUDPChannel())
+}
+
+func isDialError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// Setup a secure listener and client over the given channel and start both,
+// returning the errors of their handshakes. When one end fails the other one
+// is closed, since it might be waiting for the rest of the handshake.
+func startTestSecureChannels(t *testing.T, args string, server, client *SecureChannel) (server_err, client_err error) {
+	registerTestSecureChannels()
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, args))
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, args))
+
+	server_done := make(chan error, 1)
+	go func() {
+		server_done <- server.Start()
+	}()
+
+	client_done := make(chan error, 1)
+	go func() {
+		// the listener might not be listening yet
+		err := client.Start()
+		for i := 0; i < 100 && isDialError(err); i++ {
+			time.Sleep(10 * time.Millisecond)
+			err = client.Start()
+		}
+		client_done <- err
+	}()
+
+	for server_done != nil || client_done != nil {
+		select {
+		case server_err = <-server_done:
+			server_done = nil
+			if server_err != nil {
+				client.Close()
+			}
+		case client_err = <-client_done:
+			client_done = nil
+			if client_err != nil {
+				server.Close()
+			}
+		}
+	}
+
+	return server_err, client_err
+}
+
+func TestSecureChannel(t *testing.T) {
+	// so that the handshake over udp survives the listener starting late
+	enableReliable(t)
+	server_key, server_public := newTestIdentity(t, "server")
+	client_key, client_public := newTestIdentity(t, "client")
+
+	for _, args := range []string{"tcp:" + freeAddress(t), "udp:" + freeUDPAddress(t)} {
+		server := NewSecureChannel()
+		server.key_file = server_key
+		server.peers = client_public
+
+		client := NewSecureChannel()
+		client.key_file = client_key
+		client.peers = server_public
+
+		server_err, client_err := startTestSecureChannels(t, args, server, client)
+		assert.Nil(t, server_err, args)
+		assert.Nil(t, client_err, args)
+
+		testRoundTrip(t, server, client, TunnelBufferSize, []string{"hello secure"}, "hello client")
+	}
+}
+
+func TestSecureChannelWrongPeer(t *testing.T) {
+	enableReliable(t)
+	server_key, server_public := newTestIdentity(t, "server")
+	client_key, _ := newTestIdentity(t, "client")
+	_, other_public := newTestIdentity(t, "other")
+
+	for _, args := range []string{"tcp:" + freeAddress(t), "udp:" + freeUDPAddress(t)} {
+		server := NewSecureChannel()
+		server.key_file = server_key
+		server.peers = other_public
+
+		client := NewSecureChannel()
+		client.key_file = client_key
+		client.peers = server_public
+
+		server_err, _ := startTestSecureChannels(t, args, server, client)
+		assert.NotNil(t, server_err, args)
+
+		client.Close()
+		server.Close()
+	}
+}
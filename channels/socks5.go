@@ -0,0 +1,600 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SOCKS5Version         = 0x05
+	SOCKS5NoAuth          = 0x00
+	SOCKS5NoAcceptable    = 0xff
+	SOCKS5CmdConnect      = 0x01
+	SOCKS5AddrIPv4        = 0x01
+	SOCKS5AddrDomain      = 0x03
+	SOCKS5AddrIPv6        = 0x04
+	SOCKS5Succeeded       = 0x00
+	SOCKS5Failure         = 0x01
+	SOCKS5HostRefused     = 0x05
+	SOCKS5CmdUnsupported  = 0x07
+	SOCKS5AddrUnsupported = 0x08
+
+	SOCKS5ChunkSize   = 16 * 1024
+	SOCKS5QueueSize   = 1024
+	SOCKS5DialTimeout = 10 * time.Second
+)
+
+type socksStream struct {
+	id          uint32
+	conn        net.Conn
+	opened      chan bool
+	established bool
+	// data to write to the connection, nil once the other end closed it
+	writes  chan []byte
+	done    chan struct{}
+	closing sync.Once
+	// the stream is closed once both halves are done
+	read_done  bool
+	write_done bool
+}
+
+func newSocksStream(id uint32, conn net.Conn, opened chan bool) *socksStream {
+	return &socksStream{
+		id:     id,
+		conn:   conn,
+		opened: opened,
+		writes: make(chan []byte, SOCKS5QueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+func (s *socksStream) close() {
+	s.closing.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// SOCKS5Channel multiplexes TCP streams as sg1.Frame objects, as input it is
+// a local SOCKS5 server accepting CONNECT requests, as output it is the exit
+// node that dials the requested destinations.
+type SOCKS5Channel struct {
+	is_client bool
+	address   string
+	listener  net.Listener
+	streams   map[uint32]*socksStream
+	next_id   uint32
+	frames    chan *sg1.Frame
+	pending   []byte
+	decoder   *sg1.FrameDecoder
+	done      chan struct{}
+	closed    bool
+	mutex     *sync.Mutex
+	stats     Stats
+}
+
+func NewSOCKS5Channel() *SOCKS5Channel {
+	return &SOCKS5Channel{
+		is_client: true,
+		address:   "",
+		listener:  nil,
+		streams:   make(map[uint32]*socksStream),
+		next_id:   1,
+		frames:    make(chan *sg1.Frame, SOCKS5QueueSize),
+		pending:   nil,
+		decoder:   sg1.NewFrameDecoder(),
+		done:      make(chan struct{}),
+		closed:    false,
+		mutex:     &sync.Mutex{},
+	}
+}
+
+func (c *SOCKS5Channel) Copy() interface{} {
+	return NewSOCKS5Channel()
+}
+
+func (c *SOCKS5Channel) Name() string {
+	return "socks5"
+}
+
+func (c *SOCKS5Channel) Description() string {
+	return "As input, run a SOCKS5 server and multiplex its connections over the output channel, as output connect to the requested destinations, to be used with -tunnel ( example: -in socks5:127.0.0.1:1080 on the client, -out socks5 on the exit node )."
+}
+
+func (c *SOCKS5Channel) Register() error {
+	return nil
+}
+
+func (c *SOCKS5Channel) Setup(direction Direction, args string) error {
+	if sg1.Tunnel == false {
+		return fmt.Errorf("The socks5 channel can only be used with -tunnel.")
+	}
+
+	if direction == INPUT_CHANNEL {
+		c.is_client = false
+		if args == "" {
+			return fmt.Errorf("Usage: socks5:ADDRESS:PORT")
+		}
+		c.address = args
+	} else {
+		c.is_client = true
+	}
+
+	sg1.Debug("Setup socks5 channel: direction=%d address='%s'\n", direction, c.address)
+
+	return nil
+}
+
+func (c *SOCKS5Channel) Start() (err error) {
+	if c.is_client {
+		sg1.Log("SOCKS5 exit node ready ...\n\n")
+		return nil
+	}
+
+	if c.listener, err = net.Listen("tcp", c.address); err != nil {
+		return err
+	}
+
+	go func() {
+		sg1.Log("Started SOCKS5 server on %s ...\n\n", c.address)
+
+		for {
+			if conn, err := c.listener.Accept(); err == nil {
+				sg1.Debug("Got SOCKS5 client connection from %s.\n", conn.RemoteAddr())
+				go c.serve(conn)
+			} else {
+				if c.isClosed() == false {
+					sg1.Error("Error while accepting connection: %s\n", err)
+				}
+				break
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (c *SOCKS5Channel) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// Stop the SOCKS5 server and close every stream.
+func (c *SOCKS5Channel) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	sg1.Debug("Closing SOCKS5 channel with %d streams.\n", len(c.streams))
+
+	c.closed = true
+	close(c.done)
+
+	if c.listener != nil {
+		c.listener.Close()
+	}
+
+	for id, stream := range c.streams {
+		stream.close()
+		delete(c.streams, id)
+	}
+
+	return nil
+}
+
+// Queue a frame to be read from the channel, unless it has been closed.
+func (c *SOCKS5Channel) queue(frame *sg1.Frame) {
+	select {
+	case c.frames <- frame:
+	case <-c.done:
+	}
+}
+
+func (c *SOCKS5Channel) HasReader() bool {
+	return true
+}
+
+func (c *SOCKS5Channel) HasWriter() bool {
+	return true
+}
+
+// Add a stream for a new client connection, returns nil if the channel has
+// been closed.
+func (c *SOCKS5Channel) addStream(conn net.Conn) *socksStream {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	stream := newSocksStream(c.next_id, conn, make(chan bool, 1))
+
+	c.streams[stream.id] = stream
+	c.next_id++
+
+	go c.writer(stream)
+
+	return stream
+}
+
+// Add a stream for a connection dialed by the exit node, returns nil if the
+// channel has been closed in the meantime.
+func (c *SOCKS5Channel) setStream(id uint32, conn net.Conn) *socksStream {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	stream := newSocksStream(id, conn, nil)
+
+	c.streams[id] = stream
+
+	go c.writer(stream)
+
+	return stream
+}
+
+func (c *SOCKS5Channel) getStream(id uint32) *socksStream {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if stream, found := c.streams[id]; found {
+		return stream
+	}
+	return nil
+}
+
+func (c *SOCKS5Channel) delStream(id uint32) *socksStream {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if stream, found := c.streams[id]; found {
+		delete(c.streams, id)
+		return stream
+	}
+	return nil
+}
+
+func (c *SOCKS5Channel) reply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{SOCKS5Version, status, 0x00, SOCKS5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Perform the SOCKS5 negotiation and return the requested destination.
+func (c *SOCKS5Channel) negotiate(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	} else if header[0] != SOCKS5Version {
+		return "", fmt.Errorf("Unsupported SOCKS version %d.", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	no_auth := false
+	for _, method := range methods {
+		if method == SOCKS5NoAuth {
+			no_auth = true
+			break
+		}
+	}
+
+	if no_auth == false {
+		conn.Write([]byte{SOCKS5Version, SOCKS5NoAcceptable})
+		return "", fmt.Errorf("Client does not support unauthenticated SOCKS5.")
+	} else if _, err := conn.Write([]byte{SOCKS5Version, SOCKS5NoAuth}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	} else if request[1] != SOCKS5CmdConnect {
+		c.reply(conn, SOCKS5CmdUnsupported)
+		return "", fmt.Errorf("Unsupported SOCKS5 command %d.", request[1])
+	}
+
+	host := ""
+	switch request[3] {
+	case SOCKS5AddrIPv4, SOCKS5AddrIPv6:
+		size := net.IPv4len
+		if request[3] == SOCKS5AddrIPv6 {
+			size = net.IPv6len
+		}
+
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+
+	case SOCKS5AddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+
+	default:
+		c.reply(conn, SOCKS5AddrUnsupported)
+		return "", fmt.Errorf("Unsupported SOCKS5 address type %d.", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func (c *SOCKS5Channel) serve(conn net.Conn) {
+	destination, err := c.negotiate(conn)
+	if err != nil {
+		sg1.Warning("SOCKS5 negotiation with %s failed: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	stream := c.addStream(conn)
+	if stream == nil {
+		conn.Close()
+		return
+	}
+
+	sg1.Log("SOCKS5 stream %d: %s -> %s\n", stream.id, conn.RemoteAddr(), destination)
+
+	c.queue(sg1.NewFrame(sg1.FRAME_OPEN, stream.id, []byte(destination)))
+
+	// wait for the exit node to connect, the reply is sent from here so that
+	// a slow client can't block the frames of the other streams
+	select {
+	case opened := <-stream.opened:
+		if opened == false {
+			sg1.Warning("SOCKS5 stream %d: exit node could not connect to %s.\n", stream.id, destination)
+			c.reply(conn, SOCKS5HostRefused)
+			c.closeStream(stream.id, false)
+			return
+		}
+	case <-c.done:
+		return
+	}
+
+	if err := c.reply(conn, SOCKS5Succeeded); err != nil {
+		sg1.Warning("SOCKS5 stream %d: %s\n", stream.id, err)
+		c.closeStream(stream.id, true)
+		return
+	}
+
+	c.pump(stream)
+}
+
+func (c *SOCKS5Channel) connect(id uint32, destination string) {
+	sg1.Log("SOCKS5 stream %d: connecting to %s ...\n", id, destination)
+
+	conn, err := net.DialTimeout("tcp", destination, SOCKS5DialTimeout)
+	if err != nil {
+		sg1.Warning("SOCKS5 stream %d: %s\n", id, err)
+		c.queue(sg1.NewFrame(sg1.FRAME_RESET, id, nil))
+		return
+	}
+
+	stream := c.setStream(id, conn)
+	if stream == nil {
+		conn.Close()
+		return
+	}
+	c.queue(sg1.NewFrame(sg1.FRAME_OPENED, id, nil))
+
+	c.pump(stream)
+}
+
+// Read from the stream connection and queue its data as frames, once the
+// connection is done writing the other end is told to close its write half.
+func (c *SOCKS5Channel) pump(stream *socksStream) {
+	buff := make([]byte, SOCKS5ChunkSize)
+	for {
+		n, err := stream.conn.Read(buff)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buff[:n])
+			c.queue(sg1.NewFrame(sg1.FRAME_DATA, stream.id, data))
+		}
+
+		if err == io.EOF {
+			sg1.Debug("SOCKS5 stream %d: read half closed.\n", stream.id)
+			c.queue(sg1.NewFrame(sg1.FRAME_CLOSE, stream.id, nil))
+			c.halfClose(stream, true)
+			return
+		} else if err != nil {
+			sg1.Debug("SOCKS5 stream %d: %s\n", stream.id, err)
+			c.closeStream(stream.id, true)
+			return
+		}
+	}
+}
+
+// Write the data received for the stream to its connection, each stream has
+// its own writer so that a slow one can't hold back the others.
+func (c *SOCKS5Channel) writer(stream *socksStream) {
+	for {
+		select {
+		case data := <-stream.writes:
+			if data == nil {
+				sg1.Debug("SOCKS5 stream %d: write half closed.\n", stream.id)
+				if err := CloseWrite(stream.conn); err != nil {
+					sg1.Debug("SOCKS5 stream %d: %s\n", stream.id, err)
+				}
+				c.halfClose(stream, false)
+				return
+			} else if _, err := stream.conn.Write(data); err != nil {
+				sg1.Warning("SOCKS5 stream %d: %s\n", stream.id, err)
+				c.closeStream(stream.id, true)
+				return
+			}
+		case <-stream.done:
+			return
+		}
+	}
+}
+
+// Queue data for the writer of the stream, or nil to close it once the data
+// queued before has been written. If the connection is so slow that the
+// queue is full, the stream is closed.
+func (c *SOCKS5Channel) queueWrite(stream *socksStream, data []byte) {
+	select {
+	case stream.writes <- data:
+	case <-stream.done:
+	default:
+		sg1.Warning("SOCKS5 stream %d: more than %d frames waiting to be written, closing it.\n", stream.id, SOCKS5QueueSize)
+		c.closeStream(stream.id, true)
+	}
+}
+
+// Mark the read or write half of the stream as done, and close it if both
+// of them are.
+func (c *SOCKS5Channel) halfClose(stream *socksStream, read bool) {
+	c.mutex.Lock()
+	if read {
+		stream.read_done = true
+	} else {
+		stream.write_done = true
+	}
+	done := stream.read_done && stream.write_done
+	c.mutex.Unlock()
+
+	if done {
+		c.closeStream(stream.id, false)
+	}
+}
+
+// Close both halves of the stream, if notify is true the other end is told
+// to reset it as well.
+func (c *SOCKS5Channel) closeStream(id uint32, notify bool) {
+	if stream := c.delStream(id); stream != nil {
+		sg1.Debug("Closing SOCKS5 stream %d.\n", id)
+		stream.close()
+		if notify {
+			c.queue(sg1.NewFrame(sg1.FRAME_RESET, id, nil))
+		}
+	}
+}
+
+func (c *SOCKS5Channel) Read(b []byte) (n int, err error) {
+	if len(c.pending) == 0 {
+		var frame *sg1.Frame
+		select {
+		case frame = <-c.frames:
+		case <-c.done:
+			return 0, io.EOF
+		}
+		sg1.Debug("Sending SOCKS5 frame type=%d stream=%d size=%d\n", frame.Type, frame.StreamID, frame.DataSize)
+		c.pending = frame.Raw()
+	}
+
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
+	c.stats.TotalRead += n
+
+	return n, nil
+}
+
+func (c *SOCKS5Channel) handleFrame(frame *sg1.Frame) {
+	sg1.Debug("Got SOCKS5 frame type=%d stream=%d size=%d\n", frame.Type, frame.StreamID, frame.DataSize)
+
+	switch frame.Type {
+	case sg1.FRAME_OPEN:
+		if c.is_client {
+			go c.connect(frame.StreamID, string(frame.Data))
+		}
+
+	case sg1.FRAME_OPENED:
+		if stream := c.getStream(frame.StreamID); stream != nil && stream.opened != nil && stream.established == false {
+			stream.established = true
+			stream.opened <- true
+		}
+
+	case sg1.FRAME_DATA:
+		if stream := c.getStream(frame.StreamID); stream != nil && frame.DataSize > 0 {
+			c.queueWrite(stream, frame.Data)
+		}
+
+	case sg1.FRAME_CLOSE, sg1.FRAME_RESET:
+		if stream := c.getStream(frame.StreamID); stream != nil && stream.opened != nil && stream.established == false {
+			// the exit node failed to connect, let the client know
+			stream.established = true
+			stream.opened <- false
+		} else if stream != nil && frame.Type == sg1.FRAME_RESET {
+			c.closeStream(frame.StreamID, false)
+		} else if stream != nil {
+			// close its write half after writing what's still queued
+			c.queueWrite(stream, nil)
+		}
+	}
+}
+
+func (c *SOCKS5Channel) Write(b []byte) (n int, err error) {
+	frames, err := c.decoder.Feed(b)
+	for _, frame := range frames {
+		c.handleFrame(frame)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	c.stats.TotalWrote += len(b)
+
+	return len(b), nil
+}
+
+func (c *SOCKS5Channel) Stats() Stats {
+	return c.stats
+}
@@ -0,0 +1,232 @@
+package channels
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/evilsocket/sg1/sg1"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts a socks5 server and an exit node, with the frames of each one
+// written to the other.
+func newTestSOCKS5Channels(t *testing.T) (server, exit *SOCKS5Channel) {
+	tunnel := sg1.Tunnel
+	sg1.Tunnel = true
+	defer func() { sg1.Tunnel = tunnel }()
+
+	server = NewSOCKS5Channel()
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, "127.0.0.1:0"))
+	assert.Nil(t, server.Start())
+
+	exit = NewSOCKS5Channel()
+	assert.Nil(t, exit.Setup(OUTPUT_CHANNEL, ""))
+	assert.Nil(t, exit.Start())
+
+	pipe := func(from, to Channel) {
+		buff := make([]byte, 65536)
+		for {
+			n, err := from.Read(buff)
+			if err != nil {
+				return
+			}
+			to.Write(buff[:n])
+		}
+	}
+
+	go pipe(server, exit)
+	go pipe(exit, server)
+
+	t.Cleanup(func() {
+		server.Close()
+		exit.Close()
+	})
+
+	return server, exit
+}
+
+func startTestEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// Accepts connections which are answered only once the client is done
+// writing, with what it wrote.
+func startTestHalfCloseServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if data, err := io.ReadAll(conn); err == nil {
+					conn.Write(append([]byte("got "), data...))
+				}
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func socksConnect(t *testing.T, proxy string, destination *net.TCPAddr) net.Conn {
+	conn, err := net.Dial("tcp", proxy)
+	assert.Nil(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte{SOCKS5Version, 1, SOCKS5NoAuth})
+	assert.Nil(t, err)
+
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply[:2])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{SOCKS5Version, SOCKS5NoAuth}, reply[:2])
+
+	request := []byte{SOCKS5Version, SOCKS5CmdConnect, 0x00, SOCKS5AddrIPv4}
+	request = append(request, destination.IP.To4()...)
+	request = binary.BigEndian.AppendUint16(request, uint16(destination.Port))
+	_, err = conn.Write(request)
+	assert.Nil(t, err)
+
+	_, err = io.ReadFull(conn, reply)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(SOCKS5Succeeded), reply[1])
+
+	return conn
+}
+
+func TestSOCKS5ChannelSetupRequiresTunnel(t *testing.T) {
+	tunnel := sg1.Tunnel
+	sg1.Tunnel = false
+	defer func() { sg1.Tunnel = tunnel }()
+
+	assert.NotNil(t, NewSOCKS5Channel().Setup(INPUT_CHANNEL, "127.0.0.1:0"))
+	assert.NotNil(t, NewSOCKS5Channel().Setup(OUTPUT_CHANNEL, ""))
+}
+
+func TestSOCKS5ChannelConnect(t *testing.T) {
+	server, _ := newTestSOCKS5Channels(t)
+	echo := startTestEchoServer(t)
+	proxy := server.listener.Addr().String()
+	destination := echo.Addr().(*net.TCPAddr)
+
+	// two streams multiplexed over the same channels
+	first := socksConnect(t, proxy, destination)
+	defer first.Close()
+	second := socksConnect(t, proxy, destination)
+	defer second.Close()
+
+	for i, conn := range []net.Conn{first, second, first} {
+		msg := []byte("hello " + string(rune('a'+i)))
+		_, err := conn.Write(msg)
+		assert.Nil(t, err)
+
+		buff := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buff)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, buff)
+	}
+}
+
+func TestSOCKS5ChannelSlowStream(t *testing.T) {
+	c := NewSOCKS5Channel()
+	defer c.Close()
+
+	// nobody reads from the slow stream, so writing to it blocks
+	slow, _ := net.Pipe()
+	fast, fast_peer := net.Pipe()
+	slow_id := c.addStream(slow).id
+	fast_id := c.addStream(fast).id
+
+	done := make(chan bool)
+	go func() {
+		c.handleFrame(sg1.NewFrame(sg1.FRAME_DATA, slow_id, []byte("stuck")))
+		c.handleFrame(sg1.NewFrame(sg1.FRAME_DATA, fast_id, []byte("not blocked")))
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleFrame blocked on the slow stream.")
+	}
+
+	fast_peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buff := make([]byte, 11)
+	_, err := io.ReadFull(fast_peer, buff)
+	assert.Nil(t, err)
+	assert.Equal(t, "not blocked", string(buff))
+}
+
+func TestSOCKS5ChannelHalfClose(t *testing.T) {
+	server, _ := newTestSOCKS5Channels(t)
+	service := startTestHalfCloseServer(t)
+
+	conn := socksConnect(t, server.listener.Addr().String(), service.Addr().(*net.TCPAddr))
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, conn.(*net.TCPConn).CloseWrite())
+
+	// the reply still gets through, then the stream is closed
+	reply, err := io.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "got hello", string(reply))
+}
+
+func TestSOCKS5ChannelSlowReply(t *testing.T) {
+	c := NewSOCKS5Channel()
+	defer c.Close()
+
+	// nobody reads the SOCKS5 reply from the client connection
+	conn, _ := net.Pipe()
+	stream := c.addStream(conn)
+
+	done := make(chan bool)
+	go func() {
+		c.handleFrame(sg1.NewFrame(sg1.FRAME_OPENED, stream.id, nil))
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleFrame blocked on the SOCKS5 reply.")
+	}
+}
+
+func TestSOCKS5ChannelConnectAfterClose(t *testing.T) {
+	echo := startTestEchoServer(t)
+
+	c := NewSOCKS5Channel()
+	assert.Nil(t, c.Close())
+
+	c.connect(1, echo.Addr().String())
+	assert.Nil(t, c.getStream(1))
+}
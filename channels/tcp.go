@@ -27,26 +27,35 @@
 package channels
 
 import (
+	"fmt"
 	"github.com/evilsocket/sg1/sg1"
+	"io"
 	"net"
+	"os"
+	"strings"
 	"sync"
 )
 
+// TCPChannel is used for both TCP and unix domain sockets, as they only
+// differ by the network and address format.
 type TCPChannel struct {
+	network    string
 	is_client  bool
-	address    *net.TCPAddr
-	connection *net.TCPConn
+	address    string
+	connection net.Conn
 	client     net.Conn
 	listener   net.Listener
+	closed     bool
 	mutex      *sync.Mutex
 	cond       *sync.Cond
 	stats      Stats
 }
 
-func NewTCPChannel() *TCPChannel {
+func newTCPChannel(network string) *TCPChannel {
 	s := &TCPChannel{
+		network:    network,
 		is_client:  true,
-		address:    nil,
+		address:    "",
 		connection: nil,
 		mutex:      &sync.Mutex{},
 		cond:       nil,
@@ -56,15 +65,26 @@ func NewTCPChannel() *TCPChannel {
 	return s
 }
 
+func NewTCPChannel() *TCPChannel {
+	return newTCPChannel("tcp")
+}
+
+func NewUnixChannel() *TCPChannel {
+	return newTCPChannel("unix")
+}
+
 func (c *TCPChannel) Copy() interface{} {
-	return NewTCPChannel()
+	return newTCPChannel(c.network)
 }
 
 func (c *TCPChannel) Name() string {
-	return "tcp"
+	return c.network
 }
 
 func (c *TCPChannel) Description() string {
+	if c.network == "unix" {
+		return "Read or write data on a unix domain socket server (for input) or client (for output) connection ( example: unix:/tmp/sg1.sock )."
+	}
 	return "Read or write data on a TCP server (for input) or client (for output) connection ( example: tcp:127.0.0.1:8080 )."
 }
 
@@ -80,36 +100,53 @@ func (c *TCPChannel) Setup(direction Direction, args string) (err error) {
 		c.is_client = true
 	}
 
-	if c.address, err = net.ResolveTCPAddr("tcp", args); err != nil {
+	if c.network == "unix" {
+		if args == "" {
+			return fmt.Errorf("Usage: unix:/path/to/socket")
+		}
+		c.address = args
+	} else if addr, err := net.ResolveTCPAddr(c.network, args); err != nil {
 		return err
+	} else {
+		c.address = addr.String()
 	}
 
-	sg1.Debug("Setup tcp channel: direction=%d address=%s\n", direction, args)
+	sg1.Debug("Setup %s channel: direction=%d address=%s\n", c.network, direction, c.address)
 
 	return nil
 }
 
 func (c *TCPChannel) Start() (err error) {
 	if c.is_client {
-		sg1.Log("Connecting to TCP endpoint %s ...\n\n", c.address)
+		sg1.Log("Connecting to %s endpoint %s ...\n\n", strings.ToUpper(c.network), c.address)
 
-		if c.connection, err = net.DialTCP("tcp", nil, c.address); err != nil {
+		if c.connection, err = net.Dial(c.network, c.address); err != nil {
 			return err
 		}
 	} else {
-		if c.listener, err = net.ListenTCP("tcp", c.address); err != nil {
+		if c.network == "unix" {
+			// remove the socket left behind by a previous instance
+			if info, err := os.Stat(c.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+				sg1.Debug("Removing stale unix socket %s.\n", c.address)
+				os.Remove(c.address)
+			}
+		}
+
+		if c.listener, err = net.Listen(c.network, c.address); err != nil {
 			return err
 		}
 
 		go func() {
-			sg1.Log("Started TCP server on %s ...\n\n", c.address)
+			sg1.Log("Started %s server on %s ...\n\n", strings.ToUpper(c.network), c.address)
 
 			for {
 				if conn, err := c.listener.Accept(); err == nil {
 					sg1.Debug("Got client connection %v.\n", conn)
 					c.SetClient(conn)
 				} else {
-					sg1.Error("Error while accepting connection: %s\n", err)
+					if c.isClosed() == false {
+						sg1.Error("Error while accepting connection: %s\n", err)
+					}
 					break
 				}
 			}
@@ -131,6 +168,11 @@ func (c *TCPChannel) SetClient(con net.Conn) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	if c.closed {
+		con.Close()
+		return
+	}
+
 	sg1.Debug("Setting client.\n")
 
 	if c.client != nil {
@@ -139,27 +181,88 @@ func (c *TCPChannel) SetClient(con net.Conn) {
 	}
 
 	c.client = con
-	c.cond.Signal()
+	c.cond.Broadcast()
 }
 
 func (c *TCPChannel) WaitForClient() {
-	if c.is_client == false && c.client == nil {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.is_client == false && c.client == nil && c.closed == false {
 		sg1.Debug("Waiting for client ...\n")
-		c.mutex.Lock()
-		defer c.mutex.Unlock()
 		c.cond.Wait()
-		sg1.Debug("Got client.\n")
 	}
 }
 
+// Return the connected client or nil if the channel has been closed.
 func (c *TCPChannel) GetClient() net.Conn {
 	c.WaitForClient()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.client
 }
 
+func (c *TCPChannel) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// Shut down the writing side of the connection, the other end will read EOF
+// while we can still read what it sends.
+func (c *TCPChannel) CloseWrite() error {
+	c.mutex.Lock()
+	conn := c.connection
+	if c.is_client == false {
+		conn = c.client
+	}
+	closed := c.closed
+	c.mutex.Unlock()
+
+	if closed || conn == nil {
+		return nil
+	}
+
+	sg1.Debug("Closing the %s connection for writing.\n", c.network)
+
+	// both *net.TCPConn and *net.UnixConn support it
+	return CloseWrite(conn)
+}
+
+func (c *TCPChannel) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	sg1.Debug("Closing %s channel.\n", c.network)
+
+	c.closed = true
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.client != nil {
+		c.client.Close()
+	}
+	if c.connection != nil {
+		c.connection.Close()
+	}
+	c.cond.Broadcast()
+
+	return nil
+}
+
 func (c *TCPChannel) Read(b []byte) (n int, err error) {
 	if c.is_client == false {
-		n, err = c.GetClient().Read(b)
+		client := c.GetClient()
+		if client == nil {
+			return 0, io.EOF
+		}
+
+		n, err = client.Read(b)
 
 		sg1.Debug("Read %d bytes from client.\n", n)
 	} else {
@@ -171,12 +274,20 @@ func (c *TCPChannel) Read(b []byte) (n int, err error) {
 	if n > 0 {
 		c.stats.TotalRead += n
 	}
+	if err != nil && c.isClosed() {
+		err = io.EOF
+	}
 	return n, err
 }
 
 func (c *TCPChannel) Write(b []byte) (n int, err error) {
 	if c.is_client == false {
-		n, err = c.GetClient().Write(b)
+		client := c.GetClient()
+		if client == nil {
+			return 0, fmt.Errorf("%s channel is closed.", c.network)
+		}
+
+		n, err = client.Write(b)
 
 		sg1.Debug("Wrote %d bytes to client.\n", n)
 	} else {
@@ -0,0 +1,31 @@
+package channels
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixChannel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sg1.sock")
+
+	server := NewUnixChannel()
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, path))
+	assert.Nil(t, server.Start())
+
+	client := NewUnixChannel()
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, path))
+	assert.Nil(t, client.Start())
+
+	_, err := client.Write([]byte("hello server"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello server", readString(t, server))
+
+	_, err = server.Write([]byte("hello client"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello client", readString(t, client))
+
+	client.Close()
+	server.Close()
+}
@@ -36,7 +36,9 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"flag"
+	"fmt"
 	"github.com/evilsocket/sg1/sg1"
+	"io"
 	"math/big"
 	"net"
 	"os"
@@ -55,9 +57,10 @@ type TLSChannel struct {
 	listener   net.Listener
 	client     net.Conn
 
-	mutex *sync.Mutex
-	cond  *sync.Cond
-	stats Stats
+	closed bool
+	mutex  *sync.Mutex
+	cond   *sync.Cond
+	stats  Stats
 }
 
 func NewTLSChannel() *TLSChannel {
@@ -79,7 +82,10 @@ func NewTLSChannel() *TLSChannel {
 }
 
 func (c *TLSChannel) Copy() interface{} {
-	return NewTLSChannel()
+	cp := NewTLSChannel()
+	cp.pem_file = c.pem_file
+	cp.key_file = c.key_file
+	return cp
 }
 
 func (c *TLSChannel) Name() string {
@@ -128,8 +134,11 @@ func pemBlockForKey(priv interface{}) *pem.Block {
 	}
 }
 
-func (c *TLSChannel) getCertificateConfig() (conf *tls.Config, err error) {
-	if c.pem_file == "" || c.key_file == "" {
+// Load the key pair from the given files or, if they are not specified,
+// generate a self signed certificate. Peers are never verified, hence the
+// InsecureSkipVerify also for the client side.
+func getCertificateConfig(pem_file string, key_file string) (conf *tls.Config, err error) {
+	if pem_file == "" || key_file == "" {
 		sg1.Log("Generating new ECDSA certificate ...\n")
 
 		priv, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
@@ -173,9 +182,9 @@ func (c *TLSChannel) getCertificateConfig() (conf *tls.Config, err error) {
 			InsecureSkipVerify: true,
 		}, nil
 	} else {
-		sg1.Log("Loading X509 key pair from %s (%s).\n", c.pem_file, c.key_file)
+		sg1.Log("Loading X509 key pair from %s (%s).\n", pem_file, key_file)
 
-		cert, err := tls.LoadX509KeyPair(c.pem_file, c.key_file)
+		cert, err := tls.LoadX509KeyPair(pem_file, key_file)
 		if err != nil {
 			return conf, err
 		}
@@ -188,7 +197,7 @@ func (c *TLSChannel) getCertificateConfig() (conf *tls.Config, err error) {
 }
 
 func (c *TLSChannel) Setup(direction Direction, args string) (err error) {
-	c.config, err = c.getCertificateConfig()
+	c.config, err = getCertificateConfig(c.pem_file, c.key_file)
 	if err != nil {
 		return err
 	}
@@ -227,7 +236,9 @@ func (c *TLSChannel) Start() (err error) {
 					sg1.Debug("Got client connection %v.\n", conn)
 					c.SetClient(conn)
 				} else {
-					sg1.Log("Error while accepting connection: %s\n", err)
+					if c.isClosed() == false {
+						sg1.Log("Error while accepting connection: %s\n", err)
+					}
 					break
 				}
 			}
@@ -249,6 +260,11 @@ func (c *TLSChannel) SetClient(con net.Conn) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	if c.closed {
+		con.Close()
+		return
+	}
+
 	sg1.Debug("Setting client.\n")
 
 	if c.client != nil {
@@ -257,27 +273,67 @@ func (c *TLSChannel) SetClient(con net.Conn) {
 	}
 
 	c.client = con
-	c.cond.Signal()
+	c.cond.Broadcast()
 }
 
 func (c *TLSChannel) WaitForClient() {
-	if c.is_client == false && c.client == nil {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.is_client == false && c.client == nil && c.closed == false {
 		sg1.Debug("Waiting for client ...\n")
-		c.mutex.Lock()
-		defer c.mutex.Unlock()
 		c.cond.Wait()
-		sg1.Debug("Got client.\n")
 	}
 }
 
+// Return the connected client or nil if the channel has been closed.
 func (c *TLSChannel) GetClient() net.Conn {
 	c.WaitForClient()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.client
 }
 
+func (c *TLSChannel) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *TLSChannel) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	sg1.Debug("Closing tls channel.\n")
+
+	c.closed = true
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.client != nil {
+		c.client.Close()
+	}
+	if c.connection != nil {
+		c.connection.Close()
+	}
+	c.cond.Broadcast()
+
+	return nil
+}
+
 func (c *TLSChannel) Read(b []byte) (n int, err error) {
 	if c.is_client == false {
-		n, err = c.GetClient().Read(b)
+		client := c.GetClient()
+		if client == nil {
+			return 0, io.EOF
+		}
+
+		n, err = client.Read(b)
 
 		sg1.Debug("Read %d bytes from client.\n", n)
 	} else {
@@ -289,12 +345,20 @@ func (c *TLSChannel) Read(b []byte) (n int, err error) {
 	if n > 0 {
 		c.stats.TotalRead += n
 	}
+	if err != nil && c.isClosed() {
+		err = io.EOF
+	}
 	return n, err
 }
 
 func (c *TLSChannel) Write(b []byte) (n int, err error) {
 	if c.is_client == false {
-		n, err = c.GetClient().Write(b)
+		client := c.GetClient()
+		if client == nil {
+			return 0, fmt.Errorf("TLS channel is closed.")
+		}
+
+		n, err = client.Write(b)
 
 		sg1.Debug("Wrote %d bytes to client.\n", n)
 	} else {
@@ -0,0 +1,234 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	TunnelBufferSize = 64 * 1024
+)
+
+// TunnelAddr is the net.Addr of both ends of a Tunnel, since channels do not
+// expose their underlying endpoints it is simply described by the channel name.
+type TunnelAddr struct {
+	channel string
+}
+
+func (a TunnelAddr) Network() string {
+	return "sg1"
+}
+
+func (a TunnelAddr) String() string {
+	return a.channel
+}
+
+type tunnelRead struct {
+	data []byte
+	err  error
+}
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// Tunnel wraps a channel that can be used for both reading and writing and
+// exposes it as a net.Conn, so it can be piped to sockets or other tunnels.
+// Once the channel returns an error, every following Read returns it too.
+type Tunnel struct {
+	channel        Channel
+	reads          chan tunnelRead
+	done           chan struct{}
+	pending        []byte
+	err            error
+	read_deadline  time.Time
+	write_deadline time.Time
+	started        bool
+	closed         bool
+	mutex          *sync.Mutex
+}
+
+func NewTunnel(channel Channel) *Tunnel {
+	return &Tunnel{
+		channel: channel,
+		reads:   make(chan tunnelRead),
+		done:    make(chan struct{}),
+		pending: nil,
+		err:     nil,
+		started: false,
+		closed:  false,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (t *Tunnel) Channel() Channel {
+	return t.channel
+}
+
+// Reading from the channel happens on a separate goroutine in order to
+// honor read deadlines even with channels which block indefinitely.
+func (t *Tunnel) reader() {
+	sg1.Debug("Tunnel reader for channel %s started.\n", t.channel.Name())
+
+	for {
+		buff := make([]byte, TunnelBufferSize)
+		n, err := t.channel.Read(buff)
+		select {
+		case t.reads <- tunnelRead{data: buff[:n], err: err}:
+		case <-t.done:
+			sg1.Debug("Tunnel reader for channel %s stopped.\n", t.channel.Name())
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *Tunnel) Read(b []byte) (n int, err error) {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return 0, io.EOF
+	} else if len(t.pending) > 0 {
+		n = copy(b, t.pending)
+		t.pending = t.pending[n:]
+		t.mutex.Unlock()
+		return n, nil
+	} else if t.err != nil {
+		t.mutex.Unlock()
+		return 0, t.err
+	} else if t.started == false {
+		t.started = true
+		go t.reader()
+	}
+	deadline := t.read_deadline
+	t.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if deadline.IsZero() == false {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case read := <-t.reads:
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		n = copy(b, read.data)
+		t.pending = read.data[n:]
+		t.err = read.err
+		// the error is returned once the pending data has been read
+		if len(t.pending) > 0 {
+			return n, nil
+		}
+		return n, read.err
+
+	case <-t.done:
+		return 0, io.EOF
+
+	case <-timeout:
+		return 0, timeoutError{}
+	}
+}
+
+func (t *Tunnel) Write(b []byte) (n int, err error) {
+	t.mutex.Lock()
+	closed := t.closed
+	deadline := t.write_deadline
+	t.mutex.Unlock()
+
+	if closed {
+		return 0, fmt.Errorf("Tunnel over channel %s is closed.", t.channel.Name())
+	} else if deadline.IsZero() == false && time.Now().After(deadline) {
+		return 0, timeoutError{}
+	}
+
+	return t.channel.Write(b)
+}
+
+// Let the other end of the channel know that nothing else will be written.
+func (t *Tunnel) CloseWrite() error {
+	return CloseWrite(t.channel)
+}
+
+func (t *Tunnel) Close() error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.done)
+	t.mutex.Unlock()
+
+	return t.channel.Close()
+}
+
+func (t *Tunnel) LocalAddr() net.Addr {
+	return TunnelAddr{channel: t.channel.Name()}
+}
+
+func (t *Tunnel) RemoteAddr() net.Addr {
+	return TunnelAddr{channel: t.channel.Name()}
+}
+
+func (t *Tunnel) SetDeadline(deadline time.Time) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.read_deadline = deadline
+	t.write_deadline = deadline
+	return nil
+}
+
+func (t *Tunnel) SetReadDeadline(deadline time.Time) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.read_deadline = deadline
+	return nil
+}
+
+func (t *Tunnel) SetWriteDeadline(deadline time.Time) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.write_deadline = deadline
+	return nil
+}
@@ -0,0 +1,67 @@
+package channels
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelClose(t *testing.T) {
+	server, client := newTestDirChannels(t, t.TempDir())
+	defer client.Close()
+
+	tunnel := NewTunnel(server)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tunnel.Close()
+	}()
+
+	// a pending read is unblocked by Close
+	done := make(chan error)
+	go func() {
+		_, err := tunnel.Read(make([]byte, 16))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read was not unblocked by Close.")
+	}
+}
+
+func TestTunnelError(t *testing.T) {
+	server, client := newTestDirChannels(t, t.TempDir())
+
+	tunnel := NewTunnel(server)
+	defer tunnel.Close()
+
+	_, err := client.Write([]byte("bye"))
+	assert.Nil(t, err)
+	assert.Nil(t, client.CloseWrite())
+	client.Close()
+
+	buff := make([]byte, 16)
+	n, err := tunnel.Read(buff)
+	assert.Nil(t, err)
+	assert.Equal(t, "bye", string(buff[:n]))
+
+	// the error of the channel is returned by every following Read
+	for i := 0; i < 2; i++ {
+		done := make(chan error)
+		go func() {
+			_, err := tunnel.Read(buff)
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			assert.NotNil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Read did not return the error of the channel.")
+		}
+	}
+}
@@ -30,6 +30,8 @@ import (
 	"fmt"
 	"github.com/evilsocket/sg1/sg1"
 	"net"
+	"sync"
+	"time"
 )
 
 const (
@@ -40,18 +42,32 @@ const (
 type UDPChannel struct {
 	is_client bool
 	address   *net.UDPAddr
+	peer      net.Addr
 	conn      *net.UDPConn
+	demux     *sg1.PacketDemuxer
 	seq       *sg1.PacketSequencer
+	reliable  *sg1.ReliableSender
+	closed    bool
+	mutex     *sync.Mutex
+	cond      *sync.Cond
 	stats     Stats
 }
 
 func NewUDPChannel() *UDPChannel {
-	return &UDPChannel{
+	c := &UDPChannel{
 		is_client: true,
 		address:   nil,
+		peer:      nil,
 		conn:      nil,
+		demux:     sg1.NewPacketDemuxer(),
 		seq:       sg1.NewPacketSequencer(),
+		reliable:  nil,
+		closed:    false,
+		mutex:     &sync.Mutex{},
 	}
+
+	c.cond = sync.NewCond(c.mutex)
+	return c
 }
 
 func (c *UDPChannel) Copy() interface{} {
@@ -63,7 +79,7 @@ func (c *UDPChannel) Name() string {
 }
 
 func (c *UDPChannel) Description() string {
-	return "Send data as UDP packets and read data as UDP packets ( example: udp:192.168.1.24:10013 )."
+	return "Send data as UDP packets and read data as UDP packets, the listener replies to the last peer it got packets from ( example: udp:192.168.1.24:10013 )."
 }
 
 func (c *UDPChannel) Register() error {
@@ -88,7 +104,10 @@ func (c *UDPChannel) Setup(direction Direction, args string) (err error) {
 }
 
 func (c *UDPChannel) Start() (err error) {
-	c.seq.Start()
+	if sg1.Reliable {
+		c.reliable = sg1.NewReliableSender(c.sendPacket, sg1.ReliableWindow, time.Duration(sg1.ReliableTimeout)*time.Millisecond, sg1.ReliableRetries)
+		c.reliable.Start()
+	}
 
 	if c.is_client == true {
 		local, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
@@ -99,94 +118,198 @@ func (c *UDPChannel) Start() (err error) {
 		if c.conn, err = net.DialUDP("udp", local, c.address); err != nil {
 			return err
 		}
+
+		go c.reader()
 	} else {
 		if c.conn, err = net.ListenUDP("udp", c.address); err != nil {
 			return err
 		}
 
-		go func() {
-			defer c.conn.Close()
+		sg1.Log("Started UDP listener on %s ...\n\n", c.address)
+
+		go c.reader()
+	}
+
+	return nil
+}
+
+func (c *UDPChannel) reader() {
+	buffer := make([]byte, UDPBufferSize)
+	for {
+		n, peer, err := c.conn.ReadFrom(buffer)
+		if err != nil {
+			if c.isClosed() {
+				sg1.Debug("UDP reader stopped.\n")
+				return
+			}
+			sg1.Warning("Error while reading UDP packet: %s.\n", err)
+			continue
+		}
+
+		sg1.Debug("Read %d bytes of UDP packet from %s .\n", n, peer)
 
-			sg1.Log("Started UDP listener on %s ...\n\n", c.address)
+		if c.is_client == false {
+			c.SetPeer(peer)
+		}
 
-			buffer := make([]byte, UDPBufferSize)
-			for {
-				n, peer, err := c.conn.ReadFrom(buffer)
-				if err != nil {
-					sg1.Warning("Error while reading UDP packet: %s.\n", err)
-					continue
+		if packet, err := sg1.DecodePacket(buffer[:n]); err == nil {
+			if packet.IsAck() {
+				if c.reliable != nil {
+					c.reliable.Ack(packet)
 				}
+				continue
+			}
 
-				sg1.Debug("Read %d bytes of UDP packet from %s .\n", n, peer)
+			sg1.Debug("Decoded packet of %d bytes from UDP payload.\n", packet.DataSize)
 
-				if packet, err := sg1.DecodePacket(buffer[:n]); err == nil {
-					sg1.Debug("Decoded packet of %d bytes from UDP echo payload.\n", packet.DataSize)
+			c.stats.TotalRead += int(packet.DataSize)
+			c.demux.Add(packet)
 
-					c.stats.TotalRead += int(packet.DataSize)
-					c.seq.Add(packet)
-				} else {
-					sg1.Error("Error while decoding UDP payload: %s.\n", err)
+			if sg1.Reliable {
+				if err := c.sendPacket(sg1.NewAckPacket(packet)); err != nil {
+					sg1.Warning("Error while sending UDP ACK: %s.\n", err)
 				}
 			}
-		}()
+		} else {
+			sg1.Error("Error while decoding UDP payload: %s.\n", err)
+		}
 	}
-
-	return nil
 }
 
 func (c *UDPChannel) HasReader() bool {
-	if c.is_client {
-		return false
-	}
 	return true
 }
 
 func (c *UDPChannel) HasWriter() bool {
-	if c.is_client {
-		return true
+	return true
+}
+
+func (c *UDPChannel) SetPeer(peer net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed == false && (c.peer == nil || c.peer.String() != peer.String()) {
+		sg1.Debug("Setting UDP peer to %s.\n", peer)
+		c.peer = peer
+		c.cond.Broadcast()
+	}
+}
+
+func (c *UDPChannel) GetPeer() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.peer == nil && c.closed == false {
+		sg1.Debug("Waiting for UDP peer ...\n")
+		c.cond.Wait()
+	}
+
+	return c.peer
+}
+
+func (c *UDPChannel) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *UDPChannel) CloseWrite() error {
+	c.mutex.Lock()
+	has_peer := c.peer != nil
+	wrote := c.stats.TotalWrote
+	closed := c.closed
+	c.mutex.Unlock()
+
+	if closed || c.conn == nil || c.demux.IsClosed() || (c.is_client == false && (has_peer == false || wrote == 0)) {
+		return nil
+	}
+
+	sg1.Debug("Sending UDP FIN packet.\n")
+
+	var err error
+	if fin := c.seq.Fin(); c.reliable != nil {
+		if err = c.reliable.Send(fin); err == nil {
+			err = c.reliable.Flush()
+		}
+	} else {
+		err = c.sendPacket(fin)
+	}
+
+	return err
+}
+
+func (c *UDPChannel) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
 	}
-	return false
+
+	sg1.Debug("Closing UDP channel.\n")
+
+	c.closed = true
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+
+	if c.reliable != nil {
+		c.reliable.Close()
+	}
+	c.demux.Close()
+
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
 }
 
 func (c *UDPChannel) Read(b []byte) (n int, err error) {
-	if c.is_client {
-		return 0, fmt.Errorf("icmp client can't be used for reading.")
+	packet, err := c.demux.Get()
+	if err != nil {
+		return 0, err
 	}
 
-	packet := c.seq.Get()
 	data := packet.Data
 	for i, c := range data {
 		b[i] = c
 	}
 
-	sg1.Debug("Read %d bytes from UDP listener.\n", len(data))
+	sg1.Debug("Read %d bytes from UDP channel.\n", len(data))
 
 	return len(data), nil
 }
 
-func (c *UDPChannel) sendPacket(packet *sg1.Packet) error {
-	sg1.Debug("Encapsulating %d bytes of packet in UDP echo payload for address %s.\n", packet.DataSize, c.address)
-
+func (c *UDPChannel) sendPacket(packet *sg1.Packet) (err error) {
 	data := packet.Raw()
-	if _, err := c.conn.Write(data); err != nil {
-		return err
+
+	if c.is_client {
+		sg1.Debug("Encapsulating %d bytes of packet in UDP payload for address %s.\n", packet.DataSize, c.address)
+		_, err = c.conn.Write(data)
+	} else {
+		peer := c.GetPeer()
+		if peer == nil {
+			return fmt.Errorf("UDP channel is closed.")
+		}
+		sg1.Debug("Encapsulating %d bytes of packet in UDP payload for peer %s.\n", packet.DataSize, peer)
+		_, err = c.conn.WriteTo(data, peer)
 	}
 
-	return nil
+	return err
 }
 
 func (c *UDPChannel) Write(b []byte) (n int, err error) {
-	if c.is_client == false {
-		return 0, fmt.Errorf("icmp server can't be used for writing.")
-	}
-
 	sg1.Debug("Writing %d bytes to UDP channel as chunks of %d bytes.\n", len(b), UDPChunkSize)
 
 	wrote := 0
 	for _, packet := range c.seq.Packets(b, UDPChunkSize) {
 		sg1.Debug("Sending %d bytes of encoded packet.\n", packet.DataSize)
 
-		if err := c.sendPacket(packet); err != nil {
+		if c.reliable != nil {
+			err = c.reliable.Send(packet)
+		} else {
+			err = c.sendPacket(packet)
+		}
+
+		if err != nil {
 			sg1.Error("Error while sending UDP packet: %s\n", err)
 		} else {
 			sg1.Debug("Wrote %d bytes.\n", packet.DataSize)
@@ -195,6 +318,12 @@ func (c *UDPChannel) Write(b []byte) (n int, err error) {
 		}
 	}
 
+	if c.reliable != nil {
+		if err = c.reliable.Flush(); err != nil {
+			return wrote, err
+		}
+	}
+
 	sg1.Debug("Wrote %d bytes to UDP channel.\n", wrote)
 
 	return wrote, nil
@@ -0,0 +1,365 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package channels
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/evilsocket/sg1/sg1"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	WebSocketDefaultPath = "/"
+)
+
+// WebSocketChannel carries data as binary WebSocket frames, as input it runs
+// a WebSocket server, as output it connects to it. Like the tcp channel, the
+// server only talks to the last client that connected.
+type WebSocketChannel struct {
+	use_tls   bool
+	insecure  bool
+	is_client bool
+	address   string
+	path      string
+	url       string
+	listener  net.Listener
+	server    *http.Server
+	conn      *websocket.Conn
+	client    *websocket.Conn
+	released  chan struct{}
+	closed    bool
+	mutex     *sync.Mutex
+	cond      *sync.Cond
+	stats     Stats
+}
+
+func newWebSocketChannel(use_tls bool) *WebSocketChannel {
+	c := &WebSocketChannel{
+		use_tls:   use_tls,
+		insecure:  false,
+		is_client: true,
+		address:   "",
+		path:      WebSocketDefaultPath,
+		url:       "",
+		listener:  nil,
+		server:    nil,
+		conn:      nil,
+		client:    nil,
+		released:  nil,
+		closed:    false,
+		mutex:     &sync.Mutex{},
+	}
+
+	c.cond = sync.NewCond(c.mutex)
+	return c
+}
+
+func NewWebSocketChannel() *WebSocketChannel {
+	return newWebSocketChannel(false)
+}
+
+func NewSecureWebSocketChannel() *WebSocketChannel {
+	return newWebSocketChannel(true)
+}
+
+func (c *WebSocketChannel) Copy() interface{} {
+	cp := newWebSocketChannel(c.use_tls)
+	cp.insecure = c.insecure
+	return cp
+}
+
+func (c *WebSocketChannel) Name() string {
+	if c.use_tls {
+		return "wss"
+	}
+	return "ws"
+}
+
+func (c *WebSocketChannel) Description() string {
+	if c.use_tls {
+		return "Same as ws, but over TLS with a self signed certificate, which clients must accept with -ws-insecure ( example: wss:192.168.1.2:8443/path )."
+	}
+	return "Read or write data as WebSocket frames on a server (for input) or client (for output) connection ( example: ws:192.168.1.2:8080/path )."
+}
+
+func (c *WebSocketChannel) Register() error {
+	// only wss has a certificate to verify
+	if c.use_tls {
+		flag.BoolVar(&c.insecure, "ws-insecure", c.insecure, "Do not verify the certificate of the wss server, needed to reach the self signed wss listener.")
+	}
+	return nil
+}
+
+func (c *WebSocketChannel) Setup(direction Direction, args string) (err error) {
+	if direction == INPUT_CHANNEL {
+		c.is_client = false
+	} else {
+		c.is_client = true
+	}
+
+	c.address = args
+	if idx := strings.Index(args, "/"); idx != -1 {
+		c.address = args[:idx]
+		c.path = args[idx:]
+	}
+
+	if _, _, err = net.SplitHostPort(c.address); err != nil {
+		return fmt.Errorf("Usage: %s:ADDRESS:PORT(/path)?", c.Name())
+	}
+
+	scheme := "ws"
+	if c.use_tls {
+		scheme = "wss"
+	}
+	c.url = fmt.Sprintf("%s://%s%s", scheme, c.address, c.path)
+
+	sg1.Debug("Setup %s channel: direction=%d url=%s\n", c.Name(), direction, c.url)
+
+	return nil
+}
+
+func (c *WebSocketChannel) Start() (err error) {
+	if c.is_client {
+		sg1.Log("Connecting to WebSocket endpoint %s ...\n\n", c.url)
+
+		origin := "http://" + c.address + "/"
+		if c.use_tls {
+			origin = "https://" + c.address + "/"
+		}
+
+		config, err := websocket.NewConfig(c.url, origin)
+		if err != nil {
+			return err
+		}
+		config.TlsConfig = &tls.Config{InsecureSkipVerify: c.insecure}
+
+		if c.conn, err = websocket.DialConfig(config); err != nil {
+			return err
+		}
+		c.conn.PayloadType = websocket.BinaryFrame
+
+		return nil
+	}
+
+	if c.listener, err = net.Listen("tcp", c.address); err != nil {
+		return err
+	}
+
+	if c.use_tls {
+		config, err := getCertificateConfig("", "")
+		if err != nil {
+			c.listener.Close()
+			return err
+		}
+		c.listener = tls.NewListener(c.listener, config)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(c.path, websocket.Server{
+		// we're not a browser facing service, accept any origin
+		Handshake: func(config *websocket.Config, r *http.Request) error { return nil },
+		Handler:   c.handler,
+	})
+	c.server = &http.Server{Handler: mux}
+
+	go func() {
+		sg1.Log("Started WebSocket server on %s ...\n\n", c.url)
+
+		if err := c.server.Serve(c.listener); err != nil && err != http.ErrServerClosed {
+			sg1.Error("WebSocket server stopped: %s\n", err)
+		}
+	}()
+
+	return nil
+}
+
+// The connection is closed when the handler returns, so keep it open until
+// it's replaced by a new client or the channel is closed.
+func (c *WebSocketChannel) handler(conn *websocket.Conn) {
+	sg1.Debug("Got WebSocket client connection from %s.\n", conn.Request().RemoteAddr)
+
+	conn.PayloadType = websocket.BinaryFrame
+	if released := c.SetClient(conn); released != nil {
+		<-released
+	}
+}
+
+func (c *WebSocketChannel) HasReader() bool {
+	return true
+}
+
+func (c *WebSocketChannel) HasWriter() bool {
+	return true
+}
+
+// Set the client the server talks to, returns a channel which is closed when
+// the client is replaced or the server is closed.
+func (c *WebSocketChannel) SetClient(conn *websocket.Conn) chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		conn.Close()
+		return nil
+	}
+
+	sg1.Debug("Setting WebSocket client.\n")
+
+	if c.client != nil {
+		c.client.Close()
+		close(c.released)
+	}
+
+	c.client = conn
+	c.released = make(chan struct{})
+	c.cond.Broadcast()
+
+	return c.released
+}
+
+// Return the connected client or nil if the channel has been closed.
+func (c *WebSocketChannel) GetClient() *websocket.Conn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.client == nil && c.closed == false {
+		sg1.Debug("Waiting for WebSocket client ...\n")
+		c.cond.Wait()
+	}
+
+	return c.client
+}
+
+// Forget the client if it's still the current one, its connection failed so
+// its handler can return and the server waits for the next client.
+func (c *WebSocketChannel) dropClient(conn *websocket.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.client != conn {
+		return
+	}
+
+	sg1.Debug("Dropping WebSocket client.\n")
+
+	c.client.Close()
+	c.client = nil
+	close(c.released)
+	c.released = nil
+}
+
+func (c *WebSocketChannel) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *WebSocketChannel) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	sg1.Debug("Closing %s channel.\n", c.Name())
+
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.client != nil {
+		c.client.Close()
+		close(c.released)
+	}
+	if c.server != nil {
+		c.server.Close()
+	}
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *WebSocketChannel) connection() *websocket.Conn {
+	if c.is_client {
+		return c.conn
+	}
+	return c.GetClient()
+}
+
+func (c *WebSocketChannel) Read(b []byte) (n int, err error) {
+	conn := c.connection()
+	if conn == nil {
+		return 0, io.EOF
+	}
+
+	n, err = conn.Read(b)
+	if n > 0 {
+		c.stats.TotalRead += n
+	}
+	if err != nil {
+		if c.isClosed() {
+			err = io.EOF
+		} else if c.is_client == false {
+			c.dropClient(conn)
+		}
+	}
+
+	sg1.Debug("Read %d bytes from WebSocket.\n", n)
+
+	return n, err
+}
+
+func (c *WebSocketChannel) Write(b []byte) (n int, err error) {
+	conn := c.connection()
+	if conn == nil {
+		return 0, fmt.Errorf("%s channel is closed.", c.Name())
+	}
+
+	n, err = conn.Write(b)
+	if n > 0 {
+		c.stats.TotalWrote += n
+	}
+	if err != nil && c.is_client == false {
+		c.dropClient(conn)
+	}
+
+	sg1.Debug("Wrote %d bytes to WebSocket.\n", n)
+
+	return n, err
+}
+
+func (c *WebSocketChannel) Stats() Stats {
+	return c.stats
+}
@@ -0,0 +1,88 @@
+package channels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketChannel(t *testing.T) {
+	for _, use_tls := range []bool{false, true} {
+		address := freeAddress(t) + "/sg1"
+
+		server := newWebSocketChannel(use_tls)
+		assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+		assert.Nil(t, server.Start())
+
+		client := newWebSocketChannel(use_tls)
+		// the certificate of the wss listener is self signed
+		client.insecure = use_tls
+		assert.Nil(t, client.Setup(OUTPUT_CHANNEL, address))
+		assert.Nil(t, client.Start())
+
+		_, err := client.Write([]byte("hello server"))
+		assert.Nil(t, err)
+		assert.Equal(t, "hello server", readString(t, server))
+
+		_, err = server.Write([]byte("hello client"))
+		assert.Nil(t, err)
+		assert.Equal(t, "hello client", readString(t, client))
+
+		client.Close()
+		server.Close()
+
+		_, err = server.Read(make([]byte, 16))
+		assert.NotNil(t, err)
+	}
+}
+
+func TestWebSocketChannelReconnect(t *testing.T) {
+	address := freeAddress(t)
+
+	server := NewWebSocketChannel()
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+	assert.Nil(t, server.Start())
+	defer server.Close()
+
+	first := NewWebSocketChannel()
+	assert.Nil(t, first.Setup(OUTPUT_CHANNEL, address))
+	assert.Nil(t, first.Start())
+
+	_, err := first.Write([]byte("first"))
+	assert.Nil(t, err)
+	assert.Equal(t, "first", readString(t, server))
+
+	// the failed read drops the client and releases its handler
+	first.Close()
+	_, err = server.Read(make([]byte, 16))
+	assert.NotNil(t, err)
+	server.mutex.Lock()
+	assert.Nil(t, server.client)
+	server.mutex.Unlock()
+
+	second := NewWebSocketChannel()
+	assert.Nil(t, second.Setup(OUTPUT_CHANNEL, address))
+	assert.Nil(t, second.Start())
+	defer second.Close()
+
+	_, err = second.Write([]byte("second"))
+	assert.Nil(t, err)
+	assert.Equal(t, "second", readString(t, server))
+
+	_, err = server.Write([]byte("welcome back"))
+	assert.Nil(t, err)
+	assert.Equal(t, "welcome back", readString(t, second))
+}
+
+func TestWebSocketChannelVerifiesCertificate(t *testing.T) {
+	address := freeAddress(t)
+
+	server := NewSecureWebSocketChannel()
+	assert.Nil(t, server.Setup(INPUT_CHANNEL, address))
+	assert.Nil(t, server.Start())
+	defer server.Close()
+
+	client := NewSecureWebSocketChannel()
+	assert.Nil(t, client.Setup(OUTPUT_CHANNEL, address))
+	assert.NotNil(t, client.Start())
+}
@@ -27,11 +27,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/evilsocket/sg1/channels"
@@ -46,14 +51,39 @@ func init() {
 	flag.IntVar(&sg1.Delay, "delay", sg1.Delay, "Delay in milliseconds to wait between one I/O loop and another, or 0 for no delay.")
 	flag.IntVar(&sg1.BufferSize, "buffer-size", sg1.BufferSize, "Buffer size to use while reading data to input and writing to output.")
 	flag.BoolVar(&sg1.DebugMessages, "debug", sg1.DebugMessages, "Enable debug messages.")
+	flag.BoolVar(&sg1.Reliable, "reliable", sg1.Reliable, "Acknowledge and retransmit packets on udp, icmp and dns channels, must be enabled on both ends.")
+	flag.IntVar(&sg1.ReliableWindow, "reliable-window", sg1.ReliableWindow, "Maximum number of packets waiting to be acknowledged.")
+	flag.IntVar(&sg1.ReliableTimeout, "reliable-timeout", sg1.ReliableTimeout, "Milliseconds to wait for a packet to be acknowledged before retransmitting it.")
+	flag.IntVar(&sg1.ReliableRetries, "reliable-retries", sg1.ReliableRetries, "Number of retransmissions of a packet before giving up.")
+	flag.IntVar(&sg1.PacketTimeout, "packet-timeout", sg1.PacketTimeout, "Milliseconds to wait for a missing packet on datagram channels before giving up on it, or 0 to wait forever.")
+	flag.IntVar(&sg1.MessageTimeout, "message-timeout", sg1.MessageTimeout, "Milliseconds to wait for all the packets of a message on datagram channels before giving up on the missing ones, or 0 to wait forever.")
+	flag.BoolVar(&sg1.SkipMissing, "skip-missing", sg1.SkipMissing, "Skip missing packets instead of stopping with an error.")
+	flag.IntVar(&sg1.ReorderBufferSize, "reorder-buffer", sg1.ReorderBufferSize, "Maximum number of out of order packets to keep in memory for each stream on datagram channels.")
+	flag.StringVar(&sg1.PastebinServer, "pastebin-server", sg1.PastebinServer, "Run a local stand-in of the pastebin API on this address instead of moving data, to be used with -pastebin-url.")
+	flag.StringVar(&sg1.KVServer, "kv-server", sg1.KVServer, "Run an in-memory HTTP key-value store on this address instead of moving data, to be used by kv channels.")
+	flag.StringVar(&sg1.MailServer, "mail-server", sg1.MailServer, "Run a local stand-in of an SMTP and a POP3 server on these SMTP-ADDRESS/POP3-ADDRESS instead of moving data, to be used by mail channels.")
+	flag.BoolVar(&sg1.Tunnel, "tunnel", sg1.Tunnel, "Use input and output channels as a bidirectional tunnel, only the raw module can be used with it.")
 
 	channels.Register(channels.NewConsoleChannel())
+	channels.Register(channels.NewFileChannel())
+	channels.Register(channels.NewFIFOChannel())
 	channels.Register(channels.NewTCPChannel())
+	channels.Register(channels.NewUnixChannel())
 	channels.Register(channels.NewUDPChannel())
 	channels.Register(channels.NewTLSChannel())
 	channels.Register(channels.NewDNSChannel())
+	channels.Register(channels.NewDoHChannel())
 	channels.Register(channels.NewICMPChannel())
 	channels.Register(channels.NewPastebinChannel())
+	channels.Register(channels.NewDirChannel())
+	channels.Register(channels.NewKVChannel())
+	channels.Register(channels.NewGitChannel())
+	channels.Register(channels.NewMailChannel())
+	channels.Register(channels.NewHTTPChannel())
+	channels.Register(channels.NewWebSocketChannel())
+	channels.Register(channels.NewSecureWebSocketChannel())
+	channels.Register(channels.NewSOCKS5Channel())
+	channels.Register(channels.NewSecureChannel())
 
 	modules.Register(modules.NewRaw())
 	modules.Register(modules.NewBase64())
@@ -92,7 +122,7 @@ func onError(err error) {
 
 type DataHandler func(buff []byte) (int, []byte, error)
 
-func ReadLoop(input, output channels.Channel, buffer_size, delay int, dataHandler DataHandler) error {
+func ReadLoop(input io.Reader, output io.Writer, buffer_size, delay int, dataHandler DataHandler) error {
 	var n int
 	var err error
 
@@ -101,7 +131,8 @@ func ReadLoop(input, output channels.Channel, buffer_size, delay int, dataHandle
 		// read buffer_size bytes from the input channel
 		if n, err = input.Read(buff); err != nil {
 			if err.Error() == "EOF" {
-				break
+				// the input is over, let the other end of the output know
+				return channels.CloseWrite(output)
 			} else {
 				return err
 			}
@@ -128,26 +159,130 @@ func ReadLoop(input, output channels.Channel, buffer_size, delay int, dataHandle
 			}
 		}
 	}
+}
+
+// Move data in both directions between the two tunnels until both of them
+// are over or one fails, the data handler is only used for data going from
+// input to output. When one direction is over the other end of its output is
+// told so, while data keeps flowing in the other direction.
+func TunnelLoop(input, output *channels.Tunnel, buffer_size, delay int, dataHandler DataHandler) error {
+	done := make(chan error, 2)
+
+	go func() {
+		done <- ReadLoop(input, output, buffer_size, delay, dataHandler)
+	}()
 
+	go func() {
+		done <- ReadLoop(output, input, buffer_size, delay, nil)
+	}()
+
+	var err error
+	for i := 0; i < 2 && err == nil; i++ {
+		err = <-done
+	}
+	return err
+}
+
+func checkOptions() error {
+	if sg1.ReliableWindow < 1 {
+		return fmt.Errorf("-reliable-window must be at least 1.")
+	} else if sg1.ReliableTimeout < 1 {
+		return fmt.Errorf("-reliable-timeout must be at least 1 millisecond.")
+	} else if sg1.ReliableRetries < 0 {
+		return fmt.Errorf("-reliable-retries can not be negative.")
+	} else if sg1.Tunnel && sg1.ModuleNames != "raw" {
+		// modules would only process the data going from input to output
+		return fmt.Errorf("-tunnel can only be used with the raw module.")
+	}
 	return nil
 }
 
+// Run a local stand-in of a service until interrupted.
+func serve(name string, address string, handler http.Handler) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	server := &http.Server{Addr: address, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	sg1.Log("Running %s on http://%s/ ...\n", name, address)
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		onError(err)
+	}
+}
+
+// Run the SMTP and POP3 stand-in until interrupted.
+func serveMail(addresses string) {
+	parts := strings.Split(addresses, "/")
+	if len(parts) != 2 {
+		onError(fmt.Errorf("Usage: -mail-server SMTP-ADDRESS/POP3-ADDRESS"))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	server := channels.NewMailServer()
+	if err := server.Start(parts[0], parts[1]); err != nil {
+		onError(err)
+	}
+	defer server.Close()
+
+	smtp_address, pop3_address := server.Addresses()
+	sg1.Log("Running mail stand-in with SMTP on %s and POP3 on %s ...\n", smtp_address, pop3_address)
+
+	<-ctx.Done()
+}
+
 func main() {
 	sg1.Raw(sg1.Bold("%s v%s ( %s %s )\n\n"), sg1.APP_NAME, sg1.APP_VERSION, runtime.GOOS, runtime.GOARCH)
 
 	flag.Parse()
 
+	if err := checkOptions(); err != nil {
+		onError(err)
+	}
+
+	if sg1.PastebinServer != "" {
+		serve("pastebin API stand-in", sg1.PastebinServer, channels.NewPastebinServer())
+		return
+	} else if sg1.KVServer != "" {
+		serve("key-value store", sg1.KVServer, channels.NewKVServer())
+		return
+	} else if sg1.MailServer != "" {
+		serveMail(sg1.MailServer)
+		return
+	}
+
 	var input channels.Channel
 	var output channels.Channel
+	var input_tunnel *channels.Tunnel
+	var output_tunnel *channels.Tunnel
 	var run_modules = make([]modules.Module, 0)
 	var err error
 
-	if input, err = channels.Factory(sg1.From, channels.INPUT_CHANNEL); err != nil {
-		onError(err)
-	}
+	if sg1.Tunnel {
+		if input_tunnel, err = channels.TunnelFactory(sg1.From, channels.INPUT_CHANNEL); err != nil {
+			onError(err)
+		}
 
-	if output, err = channels.Factory(sg1.To, channels.OUTPUT_CHANNEL); err != nil {
-		onError(err)
+		if output_tunnel, err = channels.TunnelFactory(sg1.To, channels.OUTPUT_CHANNEL); err != nil {
+			onError(err)
+		}
+
+		input = input_tunnel.Channel()
+		output = output_tunnel.Channel()
+	} else {
+		if input, err = channels.Factory(sg1.From, channels.INPUT_CHANNEL); err != nil {
+			onError(err)
+		}
+
+		if output, err = channels.Factory(sg1.To, channels.OUTPUT_CHANNEL); err != nil {
+			onError(err)
+		}
 	}
 
 	module_names := strings.Split(sg1.ModuleNames, ",")
@@ -160,23 +295,38 @@ func main() {
 		}
 	}
 
+	arrow := "-->"
+	if sg1.Tunnel {
+		arrow = "<->"
+	}
+
 	if len(module_names) == 1 && module_names[0] == "raw" {
-		sg1.Log("%s --> %s\n", input.Name(), output.Name())
+		sg1.Log("%s %s %s\n", input.Name(), arrow, output.Name())
 	} else {
-		sg1.Log("%s --> [%s] --> %s\n", input.Name(), sg1.ModuleNames, output.Name())
+		sg1.Log("%s %s [%s] %s %s\n", input.Name(), arrow, sg1.ModuleNames, arrow, output.Name())
 	}
 
+	// close both ends on SIGINT or SIGTERM, so that listeners and sockets
+	// are released and any pending read returns
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	channels.CloseOnCancel(ctx, input, output)
+
 	if err = input.Start(); err != nil {
+		input.Close()
 		onError(err)
 	}
 
 	if err = output.Start(); err != nil {
+		input.Close()
+		output.Close()
 		onError(err)
 	}
 
 	start := time.Now()
 
-	err = ReadLoop(input, output, sg1.BufferSize, sg1.Delay, func(buff []byte) (int, []byte, error) {
+	handler := func(buff []byte) (int, []byte, error) {
 		var run_error error
 		var ret []byte
 
@@ -191,7 +341,28 @@ func main() {
 		}
 
 		return len(buff), buff, run_error
-	})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if sg1.Tunnel {
+			done <- TunnelLoop(input_tunnel, output_tunnel, sg1.BufferSize, sg1.Delay, handler)
+		} else {
+			done <- ReadLoop(input, output, sg1.BufferSize, sg1.Delay, handler)
+		}
+	}()
+
+	// some readers, like the console one, can't be interrupted by closing the
+	// channel, so don't wait for the loop to return when we get a signal
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		sg1.Raw("\n")
+		sg1.Warning("Interrupted, shutting down ...\n")
+	}
+
+	input.Close()
+	output.Close()
 
 	if err != nil {
 		sg1.Error("%s.\n", err)
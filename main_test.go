@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/evilsocket/sg1/channels"
+	"github.com/evilsocket/sg1/sg1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelLoopHalfClose(t *testing.T) {
+	// the service the output tunnel connects to, it replies once the
+	// request is over
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer service.Close()
+
+	requests := make(chan string, 1)
+	go func() {
+		conn, err := service.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		request, _ := io.ReadAll(conn)
+		requests <- string(request)
+		time.Sleep(200 * time.Millisecond)
+		conn.Write([]byte("world"))
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	input_tunnel, err := channels.TunnelFactory("tcp:"+address, channels.INPUT_CHANNEL)
+	assert.Nil(t, err)
+	output_tunnel, err := channels.TunnelFactory("tcp:"+service.Addr().String(), channels.OUTPUT_CHANNEL)
+	assert.Nil(t, err)
+	defer input_tunnel.Close()
+	defer output_tunnel.Close()
+
+	assert.Nil(t, input_tunnel.Channel().Start())
+	assert.Nil(t, output_tunnel.Channel().Start())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- TunnelLoop(input_tunnel, output_tunnel, 1024, 0, nil)
+	}()
+
+	client, err := net.Dial("tcp", address)
+	assert.Nil(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = client.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, client.(*net.TCPConn).CloseWrite())
+
+	select {
+	case request := <-requests:
+		assert.Equal(t, "hello", request)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The end of the request did not reach the service.")
+	}
+
+	select {
+	case <-done:
+		t.Fatal("TunnelLoop returned before the reply was sent.")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the reply still flows back after the input is over
+	reply, err := io.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(reply))
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("TunnelLoop did not return once both directions were over.")
+	}
+}
+
+func TestCheckOptionsTunnelModules(t *testing.T) {
+	tunnel, module_names := sg1.Tunnel, sg1.ModuleNames
+	defer func() {
+		sg1.Tunnel, sg1.ModuleNames = tunnel, module_names
+	}()
+
+	sg1.Tunnel = true
+	sg1.ModuleNames = "raw"
+	assert.Nil(t, checkOptions())
+
+	sg1.ModuleNames = "aes"
+	assert.NotNil(t, checkOptions())
+
+	sg1.Tunnel = false
+	assert.Nil(t, checkOptions())
+}
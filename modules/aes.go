@@ -30,26 +30,55 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"flag"
 	"fmt"
 	"github.com/evilsocket/sg1/channels"
 	"github.com/evilsocket/sg1/sg1"
+	"golang.org/x/crypto/scrypt"
 	"io"
 )
 
+const (
+	AESKeySize   = 32
+	AESSaltSize  = 16
+	AESNonceSize = 12
+	AESTagSize   = 16
+	// https://godoc.org/golang.org/x/crypto/scrypt recommended parameters
+	AESScryptN = 32768
+	AESScryptR = 8
+	AESScryptP = 1
+	// salts come from the other end, so a decrypting instance only derives
+	// this many keys before rejecting records with new salts, a sender only
+	// uses one salt per run
+	AESMaxKeys = 16
+	// each AES-GCM record is prefixed by its size
+	AESRecordHeaderSize = 4
+	AESMaxRecordSize    = 64 * 1024 * 1024
+	// the CFB mode frames data as the first versions of sg1 did with their
+	// packets: sequence number, total and data size
+	AESLegacyHeaderSize = 4 + 4 + 4
+)
+
 type AES struct {
-	key  string
-	mode string
-	in   channels.Channel
-	out  channels.Channel
+	key    string
+	mode   string
+	in     channels.Channel
+	out    channels.Channel
+	salt   []byte
+	keys   map[string][]byte
+	buffer []byte
 }
 
 func NewAES() *AES {
 	return &AES{
-		key:  "",
-		mode: "encrypt",
-		in:   nil,
-		out:  nil,
+		key:    "",
+		mode:   "encrypt",
+		in:     nil,
+		out:    nil,
+		salt:   nil,
+		keys:   make(map[string][]byte),
+		buffer: make([]byte, 0),
 	}
 }
 
@@ -58,12 +87,12 @@ func (m *AES) Name() string {
 }
 
 func (m *AES) Description() string {
-	return "Read from input, encrypt or decrypt in AES and write to output ( use -aes-key and -aes-mode arguments )."
+	return "Read from input, encrypt or decrypt in AES-CFB or AES-GCM and write to output ( use -aes-key and -aes-mode arguments )."
 }
 
 func (m *AES) Register() error {
 	flag.StringVar(&m.key, "aes-key", "", "AES key.")
-	flag.StringVar(&m.mode, "aes-mode", "encrypt", "AES mode, can be 'encrypt' or 'decrypt'.")
+	flag.StringVar(&m.mode, "aes-mode", "encrypt", "AES mode, can be 'encrypt' or 'decrypt' for AES-CFB, compatible with older versions, 'encrypt-gcm' or 'decrypt-gcm' for authenticated AES-GCM with a scrypt derived key.")
 	return nil
 }
 
@@ -140,6 +169,132 @@ func (m *AES) decrypt(ciphertext []byte, keystring string) (error, []byte) {
 	return nil, ciphertext
 }
 
+func legacyFrame(data []byte) []byte {
+	frame := make([]byte, AESLegacyHeaderSize, AESLegacyHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame[4:8], 1)
+	binary.BigEndian.PutUint32(frame[8:12], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// Return the data of a legacy frame, or the buffer itself if it's not one.
+func legacyUnframe(buffer []byte) []byte {
+	if len(buffer) < AESLegacyHeaderSize {
+		return buffer
+	}
+
+	size := binary.BigEndian.Uint32(buffer[8:12])
+	if size > uint32(len(buffer)-AESLegacyHeaderSize) {
+		return buffer
+	}
+
+	return buffer[AESLegacyHeaderSize : AESLegacyHeaderSize+size]
+}
+
+// Stretch the passphrase with scrypt, derived keys are cached by salt since
+// this is purposely slow.
+func (m *AES) deriveKey(salt []byte) ([]byte, error) {
+	if key, found := m.keys[string(salt)]; found {
+		return key, nil
+	} else if len(m.keys) >= AESMaxKeys {
+		return nil, fmt.Errorf("Rejecting AES record with salt %s, already derived keys for %d different salts.", sg1.Hex(salt), len(m.keys))
+	}
+
+	sg1.Debug("Deriving AES key from passphrase with salt %s ...\n", sg1.Hex(salt))
+
+	key, err := scrypt.Key([]byte(m.key), salt, AESScryptN, AESScryptR, AESScryptP, AESKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	m.keys[string(salt)] = key
+
+	return key, nil
+}
+
+func (m *AES) getGCM(salt []byte) (cipher.AEAD, error) {
+	key, err := m.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCMWithNonceSize(block, AESNonceSize)
+}
+
+// Encrypt the plaintext as a record made of its size, the key salt, a random
+// nonce and the authenticated ciphertext.
+func (m *AES) seal(plaintext []byte) ([]byte, error) {
+	if m.salt == nil {
+		m.salt = make([]byte, AESSaltSize)
+		if _, err := io.ReadFull(rand.Reader, m.salt); err != nil {
+			m.salt = nil
+			return nil, err
+		}
+	}
+
+	gcm, err := m.getGCM(m.salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, AESNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	size := AESSaltSize + AESNonceSize + len(plaintext) + gcm.Overhead()
+	record := make([]byte, AESRecordHeaderSize, AESRecordHeaderSize+size)
+	binary.BigEndian.PutUint32(record, uint32(size))
+
+	record = append(record, m.salt...)
+	record = append(record, nonce...)
+
+	return gcm.Seal(record, nonce, plaintext, nil), nil
+}
+
+// Since channels might split or merge the data they transport, buffer it
+// until one or more complete records are available and decrypt them.
+func (m *AES) open(data []byte) ([]byte, error) {
+	plaintext := make([]byte, 0)
+	m.buffer = append(m.buffer, data...)
+
+	for len(m.buffer) >= AESRecordHeaderSize {
+		size := int(binary.BigEndian.Uint32(m.buffer))
+		if size > AESMaxRecordSize || size < AESSaltSize+AESNonceSize+AESTagSize {
+			m.buffer = m.buffer[0:0]
+			return nil, fmt.Errorf("Invalid AES record size %d.", size)
+		} else if len(m.buffer) < AESRecordHeaderSize+size {
+			sg1.Debug("Waiting for %d more bytes of AES record.\n", AESRecordHeaderSize+size-len(m.buffer))
+			break
+		}
+
+		record := m.buffer[AESRecordHeaderSize : AESRecordHeaderSize+size]
+		m.buffer = m.buffer[AESRecordHeaderSize+size:]
+
+		salt := record[:AESSaltSize]
+		nonce := record[AESSaltSize : AESSaltSize+AESNonceSize]
+		ciphertext := record[AESSaltSize+AESNonceSize:]
+
+		gcm, err := m.getGCM(salt)
+		if err != nil {
+			return nil, err
+		}
+
+		decrypted, err := gcm.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Could not authenticate AES record: %s", err)
+		}
+
+		plaintext = append(plaintext, decrypted...)
+	}
+
+	return plaintext, nil
+}
+
 func (m *AES) Run(buff []byte) (int, []byte, error) {
 	if m.key == "" {
 		return 0, nil, fmt.Errorf("No AES key specified.")
@@ -149,23 +304,20 @@ func (m *AES) Run(buff []byte) (int, []byte, error) {
 	var data []byte
 
 	if m.mode == "encrypt" {
-		size := len(buff)
-		sg1.Debug("AES encrypting %d bytes ...\n", size)
-		packet := sg1.NewPacket(0, 1, uint32(size), buff)
-		buff = packet.Raw()
-		sg1.Debug("Packet: %s\n", sg1.Hex(buff))
-
-		err, data = m.encrypt(buff, m.key)
+		sg1.Debug("AES encrypting %d bytes ...\n", len(buff))
+		err, data = m.encrypt(legacyFrame(buff), m.key)
 	} else if m.mode == "decrypt" {
 		sg1.Debug("AES decrypting %d bytes ...\n", len(buff))
-		err, data = m.decrypt(buff, m.key)
-		if err == nil {
-			if packet, err := sg1.DecodePacket(data); err == nil {
-				sg1.Debug("AES decrypted packet of %d bytes.\n", packet.DataSize)
-				sg1.Debug("Packet data: %s\n", sg1.Hex(packet.Data))
-				data = packet.Data
-			}
+		if err, data = m.decrypt(buff, m.key); err == nil {
+			data = legacyUnframe(data)
+			sg1.Debug("AES decrypted %d bytes.\n", len(data))
 		}
+	} else if m.mode == "encrypt-gcm" {
+		sg1.Debug("AES-GCM encrypting %d bytes ...\n", len(buff))
+		data, err = m.seal(buff)
+	} else if m.mode == "decrypt-gcm" {
+		sg1.Debug("AES-GCM decrypting %d bytes ...\n", len(buff))
+		data, err = m.open(buff)
 	} else {
 		err = fmt.Errorf("Unhandled AES mode '%s'.", m.mode)
 	}
@@ -0,0 +1,116 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAES(mode string) *AES {
+	m := NewAES()
+	m.key = "y0urp4ssw0rd"
+	m.mode = mode
+	return m
+}
+
+func TestAESCFB(t *testing.T) {
+	_, encrypted, err := newTestAES("encrypt").Run([]byte("hello cfb"))
+	assert.Nil(t, err)
+
+	_, decrypted, err := newTestAES("decrypt").Run(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello cfb", string(decrypted))
+}
+
+// Data is framed as the packets of older versions: sequence number 0, total
+// 1 and data size.
+func TestAESCFBLegacyFrame(t *testing.T) {
+	m := newTestAES("encrypt")
+	_, encrypted, err := m.Run([]byte("legacy"))
+	assert.Nil(t, err)
+
+	err, plaintext := m.decrypt(encrypted, m.key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 6}, plaintext[:AESLegacyHeaderSize])
+	assert.Equal(t, "legacy", string(plaintext[AESLegacyHeaderSize:]))
+
+	// what an older version sends
+	frame := make([]byte, AESLegacyHeaderSize)
+	binary.BigEndian.PutUint32(frame[4:8], 1)
+	binary.BigEndian.PutUint32(frame[8:12], 3)
+	err, encrypted = m.encrypt(append(frame, []byte("old")...), m.key)
+	assert.Nil(t, err)
+
+	_, decrypted, err := newTestAES("decrypt").Run(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(decrypted))
+}
+
+func TestAESGCM(t *testing.T) {
+	encrypter := newTestAES("encrypt-gcm")
+	decrypter := newTestAES("decrypt-gcm")
+
+	stream := []byte{}
+	for _, message := range []string{"hello", "gcm"} {
+		_, encrypted, err := encrypter.Run([]byte(message))
+		assert.Nil(t, err)
+		stream = append(stream, encrypted...)
+	}
+
+	// records can be split and merged by channels
+	decrypted := []byte{}
+	for _, chunk := range [][]byte{stream[:7], stream[7:50], stream[50:]} {
+		_, data, err := decrypter.Run(chunk)
+		assert.Nil(t, err)
+		decrypted = append(decrypted, data...)
+	}
+	assert.Equal(t, "hellogcm", string(decrypted))
+}
+
+func TestAESGCMTampered(t *testing.T) {
+	_, encrypted, err := newTestAES("encrypt-gcm").Run([]byte("hello gcm"))
+	assert.Nil(t, err)
+
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 0x01
+	_, _, err = newTestAES("decrypt-gcm").Run(tampered)
+	assert.NotNil(t, err)
+
+	wrong := newTestAES("decrypt-gcm")
+	wrong.key = "wr0ngp4ssw0rd"
+	_, _, err = wrong.Run(encrypted)
+	assert.NotNil(t, err)
+
+	// records too short to hold the tag are rejected before decrypting
+	short := make([]byte, AESRecordHeaderSize+AESSaltSize+AESNonceSize)
+	binary.BigEndian.PutUint32(short, uint32(AESSaltSize+AESNonceSize))
+	_, _, err = newTestAES("decrypt-gcm").Run(short)
+	assert.NotNil(t, err)
+}
+
+func TestAESGCMMaxKeys(t *testing.T) {
+	_, encrypted, err := newTestAES("encrypt-gcm").Run([]byte("hello gcm"))
+	assert.Nil(t, err)
+
+	decrypter := newTestAES("decrypt-gcm")
+	_, decrypted, err := decrypter.Run(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello gcm", string(decrypted))
+
+	// as many salts as allowed were already seen
+	for i := 1; i < AESMaxKeys; i++ {
+		decrypter.keys[string(rune(i))] = make([]byte, AESKeySize)
+	}
+
+	// known salts are still accepted, new ones are rejected without scrypt
+	_, decrypted, err = decrypter.Run(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello gcm", string(decrypted))
+
+	_, encrypted, err = newTestAES("encrypt-gcm").Run([]byte("new salt"))
+	assert.Nil(t, err)
+	_, _, err = decrypter.Run(encrypted)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,118 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package sg1
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type FrameType uint8
+
+// Frames are used to multiplex several logical streams on top of a single
+// sg1 channel, each stream is opened, fed with data and closed by its own
+// frames. A FRAME_CLOSE only ends the data sent by one side, the stream is
+// over once both sides sent it, while a FRAME_RESET aborts it right away.
+const (
+	FRAME_OPEN FrameType = iota
+	FRAME_OPENED
+	FRAME_DATA
+	FRAME_CLOSE
+	FRAME_RESET
+	FRAME_MAX_TYPE = FRAME_RESET
+
+	FRAME_HEADER_SIZE = 1 + 4 + 4
+	FRAME_MAX_SIZE    = 1024 * 1024
+)
+
+type Frame struct {
+	Type     FrameType
+	StreamID uint32
+	DataSize uint32
+	Data     []byte
+}
+
+func NewFrame(ftype FrameType, stream_id uint32, data []byte) *Frame {
+	return &Frame{
+		Type:     ftype,
+		StreamID: stream_id,
+		DataSize: uint32(len(data)),
+		Data:     data,
+	}
+}
+
+func (f *Frame) Raw() []byte {
+	buffer := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(f.Data))
+
+	buffer[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(buffer[1:5], f.StreamID)
+	binary.BigEndian.PutUint32(buffer[5:9], f.DataSize)
+
+	return append(buffer, f.Data...)
+}
+
+// Frames can be split or merged by the channel they're transported on, the
+// decoder buffers incoming data until one or more complete frames are available.
+type FrameDecoder struct {
+	buffer []byte
+}
+
+func NewFrameDecoder() *FrameDecoder {
+	return &FrameDecoder{
+		buffer: make([]byte, 0),
+	}
+}
+
+func (d *FrameDecoder) Feed(data []byte) (frames []*Frame, err error) {
+	d.buffer = append(d.buffer, data...)
+	frames = make([]*Frame, 0)
+
+	for len(d.buffer) >= FRAME_HEADER_SIZE {
+		ftype := FrameType(d.buffer[0])
+		stream_id := binary.BigEndian.Uint32(d.buffer[1:5])
+		size := binary.BigEndian.Uint32(d.buffer[5:9])
+
+		if ftype > FRAME_MAX_TYPE {
+			return frames, fmt.Errorf("Unknown frame type %d.", ftype)
+		} else if size > FRAME_MAX_SIZE {
+			return frames, fmt.Errorf("Frame size %d is more than the maximum allowed.", size)
+		}
+
+		frame_size := FRAME_HEADER_SIZE + int(size)
+		if len(d.buffer) < frame_size {
+			break
+		}
+
+		frame_data := make([]byte, size)
+		copy(frame_data, d.buffer[FRAME_HEADER_SIZE:frame_size])
+		frames = append(frames, NewFrame(ftype, stream_id, frame_data))
+
+		d.buffer = d.buffer[frame_size:]
+	}
+
+	return frames, nil
+}
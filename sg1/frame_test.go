@@ -0,0 +1,43 @@
+package sg1
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFrameRaw(t *testing.T) {
+	f := NewFrame(FRAME_DATA, 0x01020304, defData)
+	raw := f.Raw()
+
+	assert.Equal(t, FRAME_HEADER_SIZE+len(defData), len(raw))
+	assert.Equal(t, byte(FRAME_DATA), raw[0])
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, raw[1:5])
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x04}, raw[5:9])
+	assert.Equal(t, defData, raw[9:])
+}
+
+func TestFrameDecoderSplit(t *testing.T) {
+	a := NewFrame(FRAME_OPEN, 1, []byte("127.0.0.1:80")).Raw()
+	b := NewFrame(FRAME_CLOSE, 1, nil).Raw()
+	stream := append(a, b...)
+	d := NewFrameDecoder()
+
+	frames, err := d.Feed(stream[:5])
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(frames))
+
+	frames, err = d.Feed(stream[5:])
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(frames))
+
+	assert.Equal(t, FRAME_OPEN, frames[0].Type)
+	assert.Equal(t, []byte("127.0.0.1:80"), frames[0].Data)
+	assert.Equal(t, FRAME_CLOSE, frames[1].Type)
+	assert.Equal(t, uint32(0), frames[1].DataSize)
+}
+
+func TestFrameDecoderMalformed(t *testing.T) {
+	d := NewFrameDecoder()
+	_, err := d.Feed([]byte{0xff, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,310 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package sg1
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// "SG1K", used to detect peers which are not running the key exchange
+	KX_MAGIC   = uint32(0x5347314b)
+	KX_VERSION = uint8(1)
+	// magic, version and X25519 ephemeral public key
+	KX_HELLO_SIZE = 4 + 1 + 32
+
+	KX_KEY_SIZE   = 32
+	KX_NONCE_SIZE = 12
+	// each record is prefixed by the size of its ciphertext
+	KX_RECORD_HEADER_SIZE = 4
+	KX_MAX_RECORD_SIZE    = 16 * 1024 * 1024
+)
+
+// A SecureSession is the result of the key exchange between two sg1 peers,
+// it holds a different key for each direction and encrypts data as a stream
+// of AES-GCM records, using a counter as nonce so that records which are
+// replayed, reordered or dropped are detected.
+type SecureSession struct {
+	initiator bool
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	send_ctr  uint64
+	recv_ctr  uint64
+	peer      ed25519.PublicKey
+	mutex     *sync.Mutex
+}
+
+func kxHello(public []byte) []byte {
+	hello := make([]byte, 5, KX_HELLO_SIZE)
+	binary.BigEndian.PutUint32(hello[0:4], KX_MAGIC)
+	hello[4] = KX_VERSION
+	return append(hello, public...)
+}
+
+func kxReadHello(r io.Reader) ([]byte, error) {
+	hello := make([]byte, KX_HELLO_SIZE)
+	if _, err := io.ReadFull(r, hello); err != nil {
+		return nil, fmt.Errorf("Error while reading key exchange hello: %s", err)
+	}
+
+	if magic := binary.BigEndian.Uint32(hello[0:4]); magic != KX_MAGIC {
+		return nil, fmt.Errorf("Unexpected key exchange magic 0x%08x, is the peer using the same channel?", magic)
+	} else if version := hello[4]; version != KX_VERSION {
+		return nil, fmt.Errorf("Unsupported key exchange version %d.", version)
+	}
+
+	return hello, nil
+}
+
+func kxCipher(secret []byte, transcript []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, transcript, info, KX_KEY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCMWithNonceSize(block, KX_NONCE_SIZE)
+}
+
+// What each peer signs with its identity key, bound to the ephemeral keys
+// of both peers and to its role so it can't be replayed or reflected.
+func kxSigned(transcript []byte, initiator bool) []byte {
+	role := "responder"
+	if initiator {
+		role = "initiator"
+	}
+	return append([]byte("sg1 kx "+role+" "), transcript...)
+}
+
+func IdentityString(key ed25519.PublicKey) string {
+	return hex.EncodeToString(key)
+}
+
+func ParseIdentity(s string) (ed25519.PublicKey, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode identity public key '%s': %s", s, err)
+	} else if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Identity public key '%s' must be %d bytes long.", s, ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Run the key exchange over rw, the initiator (the output side of a channel)
+// sends its hello first. Both peers generate an ephemeral X25519 key pair and
+// derive the session keys from the shared secret and the hellos transcript.
+// If an identity key is given, it's used to sign the transcript, while if one
+// or more pinned keys are given, the peer must prove to own one of them.
+func Handshake(rw io.ReadWriter, initiator bool, identity ed25519.PrivateKey, pinned []ed25519.PublicKey) (*SecureSession, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	local := kxHello(ephemeral.PublicKey().Bytes())
+	remote := []byte(nil)
+
+	if initiator {
+		if _, err = rw.Write(local); err != nil {
+			return nil, err
+		} else if remote, err = kxReadHello(rw); err != nil {
+			return nil, err
+		}
+	} else {
+		if remote, err = kxReadHello(rw); err != nil {
+			return nil, err
+		} else if _, err = rw.Write(local); err != nil {
+			return nil, err
+		}
+	}
+
+	peer_public, err := ecdh.X25519().NewPublicKey(remote[5:])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid peer public key: %s", err)
+	}
+
+	secret, err := ephemeral.ECDH(peer_public)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	if initiator {
+		hash.Write(local)
+		hash.Write(remote)
+	} else {
+		hash.Write(remote)
+		hash.Write(local)
+	}
+	transcript := hash.Sum(nil)
+
+	s := &SecureSession{
+		initiator: initiator,
+		mutex:     &sync.Mutex{},
+	}
+
+	to_responder, err := kxCipher(secret, transcript, "sg1 initiator to responder")
+	if err != nil {
+		return nil, err
+	}
+	to_initiator, err := kxCipher(secret, transcript, "sg1 responder to initiator")
+	if err != nil {
+		return nil, err
+	}
+
+	if initiator {
+		s.send, s.recv = to_responder, to_initiator
+	} else {
+		s.send, s.recv = to_initiator, to_responder
+	}
+
+	Debug("Key exchange completed, authenticating peers ...\n")
+
+	// the first record sent by each peer is its identity public key and the
+	// signature of the transcript, or empty if it has no identity
+	auth := []byte{}
+	if identity != nil {
+		auth = append(auth, identity.Public().(ed25519.PublicKey)...)
+		auth = append(auth, ed25519.Sign(identity, kxSigned(transcript, initiator))...)
+	}
+
+	if initiator {
+		if _, err = rw.Write(s.Seal(auth)); err != nil {
+			return nil, err
+		} else if auth, err = s.ReadRecord(rw); err != nil {
+			return nil, err
+		}
+	} else {
+		peer_auth, err := s.ReadRecord(rw)
+		if err != nil {
+			return nil, err
+		} else if _, err = rw.Write(s.Seal(auth)); err != nil {
+			return nil, err
+		}
+		auth = peer_auth
+	}
+
+	if len(auth) == ed25519.PublicKeySize+ed25519.SignatureSize {
+		key := ed25519.PublicKey(auth[:ed25519.PublicKeySize])
+		if ed25519.Verify(key, kxSigned(transcript, !initiator), auth[ed25519.PublicKeySize:]) == false {
+			return nil, fmt.Errorf("Invalid identity signature from peer %s.", IdentityString(key))
+		}
+		s.peer = key
+	} else if len(auth) != 0 {
+		return nil, fmt.Errorf("Unexpected peer identity record of %d bytes.", len(auth))
+	}
+
+	if len(pinned) > 0 {
+		if s.peer == nil {
+			return nil, fmt.Errorf("Peer did not provide any identity while a pinned key was expected.")
+		}
+
+		found := false
+		for _, key := range pinned {
+			if bytes.Equal(key, s.peer) {
+				found = true
+				break
+			}
+		}
+
+		if found == false {
+			return nil, fmt.Errorf("Peer identity %s does not match any pinned key.", IdentityString(s.peer))
+		}
+	}
+
+	return s, nil
+}
+
+// Return the identity public key of the peer, or nil if it did not send one.
+func (s *SecureSession) Peer() ed25519.PublicKey {
+	return s.peer
+}
+
+func kxNonce(counter uint64) []byte {
+	nonce := make([]byte, KX_NONCE_SIZE)
+	binary.BigEndian.PutUint64(nonce[KX_NONCE_SIZE-8:], counter)
+	return nonce
+}
+
+// Encrypt the plaintext and return it as a record ready to be sent.
+func (s *SecureSession) Seal(plaintext []byte) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nonce := kxNonce(s.send_ctr)
+	s.send_ctr++
+
+	size := len(plaintext) + s.send.Overhead()
+	record := make([]byte, KX_RECORD_HEADER_SIZE, KX_RECORD_HEADER_SIZE+size)
+	binary.BigEndian.PutUint32(record, uint32(size))
+
+	return s.send.Seal(record, nonce, plaintext, nil)
+}
+
+// Read a whole record from r and return its decrypted contents.
+func (s *SecureSession) ReadRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, KX_RECORD_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > KX_MAX_RECORD_SIZE {
+		return nil, fmt.Errorf("Record size %d exceeds the maximum of %d bytes.", size, KX_MAX_RECORD_SIZE)
+	}
+
+	ciphertext := make([]byte, size)
+	if _, err := io.ReadFull(r, ciphertext); err != nil {
+		return nil, err
+	}
+
+	nonce := kxNonce(s.recv_ctr)
+	s.recv_ctr++
+
+	plaintext, err := s.recv.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not authenticate record %d: %s", s.recv_ctr-1, err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,127 @@
+package sg1
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type handshakeResult struct {
+	session *SecureSession
+	err     error
+}
+
+func testHandshake(t *testing.T, init_id, resp_id ed25519.PrivateKey, init_pinned, resp_pinned []ed25519.PublicKey) (handshakeResult, handshakeResult, net.Conn, net.Conn) {
+	a, b := net.Pipe()
+	done := make(chan handshakeResult)
+
+	go func() {
+		s, err := Handshake(b, false, resp_id, resp_pinned)
+		if err != nil {
+			b.Close()
+		}
+		done <- handshakeResult{s, err}
+	}()
+
+	s, err := Handshake(a, true, init_id, init_pinned)
+	if err != nil {
+		a.Close()
+	}
+
+	return handshakeResult{s, err}, <-done, a, b
+}
+
+func testIdentity(t *testing.T) ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	return priv
+}
+
+func TestHandshakeAnonymous(t *testing.T) {
+	init, resp, a, b := testHandshake(t, nil, nil, nil, nil)
+	assert.Nil(t, init.err)
+	assert.Nil(t, resp.err)
+	assert.Nil(t, init.session.Peer())
+	assert.Nil(t, resp.session.Peer())
+
+	go a.Write(init.session.Seal([]byte("hello responder")))
+	data, err := resp.session.ReadRecord(b)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello responder"), data)
+
+	go b.Write(resp.session.Seal([]byte("hello initiator")))
+	data, err = init.session.ReadRecord(a)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello initiator"), data)
+}
+
+func TestHandshakePinned(t *testing.T) {
+	init_id := testIdentity(t)
+	resp_id := testIdentity(t)
+	init_pub := init_id.Public().(ed25519.PublicKey)
+	resp_pub := resp_id.Public().(ed25519.PublicKey)
+
+	init, resp, _, _ := testHandshake(t, init_id, resp_id, []ed25519.PublicKey{resp_pub}, []ed25519.PublicKey{init_pub})
+	assert.Nil(t, init.err)
+	assert.Nil(t, resp.err)
+	assert.Equal(t, resp_pub, init.session.Peer())
+	assert.Equal(t, init_pub, resp.session.Peer())
+}
+
+func TestHandshakeWrongPin(t *testing.T) {
+	init_id := testIdentity(t)
+	other := testIdentity(t).Public().(ed25519.PublicKey)
+
+	_, resp, _, _ := testHandshake(t, init_id, nil, nil, []ed25519.PublicKey{other})
+	assert.NotNil(t, resp.err)
+}
+
+func TestHandshakeMissingIdentity(t *testing.T) {
+	resp_pub := testIdentity(t).Public().(ed25519.PublicKey)
+
+	init, _, _, _ := testHandshake(t, nil, nil, []ed25519.PublicKey{resp_pub}, nil)
+	assert.NotNil(t, init.err)
+}
+
+func TestSecureSessionTamperedRecord(t *testing.T) {
+	init, resp, a, b := testHandshake(t, nil, nil, nil, nil)
+	assert.Nil(t, init.err)
+	assert.Nil(t, resp.err)
+
+	record := init.session.Seal([]byte("some data"))
+	record[len(record)-1] ^= 0xff
+
+	go a.Write(record)
+	_, err := resp.session.ReadRecord(b)
+	assert.NotNil(t, err)
+}
+
+func TestSecureSessionReplayedRecord(t *testing.T) {
+	init, resp, a, b := testHandshake(t, nil, nil, nil, nil)
+	assert.Nil(t, init.err)
+	assert.Nil(t, resp.err)
+
+	record := init.session.Seal([]byte("some data"))
+
+	go a.Write(record)
+	_, err := resp.session.ReadRecord(b)
+	assert.Nil(t, err)
+
+	go a.Write(record)
+	_, err = resp.session.ReadRecord(b)
+	assert.NotNil(t, err)
+}
+
+func TestParseIdentity(t *testing.T) {
+	pub := testIdentity(t).Public().(ed25519.PublicKey)
+
+	parsed, err := ParseIdentity(IdentityString(pub))
+	assert.Nil(t, err)
+	assert.Equal(t, pub, parsed)
+
+	_, err = ParseIdentity("deadbeef")
+	assert.NotNil(t, err)
+}
@@ -33,4 +33,20 @@ var (
 	Delay         = int(0)
 	BufferSize    = 1024 * 1024
 	DebugMessages = false
+	Tunnel        = false
+
+	Reliable        = false
+	ReliableWindow  = 32
+	ReliableTimeout = 500
+	ReliableRetries = 10
+
+	PacketTimeout  = 10000
+	MessageTimeout = 0
+	SkipMissing    = false
+
+	ReorderBufferSize = 4096
+
+	PastebinServer = ""
+	KVServer       = ""
+	MailServer     = ""
 )
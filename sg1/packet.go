@@ -30,17 +30,39 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash/crc32"
+)
+
+const (
+	// "S1", used to discard anything that's not an sg1 packet
+	PACKET_MAGIC = uint16(0x5331)
+	// to be increased every time the packet format changes
+	PACKET_VERSION = uint8(1)
+	// magic, version, flags, stream id, seq number, seq total, data size and crc32
+	PACKET_HEADER_SIZE = 2 + 1 + 1 + 4 + 4 + 4 + 4 + 4
+
+	// the packet acknowledges the reception of the packet with the same
+	// stream id, sequence number and total
+	PACKET_FLAG_ACK = uint8(1 << 0)
+	// the sender reached the end of its input, no more packets will follow
+	PACKET_FLAG_FIN = uint8(1 << 1)
+	// the packet carries no data and only asks the listener for the packets
+	// it has to send back
+	PACKET_FLAG_POLL = uint8(1 << 2)
 )
 
 type Packet struct {
+	Flags     uint8
+	StreamID  uint32
 	SeqNumber uint32
 	SeqTotal  uint32
 	DataSize  uint32
 	Data      []byte
 }
 
-func NewPacket(seqn uint32, seqtot uint32, datasize uint32, data []byte) *Packet {
+func NewPacket(stream uint32, seqn uint32, seqtot uint32, datasize uint32, data []byte) *Packet {
 	return &Packet{
+		StreamID:  stream,
 		SeqNumber: seqn,
 		SeqTotal:  seqtot,
 		DataSize:  datasize,
@@ -51,7 +73,35 @@ func NewPacket(seqn uint32, seqtot uint32, datasize uint32, data []byte) *Packet
 func (p *Packet) Copy() *Packet {
 	new_data := make([]byte, p.DataSize)
 	copy(new_data, p.Data)
-	return NewPacket(p.SeqNumber, p.SeqTotal, p.DataSize, new_data)
+	cp := NewPacket(p.StreamID, p.SeqNumber, p.SeqTotal, p.DataSize, new_data)
+	cp.Flags = p.Flags
+	return cp
+}
+
+func NewAckPacket(p *Packet) *Packet {
+	ack := NewPacket(p.StreamID, p.SeqNumber, p.SeqTotal, 0, []byte{})
+	ack.Flags = PACKET_FLAG_ACK
+	return ack
+}
+
+// Poll packets have a random sequence number so that they can't be answered
+// by a cache in between.
+func NewPollPacket(stream uint32) *Packet {
+	poll := NewPacket(stream, NewStreamID(), 0, 0, []byte{})
+	poll.Flags = PACKET_FLAG_POLL
+	return poll
+}
+
+func (p *Packet) IsAck() bool {
+	return p.Flags&PACKET_FLAG_ACK != 0
+}
+
+func (p *Packet) IsFin() bool {
+	return p.Flags&PACKET_FLAG_FIN != 0
+}
+
+func (p *Packet) IsPoll() bool {
+	return p.Flags&PACKET_FLAG_POLL != 0
 }
 
 func DecodePacket(buffer []byte) (p *Packet, err error) {
@@ -60,43 +110,93 @@ func DecodePacket(buffer []byte) (p *Packet, err error) {
 		return nil, fmt.Errorf("Buffer size %d is less than minimum required.", buf_size)
 	}
 
-	seqn_buf := buffer[0:4]
-	totn_buf := buffer[4:8]
-	size_buf := buffer[8:12]
+	magic := binary.BigEndian.Uint16(buffer[0:2])
+	version := buffer[2]
+	flags := buffer[3]
+	strm_buf := buffer[4:8]
+	seqn_buf := buffer[8:12]
+	totn_buf := buffer[12:16]
+	size_buf := buffer[16:20]
+	csum_buf := buffer[20:24]
 	max_size := len(buffer) - p.HeaderSize()
 
+	if magic != PACKET_MAGIC {
+		return nil, fmt.Errorf("Unexpected packet magic 0x%04x.", magic)
+	} else if version == 0 || version > PACKET_VERSION {
+		return nil, fmt.Errorf("Unsupported packet version %d.", version)
+	}
+
+	strm := binary.BigEndian.Uint32(strm_buf)
 	seqn := binary.BigEndian.Uint32(seqn_buf)
 	totn := binary.BigEndian.Uint32(totn_buf)
 	size := binary.BigEndian.Uint32(size_buf)
+	csum := binary.BigEndian.Uint32(csum_buf)
 
 	data_buf := make([]byte, 0)
 	if size > uint32(max_size) {
 		return nil, fmt.Errorf("Data size %d is more than the %d bytes of available payload.", size, max_size)
 	} else if size > 0 {
-		data_buf = buffer[12:]
+		data_buf = buffer[p.HeaderSize():]
 	}
 
-	return NewPacket(seqn, totn, size, data_buf[:size]), nil
-}
+	if expected := packetChecksum(buffer[0:20], data_buf[:size]); csum != expected {
+		return nil, fmt.Errorf("Packet checksum 0x%08x does not match the expected 0x%08x.", csum, expected)
+	}
 
-func (p *Packet) HeaderSize() int {
-	return 4 + 4 + 4
+	p = NewPacket(strm, seqn, totn, size, data_buf[:size])
+	p.Flags = flags
+
+	return p, nil
 }
 
-func (p *Packet) Raw() []byte {
-	seqn_buf := make([]byte, 4)
-	totn_buf := make([]byte, 4)
-	size_buf := make([]byte, 4)
+// Decode a buffer made of one or more consecutive packets.
+func DecodePackets(buffer []byte) ([]*Packet, error) {
+	packets := make([]*Packet, 0)
 
-	binary.BigEndian.PutUint32(seqn_buf, p.SeqNumber)
-	binary.BigEndian.PutUint32(totn_buf, p.SeqTotal)
-	binary.BigEndian.PutUint32(size_buf, p.DataSize)
+	for len(buffer) > 0 {
+		if len(buffer) < PACKET_HEADER_SIZE {
+			return packets, fmt.Errorf("Trailing %d bytes are less than a packet header.", len(buffer))
+		}
 
-	buffer := append(size_buf, p.Data...)
-	buffer = append(totn_buf, buffer...)
-	buffer = append(seqn_buf, buffer...)
+		end := PACKET_HEADER_SIZE + int(binary.BigEndian.Uint32(buffer[16:20]))
+		if end > len(buffer) {
+			return packets, fmt.Errorf("Packet of %d bytes exceeds the %d bytes of the buffer.", end, len(buffer))
+		}
 
-	return buffer
+		packet, err := DecodePacket(buffer[:end])
+		if err != nil {
+			return packets, err
+		}
+
+		packets = append(packets, packet)
+		buffer = buffer[end:]
+	}
+
+	return packets, nil
+}
+
+func packetChecksum(header []byte, data []byte) uint32 {
+	crc := crc32.Update(0, crc32.IEEETable, header)
+	return crc32.Update(crc, crc32.IEEETable, data)
+}
+
+func (p *Packet) HeaderSize() int {
+	return PACKET_HEADER_SIZE
+}
+
+func (p *Packet) Raw() []byte {
+	header := make([]byte, PACKET_HEADER_SIZE)
+
+	binary.BigEndian.PutUint16(header[0:2], PACKET_MAGIC)
+	header[2] = PACKET_VERSION
+	header[3] = p.Flags
+	binary.BigEndian.PutUint32(header[4:8], p.StreamID)
+	binary.BigEndian.PutUint32(header[8:12], p.SeqNumber)
+	binary.BigEndian.PutUint32(header[12:16], p.SeqTotal)
+	binary.BigEndian.PutUint32(header[16:20], p.DataSize)
+	binary.BigEndian.PutUint32(header[20:24], packetChecksum(header[0:20], p.Data))
+
+	return append(header, p.Data...)
 }
 
 func (p *Packet) Hex() string {
@@ -128,8 +228,6 @@ func BufferToChunks(buffer []byte, chunk_size int) [][]byte {
 		}
 
 		chunk := buffer[done : done+size]
-		chunk = PadBuffer(chunk, chunk_size, 0x00)
-
 		chunks = append(chunks, chunk)
 
 		done += size
@@ -0,0 +1,157 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package sg1
+
+import (
+	"io"
+	"sync"
+)
+
+type demuxedPacket struct {
+	packet *Packet
+	err    error
+}
+
+// PacketDemuxer routes incoming packets to a different PacketSequencer for
+// each stream id, so that several senders can share the same listener
+// without their sequence numbers colliding. Once every stream has been
+// ended by its FIN packet, the demuxer closes itself.
+type PacketDemuxer struct {
+	mutex   *sync.Mutex
+	streams map[uint32]*PacketSequencer
+	active  int
+	out     chan demuxedPacket
+	done    chan struct{}
+	closed  bool
+}
+
+func NewPacketDemuxer() *PacketDemuxer {
+	return &PacketDemuxer{
+		mutex:   &sync.Mutex{},
+		streams: make(map[uint32]*PacketSequencer),
+		out:     make(chan demuxedPacket),
+		done:    make(chan struct{}),
+		closed:  false,
+	}
+}
+
+func (d *PacketDemuxer) sequencer(stream uint32) *PacketSequencer {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	seq, found := d.streams[stream]
+	if d.closed {
+		return nil
+	} else if found == false {
+		Debug("New stream %x, now handling %d streams.\n", stream, len(d.streams)+1)
+
+		seq = NewPacketSequencer()
+		seq.stream = stream
+		seq.Start()
+		d.streams[stream] = seq
+		d.active++
+
+		go d.forward(seq)
+	}
+
+	return seq
+}
+
+// Move every ordered packet of a stream, or its errors, to the demuxer output.
+func (d *PacketDemuxer) forward(seq *PacketSequencer) {
+	for {
+		packet, err := seq.Get()
+		if err == io.EOF {
+			d.ended(seq)
+			return
+		}
+
+		select {
+		case d.out <- demuxedPacket{packet: packet, err: err}:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *PacketDemuxer) ended(seq *PacketSequencer) {
+	d.mutex.Lock()
+	d.active--
+	active := d.active
+	d.mutex.Unlock()
+
+	Debug("Stream %x ended, %d streams still active.\n", seq.StreamID(), active)
+
+	if active == 0 {
+		d.Close()
+	}
+}
+
+// Return true if the demuxer has been closed or all of its streams ended.
+func (d *PacketDemuxer) IsClosed() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.closed
+}
+
+// Close every stream, any pending or future call to Get will return io.EOF.
+func (d *PacketDemuxer) Close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed == false {
+		Debug("Closing packet demuxer with %d streams.\n", len(d.streams))
+		d.closed = true
+		close(d.done)
+		for _, seq := range d.streams {
+			seq.Close()
+		}
+	}
+}
+
+func (d *PacketDemuxer) Streams() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.streams)
+}
+
+func (d *PacketDemuxer) Add(packet *Packet) {
+	if seq := d.sequencer(packet.StreamID); seq != nil {
+		seq.Add(packet)
+	}
+}
+
+// Return the next packet of any stream, packets of the same stream are
+// always returned in order.
+func (d *PacketDemuxer) Get() (*Packet, error) {
+	select {
+	case next := <-d.out:
+		return next.packet, next.err
+	case <-d.done:
+		return nil, io.EOF
+	}
+}
@@ -0,0 +1,80 @@
+package sg1
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestPacketDemuxer(t *testing.T) {
+	a := NewPacketSequencer()
+	b := NewPacketSequencer()
+	pa := a.Packets([]byte("aaaabbbbcccc"), 4)
+	pb := b.Packets([]byte("1111222233334444"), 4)
+
+	d := NewPacketDemuxer()
+	// interleave the streams and send them out of order
+	for _, p := range []*Packet{pb[1], pa[2], pb[0], pa[0], pb[3], pa[1], pb[2]} {
+		d.Add(p)
+	}
+
+	got := map[uint32]string{}
+	for i := 0; i < len(pa)+len(pb); i++ {
+		p, err := d.Get()
+		assert.Nil(t, err)
+		got[p.StreamID] += string(p.Data)
+	}
+
+	assert.Equal(t, 2, d.Streams())
+	assert.Equal(t, "aaaabbbbcccc", got[a.StreamID()])
+	assert.Equal(t, "1111222233334444", got[b.StreamID()])
+}
+
+func TestPacketDemuxerClose(t *testing.T) {
+	a := NewPacketSequencer()
+	d := NewPacketDemuxer()
+
+	d.Add(a.Packets([]byte("aaaa"), 4)[0])
+	d.Close()
+
+	// packets of closed demuxers are dropped
+	d.Add(a.Packets([]byte("bbbb"), 4)[0])
+
+	for i := 0; i < 2; i++ {
+		if p, err := d.Get(); err != nil {
+			assert.Equal(t, io.EOF, err)
+			return
+		} else {
+			assert.Equal(t, "aaaa", string(p.Data))
+		}
+	}
+	t.Fatal("Expected io.EOF from closed demuxer.")
+}
+
+func TestPacketDemuxerFin(t *testing.T) {
+	a := NewPacketSequencer()
+	b := NewPacketSequencer()
+	d := NewPacketDemuxer()
+
+	d.Add(a.Packets([]byte("aaaa"), 4)[0])
+	d.Add(b.Packets([]byte("bbbb"), 4)[0])
+	d.Add(a.Fin())
+
+	got := ""
+	for i := 0; i < 2; i++ {
+		p, err := d.Get()
+		assert.Nil(t, err)
+		got += string(p.Data)
+	}
+	assert.Contains(t, got, "aaaa")
+	assert.Contains(t, got, "bbbb")
+
+	// stream b is still active
+	assert.False(t, d.IsClosed())
+
+	d.Add(b.Fin())
+	p, err := d.Get()
+	assert.Nil(t, p)
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, d.IsClosed())
+}
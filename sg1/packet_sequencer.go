@@ -27,25 +27,92 @@
 package sg1
 
 import (
-	"sort"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// Returned by PacketSequencer.Get when one or more packets did not arrive in
+// time, the sequencer skips them and the next call will keep going.
+type MissingPacketsError struct {
+	From  uint32
+	Count uint32
+}
+
+func (e MissingPacketsError) Error() string {
+	if e.Count == 1 {
+		return fmt.Sprintf("Packet with sequence number %d is missing.", e.From)
+	}
+	return fmt.Sprintf("Packets with sequence numbers %d to %d are missing.", e.From, e.From+e.Count-1)
+}
+
 type PacketSequencer struct {
-	seqn  uint32
-	in    chan *Packet
-	mutex *sync.Mutex
-	cond  *sync.Cond
-	queue []*Packet
+	stream uint32
+	seqn   uint32
+	in     chan *Packet
+	done   chan struct{}
+	closed bool
+	mutex  *sync.Mutex
+	cond   *sync.Cond
+	// packets received and not returned yet, indexed by sequence number, the
+	// ones out of order are bounded to the max_pending sequence numbers
+	// following the first missing one
+	pending     map[uint32]*Packet
+	max_pending int
+	// first sequence number not received yet, packets before it are in order
+	// and only waiting to be returned
+	ready uint32
+
+	packet_timeout  time.Duration
+	message_timeout time.Duration
+	skip_missing    bool
+	// packets left to complete the message being received and when it started,
+	// if its first packets were lost this is a lower bound and exact is false
+	remaining     uint32
+	exact         bool
+	message_start time.Time
+	// sequence number of the first packet of the next message, when known
+	next_first uint32
+	next_known bool
+	missing    []uint32
+}
+
+// Generate a random stream identifier, so that packets of different senders
+// reaching the same listener are not mixed together.
+func NewStreamID() uint32 {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		Warning("Error while generating random stream id: %s\n", err)
+		return uint32(Time())
+	}
+	return binary.BigEndian.Uint32(buf)
 }
 
 func NewPacketSequencer() *PacketSequencer {
 	s := &PacketSequencer{
-		seqn:  0,
-		in:    make(chan *Packet),
-		mutex: &sync.Mutex{},
-		queue: make([]*Packet, 0),
+		stream: NewStreamID(),
+		seqn:   0,
+		in:     make(chan *Packet),
+		done:   make(chan struct{}),
+		closed: false,
+		mutex:  &sync.Mutex{},
+
+		pending:     make(map[uint32]*Packet),
+		max_pending: ReorderBufferSize,
+		ready:       0,
+
+		packet_timeout:  time.Duration(PacketTimeout) * time.Millisecond,
+		message_timeout: time.Duration(MessageTimeout) * time.Millisecond,
+		skip_missing:    SkipMissing,
+		remaining:       0,
+		exact:           false,
+		next_first:      0,
+		next_known:      true,
+		missing:         make([]uint32, 0),
 	}
 
 	s.cond = sync.NewCond(s.mutex)
@@ -53,40 +120,120 @@ func NewPacketSequencer() *PacketSequencer {
 	return s
 }
 
+// Set how long to wait for a missing packet and for a whole message to be
+// received before giving up on them, 0 means to wait forever.
+func (s *PacketSequencer) SetTimeouts(packet time.Duration, message time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.packet_timeout = packet
+	s.message_timeout = message
+}
+
+// Set the maximum number of out of order packets that can be kept in memory.
+func (s *PacketSequencer) SetReorderBufferSize(size int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if size < 1 {
+		size = 1
+	}
+	s.max_pending = size
+}
+
+// If true, missing packets are silently skipped instead of making Get return
+// a MissingPacketsError, they can be still retrieved with Missing.
+func (s *PacketSequencer) SetSkipMissing(skip bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.skip_missing = skip
+}
+
+// Return the sequence numbers of the packets which have been skipped so far.
+func (s *PacketSequencer) Missing() []uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	missing := make([]uint32, len(s.missing))
+	copy(missing, s.missing)
+	return missing
+}
+
+func (s *PacketSequencer) StreamID() uint32 {
+	return s.stream
+}
+
 func (s *PacketSequencer) Start() {
 	go s.worker()
 }
 
-func (s *PacketSequencer) add(p *Packet) {
+// Stop the sequencer, once the packets already received in order have been
+// returned Get will return io.EOF.
+func (s *PacketSequencer) Close() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	Debug("Adding packet with sequence number %d to queue.\n", p.SeqNumber)
+	if s.closed == false {
+		Debug("Closing packet sequencer for stream %x.\n", s.stream)
+		s.closed = true
+		close(s.done)
+		s.cond.Broadcast()
+	}
+}
 
-	s.queue = append(s.queue, p)
+func (s *PacketSequencer) IsClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
 
-	Debug("Sorting %d packets in queue.\n", len(s.queue))
+func (s *PacketSequencer) add(p *Packet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// retransmissions or resolvers retrying the same request might deliver
+	// the same packet more than once
+	if p.SeqNumber < s.seqn {
+		Debug("Dropping already processed packet with sequence number %d.\n", p.SeqNumber)
+		return
+	} else if _, found := s.pending[p.SeqNumber]; found {
+		Debug("Dropping duplicated packet with sequence number %d.\n", p.SeqNumber)
+		return
+	} else if p.SeqNumber-s.ready >= uint32(s.max_pending) {
+		Warning("Dropping packet with sequence number %d, more than %d packets ahead of the missing %d.\n", p.SeqNumber, s.max_pending, s.ready)
+		return
+	}
 
-	// sort by sequence number
-	sort.Slice(s.queue, func(i, j int) bool {
-		return s.queue[i].SeqNumber < s.queue[j].SeqNumber
-	})
+	Debug("Adding packet with sequence number %d to %d pending packets.\n", p.SeqNumber, len(s.pending))
 
-	/*
-		for i, p := range s.queue {
-			Debug("  packets[%d] = '%s'\n", i, string(p.Data))
-		}
-	*/
+	s.pending[p.SeqNumber] = p
+	s.updateReady()
+	s.cond.Broadcast()
+}
 
-	s.cond.Signal()
+// Move the first missing sequence number past the packets received in order.
+// Must be called with the mutex locked.
+func (s *PacketSequencer) updateReady() {
+	if s.ready < s.seqn {
+		s.ready = s.seqn
+	}
+	for s.hasSeqn(s.ready) {
+		s.ready++
+	}
 }
 
 func (s *PacketSequencer) worker() {
 	Debug("Packet sequencer started.\n")
 
 	for {
-		packet := <-s.in
-		s.add(packet)
+		select {
+		case packet := <-s.in:
+			s.add(packet)
+		case <-s.done:
+			Debug("Packet sequencer stopped.\n")
+			return
+		}
 	}
 }
 
@@ -103,35 +250,43 @@ func (s *PacketSequencer) Packets(buffer []byte, chunk_size int) []*Packet {
 	return packets
 }
 
-func (s *PacketSequencer) nextSeqNumber(n uint32, total uint32) {
-	last := total - 1
-	if n == last {
-		Debug("Got last packet (seqn=%d), reset seqn to 0.\n", n)
-		atomic.SwapUint32(&s.seqn, 0)
-	} else {
-		atomic.AddUint32(&s.seqn, 1)
-	}
+// Sequence numbers are never reset for the lifetime of a stream, this way
+// packets of consecutive messages and retransmitted packets can't be confused
+// with each other, while SeqTotal is the number of packets of the message.
+func (s *PacketSequencer) nextSeqNumber() uint32 {
+	return atomic.AddUint32(&s.seqn, 1) - 1
 }
 
 func (s *PacketSequencer) Packet(data []byte, total uint32) *Packet {
 	size := len(data)
-	packet := NewPacket(s.seqn, total, uint32(size), data)
+	seqn := s.nextSeqNumber()
+	packet := NewPacket(s.stream, seqn, total, uint32(size), data)
 
-	Debug("PacketSequencer built a packet with seqn=%d tot=%d\n", s.seqn, total)
+	Debug("PacketSequencer built a packet with stream=%x seqn=%d tot=%d\n", s.stream, seqn, total)
 
-	s.nextSeqNumber(s.seqn, total)
+	return packet
+}
 
+// Build the packet signaling the end of the stream, it takes the next
+// sequence number so it's only processed after every data packet.
+func (s *PacketSequencer) Fin() *Packet {
+	packet := s.Packet([]byte{}, 1)
+	packet.Flags = PACKET_FLAG_FIN
 	return packet
 }
 
 func (s *PacketSequencer) Add(packet *Packet) {
-	s.in <- packet.Copy()
+	select {
+	case s.in <- packet.Copy():
+	case <-s.done:
+		Debug("Dropping packet with sequence number %d, sequencer is closed.\n", packet.SeqNumber)
+	}
 }
 
 func (s *PacketSequencer) HasPacket() bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	return len(s.queue) > 0
+	return len(s.pending) > 0
 }
 
 func (s *PacketSequencer) Wait() {
@@ -140,36 +295,185 @@ func (s *PacketSequencer) Wait() {
 	s.cond.Wait()
 }
 
-func (s *PacketSequencer) WaitForSeqn(n uint32) {
+func (s *PacketSequencer) WaitForSeqn(n uint32) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.waitForSeqn(n)
+}
+
+func (s *PacketSequencer) hasSeqn(n uint32) bool {
+	_, found := s.pending[n]
+	return found
+}
+
+// Return when the packet must be considered lost, or a zero time if there is
+// no evidence of missing packets yet and we can wait indefinitely.
+func (s *PacketSequencer) deadline(since time.Time) time.Time {
+	deadline := time.Time{}
+
+	if s.remaining > 0 || len(s.pending) > 0 {
+		if s.packet_timeout > 0 {
+			deadline = since.Add(s.packet_timeout)
+		}
+
+		if s.remaining > 0 && s.message_timeout > 0 {
+			message_deadline := s.message_start.Add(s.message_timeout)
+			if deadline.IsZero() || message_deadline.Before(deadline) {
+				deadline = message_deadline
+			}
+		}
+	}
+
+	return deadline
+}
+
+// Wait for the packet with the given sequence number, returns false if the
+// timeouts expired before it was received or if the sequencer has been closed.
+// Must be called with the mutex locked.
+func (s *PacketSequencer) waitForSeqn(n uint32) bool {
 	Debug("Waiting for packet with sequence number %d.\n", n)
 
-	for {
-		if s.HasPacket() == false {
-			s.Wait()
+	since := time.Now()
+	for s.hasSeqn(n) == false {
+		if s.closed {
+			return false
 		}
 
-		s.mutex.Lock()
-		pkt := s.queue[0]
-		s.mutex.Unlock()
+		deadline := s.deadline(since)
+		if deadline.IsZero() {
+			s.cond.Wait()
+			// start counting from the first sign of a missing packet
+			since = time.Now()
+			continue
+		}
 
-		if pkt.SeqNumber == n {
-			break
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false
 		}
+
+		timer := time.AfterFunc(wait, func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.cond.Broadcast()
+		})
+		s.cond.Wait()
+		timer.Stop()
 	}
+
+	return true
 }
 
-func (s *PacketSequencer) Get() *Packet {
-	s.WaitForSeqn(s.seqn)
+// Give up on the missing packets, either until the first pending one or until
+// the end of the current message. Must be called with the mutex locked.
+func (s *PacketSequencer) skip() error {
+	from := s.seqn
+	count := s.remaining
+	if len(s.pending) > 0 {
+		count = uint32(s.max_pending)
+		for seqn := range s.pending {
+			if seqn-from < count {
+				count = seqn - from
+			}
+		}
+	}
+
+	for i := uint32(0); i < count; i++ {
+		s.missing = append(s.missing, from+i)
+	}
 
+	if s.remaining > 0 && count >= s.remaining {
+		// we skipped past the end of the current message
+		s.endMessage(from + s.remaining)
+	} else if s.remaining > 0 {
+		s.remaining -= count
+	}
+
+	atomic.AddUint32(&s.seqn, count)
+	s.updateReady()
+
+	Warning("Skipping %d missing packets starting from sequence number %d.\n", count, from)
+
+	if s.skip_missing {
+		return nil
+	}
+	return MissingPacketsError{From: from, Count: count}
+}
+
+// Return the next packet in order, if a packet is missing for longer than the
+// configured timeouts it is skipped and, unless the sequencer has been
+// configured to skip missing packets, a MissingPacketsError is returned.
+// Once the sequencer is closed or the FIN packet of the stream is reached,
+// io.EOF is returned.
+func (s *PacketSequencer) Get() (*Packet, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	packet := s.queue[0]
-	s.queue = s.queue[1:]
+	for s.waitForSeqn(s.seqn) == false {
+		if s.closed {
+			return nil, io.EOF
+		} else if err := s.skip(); err != nil {
+			return nil, err
+		}
+	}
+
+	packet := s.pending[s.seqn]
+	delete(s.pending, s.seqn)
+
+	if packet.IsFin() {
+		Debug("Got FIN packet with sequence number %d, closing stream %x.\n", packet.SeqNumber, s.stream)
+		s.nextSeqNumber()
+		if s.closed == false {
+			s.closed = true
+			close(s.done)
+			s.cond.Broadcast()
+		}
+		return nil, io.EOF
+	}
 
 	Debug("Returning packet with sequence number %d / %d.\n", packet.SeqNumber, packet.SeqTotal)
 
-	s.nextSeqNumber(packet.SeqNumber, packet.SeqTotal)
+	if s.remaining == 0 {
+		s.startMessage(packet)
+	}
+	if s.remaining--; s.remaining == 0 {
+		s.endMessage(packet.SeqNumber + 1)
+	}
 
-	return packet
+	s.nextSeqNumber()
+
+	return packet, nil
+}
+
+// Start tracking the message of the given packet. SeqTotal is the number of
+// packets of the whole message, so the packets left can only be computed if
+// we know where the message starts, otherwise we assume this is its last
+// packet: skipping fewer missing packets than needed only delays the next
+// skip, while skipping more would drop the packets of the next message.
+// Must be called with the mutex locked.
+func (s *PacketSequencer) startMessage(p *Packet) {
+	s.message_start = time.Now()
+
+	if s.next_known && p.SeqNumber >= s.next_first && p.SeqNumber-s.next_first < p.SeqTotal {
+		s.remaining = s.next_first + p.SeqTotal - p.SeqNumber
+		// if packets were skipped before this one, they might have been a
+		// whole message and this packet the first of a longer one
+		s.exact = p.SeqNumber == s.next_first
+	} else {
+		s.remaining = 1
+		s.exact = p.SeqTotal == 1
+	}
+
+	s.next_known = false
+}
+
+// The current message ended before the given sequence number, which is the
+// first of the next message only if we knew exactly where the current one
+// ended. Must be called with the mutex locked.
+func (s *PacketSequencer) endMessage(next uint32) {
+	s.remaining = 0
+	if s.exact {
+		s.next_first = next
+		s.next_known = true
+	}
 }
@@ -0,0 +1,243 @@
+package sg1
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+func newTestSequencer(packet, message time.Duration, skip bool) *PacketSequencer {
+	s := NewPacketSequencer()
+	s.SetTimeouts(packet, message)
+	s.SetSkipMissing(skip)
+	s.Start()
+	return s
+}
+
+func TestSequencerReorder(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(0, 0, false)
+
+	packets := out.Packets([]byte("0123456789"), 2)
+	for _, i := range []int{3, 1, 4, 0, 2} {
+		s.Add(packets[i])
+	}
+
+	got := ""
+	for range packets {
+		p, err := s.Get()
+		assert.Nil(t, err)
+		got += string(p.Data)
+	}
+	assert.Equal(t, "0123456789", got)
+}
+
+func TestSequencerMissingPacket(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(20*time.Millisecond, 0, false)
+
+	packets := out.Packets([]byte("aabbcc"), 2)
+	s.Add(packets[0])
+	s.Add(packets[2])
+
+	p, err := s.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "aa", string(p.Data))
+
+	p, err = s.Get()
+	assert.Nil(t, p)
+	assert.Equal(t, MissingPacketsError{From: 1, Count: 1}, err)
+
+	p, err = s.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "cc", string(p.Data))
+	assert.Equal(t, []uint32{1}, s.Missing())
+}
+
+func TestSequencerSkipMissingTail(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(20*time.Millisecond, 0, true)
+
+	first := out.Packets([]byte("aabbcc"), 2)
+	second := out.Packets([]byte("dd"), 2)
+	// the last two packets of the first message are lost
+	s.Add(first[0])
+
+	p, err := s.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "aa", string(p.Data))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Add(second[0])
+	}()
+
+	p, err = s.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "dd", string(p.Data))
+	assert.Equal(t, []uint32{1, 2}, s.Missing())
+}
+
+func TestSequencerMessageTimeout(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(0, 30*time.Millisecond, false)
+
+	packets := out.Packets([]byte("aabb"), 2)
+	s.Add(packets[0])
+
+	_, err := s.Get()
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, err = s.Get()
+	assert.Equal(t, MissingPacketsError{From: 1, Count: 1}, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestSequencerLostFirstPacket(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(20*time.Millisecond, 0, false)
+
+	first := out.Packets([]byte("aabbcc"), 2)
+	second := out.Packets([]byte("ddee"), 2)
+
+	// the first and the last packets of the first message are lost
+	s.Add(first[1])
+
+	_, err := s.Get()
+	assert.Equal(t, MissingPacketsError{From: 0, Count: 1}, err)
+
+	p, err := s.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "bb", string(p.Data))
+
+	// only the last packet of the first message is skipped
+	_, err = s.Get()
+	assert.Equal(t, MissingPacketsError{From: 2, Count: 1}, err)
+
+	for _, p := range second {
+		s.Add(p)
+	}
+	for _, expected := range []string{"dd", "ee"} {
+		p, err := s.Get()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(p.Data))
+	}
+	assert.Equal(t, []uint32{0, 2}, s.Missing())
+}
+
+func TestSequencerDuplicates(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(0, 0, false)
+
+	packets := out.Packets([]byte("aabb"), 2)
+	s.Add(packets[1])
+	s.Add(packets[1])
+	s.Add(packets[0])
+
+	for _, expected := range []string{"aa", "bb"} {
+		p, err := s.Get()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(p.Data))
+	}
+
+	s.Add(packets[0])
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, s.HasPacket())
+}
+
+func TestSequencerBoundedBuffer(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(0, 0, false)
+	s.SetReorderBufferSize(2)
+
+	packets := out.Packets([]byte("aabbcc"), 2)
+	// too far ahead of the expected sequence number
+	s.Add(packets[2])
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, s.HasPacket())
+
+	s.Add(packets[1])
+	s.Add(packets[0])
+	for _, expected := range []string{"aa", "bb"} {
+		p, err := s.Get()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(p.Data))
+	}
+}
+
+// Packets received in order and not read yet don't count against the limit.
+func TestSequencerBoundedBufferInOrder(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(0, 0, false)
+	s.SetReorderBufferSize(2)
+
+	packets := out.Packets([]byte("aabbccddee"), 2)
+	for _, p := range packets {
+		s.Add(p)
+	}
+
+	got := ""
+	for range packets {
+		p, err := s.Get()
+		assert.Nil(t, err)
+		got += string(p.Data)
+	}
+	assert.Equal(t, "aabbccddee", got)
+}
+
+func TestSequencerClose(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(0, 0, false)
+
+	packets := out.Packets([]byte("aabbcc"), 2)
+	s.Add(packets[0])
+	s.Add(packets[2])
+
+	p, err := s.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "aa", string(p.Data))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Close()
+	}()
+
+	// blocked waiting for the second packet forever
+	p, err = s.Get()
+	assert.Nil(t, p)
+	assert.Equal(t, io.EOF, err)
+
+	// adding packets to a closed sequencer must not block
+	s.Add(packets[1])
+	assert.True(t, s.IsClosed())
+}
+
+func TestSequencerFin(t *testing.T) {
+	out := NewPacketSequencer()
+	s := newTestSequencer(0, 0, false)
+
+	packets := out.Packets([]byte("aabb"), 2)
+	fin := out.Fin()
+	assert.True(t, fin.IsFin())
+
+	// the FIN packet is only processed after the data packets
+	for _, p := range []*Packet{fin, packets[1], packets[0]} {
+		s.Add(p)
+	}
+
+	got := ""
+	for range packets {
+		p, err := s.Get()
+		assert.Nil(t, err)
+		got += string(p.Data)
+	}
+	assert.Equal(t, "aabb", got)
+
+	for i := 0; i < 2; i++ {
+		p, err := s.Get()
+		assert.Nil(t, p)
+		assert.Equal(t, io.EOF, err)
+	}
+}
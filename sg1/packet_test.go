@@ -6,15 +6,17 @@ import (
 )
 
 var (
+	defStreamID  = uint32(0xdeadbeef)
 	defSeqNumber = uint32(0)
 	defSeqTotal  = uint32(1)
 	defData      = []byte{0xde, 0xad, 0xbe, 0xef}
 	defDataSize  = uint32(len(defData))
-	defPacket    = NewPacket(defSeqNumber, defSeqTotal, defDataSize, defData)
+	defPacket    = NewPacket(defStreamID, defSeqNumber, defSeqTotal, defDataSize, defData)
 	defCopy      = (*Packet)(nil)
 )
 
 func TestPacketCreation(t *testing.T) {
+	assert.Equal(t, defStreamID, defPacket.StreamID)
 	assert.Equal(t, defSeqNumber, defPacket.SeqNumber)
 	assert.Equal(t, defSeqTotal, defPacket.SeqTotal)
 	assert.Equal(t, defDataSize, defPacket.DataSize)
@@ -26,6 +28,7 @@ func TestPacketCopy(t *testing.T) {
 	defCopy = defPacket.Copy()
 	assert.NotNil(t, defCopy)
 
+	assert.Equal(t, defPacket.StreamID, defCopy.StreamID)
 	assert.Equal(t, defPacket.SeqNumber, defCopy.SeqNumber)
 	assert.Equal(t, defPacket.SeqTotal, defCopy.SeqTotal)
 	assert.Equal(t, defPacket.DataSize, defCopy.DataSize)
@@ -39,10 +42,14 @@ func TestPacketRaw(t *testing.T) {
 
 	assert.Equal(t, uint32(defPacket.HeaderSize())+defPacket.DataSize, sz)
 
-	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x00}, raw[0:4])  // seq n
-	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x01}, raw[4:8])  // seq total
-	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x04}, raw[8:12]) // data size
-	assert.Equal(t, defData, raw[12:])                         // data
+	assert.Equal(t, []byte{0x53, 0x31}, raw[0:2])               // magic
+	assert.Equal(t, PACKET_VERSION, raw[2])                     // version
+	assert.Equal(t, byte(0x00), raw[3])                         // flags
+	assert.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, raw[4:8])   // stream id
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x00}, raw[8:12])  // seq n
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x01}, raw[12:16]) // seq total
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x04}, raw[16:20]) // data size
+	assert.Equal(t, defData, raw[24:])                          // data
 }
 
 func TestDecodePacket(t *testing.T) {
@@ -53,6 +60,7 @@ func TestDecodePacket(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, p)
 
+	assert.Equal(t, defPacket.StreamID, p.StreamID)
 	assert.Equal(t, defPacket.SeqNumber, p.SeqNumber)
 	assert.Equal(t, defPacket.SeqTotal, p.SeqTotal)
 	assert.Equal(t, defPacket.DataSize, p.DataSize)
@@ -72,3 +80,76 @@ func TestDecodeMalformedPacket(t *testing.T) {
 	_, err := DecodePacket(raw)
 	assert.NotNil(t, err)
 }
+
+func TestDecodeAckPacket(t *testing.T) {
+	ack := NewAckPacket(defPacket)
+	assert.True(t, ack.IsAck())
+	assert.False(t, defPacket.IsAck())
+
+	p, err := DecodePacket(ack.Raw())
+	assert.Nil(t, err)
+	assert.True(t, p.IsAck())
+	assert.Equal(t, defPacket.StreamID, p.StreamID)
+	assert.Equal(t, defPacket.SeqNumber, p.SeqNumber)
+	assert.Equal(t, uint32(0), p.DataSize)
+}
+
+func TestDecodeForeignPacket(t *testing.T) {
+	raw := defPacket.Raw()
+	raw[0] = 0x00
+	_, err := DecodePacket(raw)
+	assert.NotNil(t, err)
+}
+
+func TestDecodeUnsupportedVersion(t *testing.T) {
+	raw := defPacket.Raw()
+	raw[2] = PACKET_VERSION + 1
+	_, err := DecodePacket(raw)
+	assert.NotNil(t, err)
+}
+
+func TestDecodeCorruptedPacket(t *testing.T) {
+	raw := defPacket.Raw()
+	raw[len(raw)-1] ^= 0xff
+	_, err := DecodePacket(raw)
+	assert.NotNil(t, err)
+
+	raw = defPacket.Raw()
+	raw[9] ^= 0x01
+	_, err = DecodePacket(raw)
+	assert.NotNil(t, err)
+}
+
+func TestDecodePackets(t *testing.T) {
+	seq := NewPacketSequencer()
+	packets := seq.Packets([]byte("some data split in packets"), 8)
+
+	buffer := []byte{}
+	for _, p := range packets {
+		buffer = append(buffer, p.Raw()...)
+	}
+
+	decoded, err := DecodePackets(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, len(packets), len(decoded))
+	for i, p := range decoded {
+		assert.Equal(t, packets[i].SeqNumber, p.SeqNumber)
+		assert.Equal(t, packets[i].Data, p.Data)
+	}
+
+	_, err = DecodePackets(buffer[:len(buffer)-1])
+	assert.NotNil(t, err)
+}
+
+// The last chunk must not be padded, or the padding would end up in the
+// data of its packet and be delivered to the other end.
+func TestBufferToChunks(t *testing.T) {
+	chunks := BufferToChunks([]byte("0123456789"), 4)
+	assert.Equal(t, [][]byte{[]byte("0123"), []byte("4567"), []byte("89")}, chunks)
+
+	packets := NewPacketSequencer().Packets([]byte("0123456789"), 4)
+	assert.Equal(t, uint32(2), packets[2].DataSize)
+	assert.Equal(t, []byte("89"), packets[2].Data)
+
+	assert.Empty(t, BufferToChunks([]byte{}, 4))
+}
@@ -0,0 +1,201 @@
+/*
+* Copyleft 2017, Simone Margaritelli <evilsocket at protonmail dot com>
+* Redistribution and use in source and binary forms, with or without
+* modification, are permitted provided that the following conditions are met:
+*
+*   * Redistributions of source code must retain the above copyright notice,
+*     this list of conditions and the following disclaimer.
+*   * Redistributions in binary form must reproduce the above copyright
+*     notice, this list of conditions and the following disclaimer in the
+*     documentation and/or other materials provided with the distribution.
+*   * Neither the name of ARM Inject nor the names of its contributors may be used
+*     to endorse or promote products derived from this software without
+*     specific prior written permission.
+*
+* THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+* AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+* IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+* ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+* LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+* CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+* SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+* INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+* CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+* ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+* POSSIBILITY OF SUCH DAMAGE.
+ */
+package sg1
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type inflightPacket struct {
+	packet   *Packet
+	sent     time.Time
+	attempts int
+}
+
+// ReliableSender keeps track of the packets sent over a datagram channel
+// until they are acknowledged by the other end, retransmitting them when the
+// timeout expires. Each packet is acknowledged individually, at most window
+// packets can be waiting for their ACK at the same time.
+type ReliableSender struct {
+	send     func(*Packet) error
+	window   int
+	timeout  time.Duration
+	retries  int
+	inflight map[uint32]*inflightPacket
+	err      error
+	done     chan struct{}
+	mutex    *sync.Mutex
+	cond     *sync.Cond
+}
+
+func NewReliableSender(send func(*Packet) error, window int, timeout time.Duration, retries int) *ReliableSender {
+	if window < 1 {
+		window = 1
+	}
+	// the worker checks for expired packets every half timeout
+	if timeout < time.Millisecond {
+		timeout = time.Millisecond
+	}
+	if retries < 0 {
+		retries = 0
+	}
+
+	r := &ReliableSender{
+		send:     send,
+		window:   window,
+		timeout:  timeout,
+		retries:  retries,
+		inflight: make(map[uint32]*inflightPacket),
+		err:      nil,
+		done:     make(chan struct{}),
+		mutex:    &sync.Mutex{},
+	}
+
+	r.cond = sync.NewCond(r.mutex)
+
+	return r
+}
+
+func (r *ReliableSender) Start() {
+	go r.worker()
+}
+
+func (r *ReliableSender) Send(packet *Packet) error {
+	r.mutex.Lock()
+
+	// wait for a free slot
+	for r.err == nil && len(r.inflight) >= r.window {
+		r.cond.Wait()
+	}
+
+	if r.err != nil {
+		r.mutex.Unlock()
+		return r.err
+	}
+
+	r.inflight[packet.SeqNumber] = &inflightPacket{
+		packet:   packet,
+		sent:     time.Now(),
+		attempts: 1,
+	}
+
+	r.mutex.Unlock()
+
+	return r.send(packet)
+}
+
+func (r *ReliableSender) Ack(ack *Packet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if sent, found := r.inflight[ack.SeqNumber]; found {
+		if sent.packet.StreamID == ack.StreamID {
+			Debug("Packet with sequence number %d acknowledged after %d attempts.\n", ack.SeqNumber, sent.attempts)
+			delete(r.inflight, ack.SeqNumber)
+			r.cond.Broadcast()
+			return
+		}
+	}
+
+	Debug("Ignoring stale ACK for sequence number %d.\n", ack.SeqNumber)
+}
+
+// Block until every packet sent so far has been acknowledged.
+func (r *ReliableSender) Flush() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for r.err == nil && len(r.inflight) > 0 {
+		r.cond.Wait()
+	}
+
+	return r.err
+}
+
+// Stop retransmitting packets, any pending or future call to Send or Flush
+// will return an error.
+func (r *ReliableSender) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	select {
+	case <-r.done:
+		return
+	default:
+		close(r.done)
+	}
+
+	if r.err == nil {
+		r.err = fmt.Errorf("Reliable sender has been closed.")
+	}
+	r.cond.Broadcast()
+}
+
+func (r *ReliableSender) expired() (resend []*Packet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	resend = make([]*Packet, 0)
+
+	for seqn, sent := range r.inflight {
+		if now.Sub(sent.sent) < r.timeout {
+			continue
+		} else if sent.attempts > r.retries {
+			r.err = fmt.Errorf("Packet with sequence number %d not acknowledged after %d attempts.", seqn, sent.attempts)
+			r.cond.Broadcast()
+			return nil
+		}
+
+		sent.attempts++
+		sent.sent = now
+		resend = append(resend, sent.packet)
+	}
+
+	return resend
+}
+
+func (r *ReliableSender) worker() {
+	ticker := time.NewTicker(r.timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, packet := range r.expired() {
+				Debug("Retransmitting packet with sequence number %d.\n", packet.SeqNumber)
+				if err := r.send(packet); err != nil {
+					Warning("Error while retransmitting packet: %s\n", err)
+				}
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
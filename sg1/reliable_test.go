@@ -0,0 +1,102 @@
+package sg1
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReliableLossyLink(t *testing.T) {
+	seq := NewPacketSequencer()
+	out := NewPacketSequencer()
+	out.Start()
+
+	var sender *ReliableSender
+	transmissions := int32(0)
+	link := make(chan *Packet, 128)
+
+	sender = NewReliableSender(func(p *Packet) error {
+		// drop every third packet
+		if atomic.AddInt32(&transmissions, 1)%3 != 0 {
+			link <- p.Copy()
+		}
+		return nil
+	}, 4, 20*time.Millisecond, 10)
+	sender.Start()
+
+	go func() {
+		acks := 0
+		for p := range link {
+			out.Add(p)
+			// drop every fourth ACK
+			if acks++; acks%4 != 0 {
+				sender.Ack(NewAckPacket(p))
+			}
+		}
+	}()
+
+	messages := []string{"hello reliable world", "hello reliable world", "bye"}
+	for _, msg := range messages {
+		for _, p := range seq.Packets([]byte(msg), 3) {
+			assert.Nil(t, sender.Send(p))
+		}
+	}
+	assert.Nil(t, sender.Flush())
+
+	for _, msg := range messages {
+		got := ""
+		for len(got) < len(msg) {
+			p, err := out.Get()
+			assert.Nil(t, err)
+			got += string(p.Data)
+		}
+		assert.Equal(t, msg, got)
+	}
+	assert.False(t, out.HasPacket())
+}
+
+func TestReliableGiveUp(t *testing.T) {
+	seq := NewPacketSequencer()
+	sender := NewReliableSender(func(p *Packet) error { return nil }, 4, 10*time.Millisecond, 2)
+	sender.Start()
+
+	for _, p := range seq.Packets([]byte("lost"), 2) {
+		assert.Nil(t, sender.Send(p))
+	}
+	assert.NotNil(t, sender.Flush())
+}
+
+func TestReliableClose(t *testing.T) {
+	seq := NewPacketSequencer()
+	sender := NewReliableSender(func(p *Packet) error { return nil }, 1, time.Second, 10)
+	sender.Start()
+
+	packets := seq.Packets([]byte("data"), 2)
+	assert.Nil(t, sender.Send(packets[0]))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sender.Close()
+	}()
+
+	// blocked waiting for a free slot in the window
+	assert.NotNil(t, sender.Send(packets[1]))
+	assert.NotNil(t, sender.Flush())
+}
+
+func TestReliableInvalidArguments(t *testing.T) {
+	seq := NewPacketSequencer()
+	sender := NewReliableSender(func(p *Packet) error { return nil }, 0, 0, -1)
+	sender.Start()
+	defer sender.Close()
+
+	assert.Equal(t, 1, sender.window)
+	assert.Equal(t, time.Millisecond, sender.timeout)
+	assert.Equal(t, 0, sender.retries)
+
+	for _, p := range seq.Packets([]byte("lost"), 4) {
+		assert.Nil(t, sender.Send(p))
+	}
+	assert.NotNil(t, sender.Flush())
+}